@@ -0,0 +1,92 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// addrMatcher is a compiled destination pattern
+type addrMatcher struct {
+	anyHost  bool
+	host     string
+	wildcard bool
+	network  *net.IPNet
+	port     int
+}
+
+// compileAddrMatcher parses a destination pattern: host, host:port or
+// :port where host is an exact name, a wildcard such as *.prod.example
+// matching every name below the suffix, an IP, a CIDR (bracketed when
+// a port follows an IPv6 one) or * for any destination. An omitted or
+// * port matches any port.
+func compileAddrMatcher(pattern string) (addrMatcher, error) {
+	var m addrMatcher
+	host, port, err := splitAddrPattern(pattern)
+	if err != nil {
+		return m, fmt.Errorf("%q: %v", pattern, err)
+	}
+	m.port = port
+	switch {
+	case host == "" || host == "*":
+		m.anyHost = true
+	case strings.Contains(host, "/"):
+		if _, m.network, err = net.ParseCIDR(host); err != nil {
+			return m, fmt.Errorf("%q: %v", pattern, err)
+		}
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		m.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case strings.HasPrefix(host, "*."):
+		m.wildcard = true
+		m.host = canonicalName(host[2:])
+	default:
+		m.host = canonicalName(host)
+	}
+	if m.anyHost && m.port == 0 && pattern != "*" {
+		return m, fmt.Errorf("%q: matches every destination, use * to mean that", pattern)
+	}
+	return m, nil
+}
+
+// matches reports whether dest fits the pattern. Names are compared
+// against dest.FQDN, networks against dest.IP.
+func (m *addrMatcher) matches(dest *AddrSpec) bool {
+	if m.port != 0 && m.port != dest.Port {
+		return false
+	}
+	switch {
+	case m.anyHost:
+		return true
+	case m.network != nil:
+		return dest.IP != nil && m.network.Contains(dest.IP)
+	case m.wildcard:
+		name := canonicalName(dest.FQDN)
+		return matchesSuffix(name, m.host) && name != m.host
+	default:
+		return dest.FQDN != "" && canonicalName(dest.FQDN) == m.host
+	}
+}
+
+// splitAddrPattern splits host:port, host or :port; a zero port means
+// the port was omitted or given as *
+func splitAddrPattern(s string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		// No port, possibly a bare IPv6 address or CIDR
+		return strings.Trim(s, "[]"), 0, nil
+	}
+	if portStr == "" || portStr == "*" {
+		return host, 0, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	return host, port, nil
+}
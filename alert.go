@@ -0,0 +1,484 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AlertKind names a way a leg can degrade
+type AlertKind string
+
+const (
+	// AlertRTTSpike is a smoothed RTT above Threshold times the leg's
+	// baseline, an average of its earlier samples. Threshold defaults
+	// to 3.
+	AlertRTTSpike AlertKind = "rtt_spike"
+	// AlertRetransmits is a share of data segments retransmitted over
+	// one interval above Threshold, 0.05 by default. Intervals with
+	// fewer than 10 data segments sent are not judged.
+	AlertRetransmits AlertKind = "retransmits"
+	// AlertZeroWindow is a peer that keeps its receive window closed
+	// while data waits to be sent, seen as at least Threshold
+	// unanswered window probes, 1 by default.
+	AlertZeroWindow AlertKind = "zero_window"
+	// AlertStuckSend is at least Threshold unsent bytes, 1 by default,
+	// with nothing acknowledged over the interval.
+	AlertStuckSend AlertKind = "stuck_send"
+)
+
+// defaultThreshold returns the threshold of a rule of kind k that
+// leaves it zero
+func (k AlertKind) defaultThreshold() float64 {
+	switch k {
+	case AlertRTTSpike:
+		return 3
+	case AlertRetransmits:
+		return 0.05
+	}
+	return 1
+}
+
+const (
+	// alertBaselineSamples is how many samples a leg needs before its
+	// RTT baseline is trusted
+	alertBaselineSamples = 5
+	// alertMinSegs is the fewest data segments an interval needs for
+	// its retransmission share to be judged
+	alertMinSegs = 10
+)
+
+// DefaultAlertCooldown is the cooldown of rules that do not set one
+const DefaultAlertCooldown = time.Minute
+
+// Alert is raised when a leg of a session degrades
+type Alert struct {
+	Kind AlertKind `json:"kind"`
+	Leg  Leg       `json:"leg"`
+	// Dest is the requested destination, empty for LegHost sockets
+	Dest   string    `json:"dest,omitempty"`
+	Local  string    `json:"local"`
+	Remote string    `json:"remote"`
+	Time   time.Time `json:"time"`
+	// Value is what the rule measured and Threshold what it allows:
+	// the RTT over its baseline, the retransmitted share, the window
+	// probes or the unsent bytes
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	// Suppressed counts the alerts of the same rule and path dropped
+	// during the cooldown before this one
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+func (a Alert) String() string {
+	s := fmt.Sprintf("%s on the %s leg %v -> %v: %.3g over %.3g", a.Kind, a.Leg, a.Local, a.Remote, a.Value, a.Threshold)
+	if a.Dest != "" {
+		s += " (" + a.Dest + ")"
+	}
+	if a.Suppressed > 0 {
+		s += fmt.Sprintf(", %d more suppressed", a.Suppressed)
+	}
+	return s
+}
+
+// AlertRule raises alerts of one kind on the legs it matches
+type AlertRule struct {
+	Kind AlertKind
+
+	// Match is a destination pattern as in RewriteRule.Match, empty
+	// matches any destination. Rules with a Match never see LegHost
+	// sockets.
+	Match string
+
+	// Leg limits the rule to one leg, empty for all of them.
+	Leg Leg
+
+	// Threshold is the limit the kind's measure must cross, zero for
+	// the kind's default.
+	Threshold float64
+
+	// For is how long the condition must hold before the rule fires,
+	// zero for the first sample that shows it.
+	For time.Duration
+
+	// Cooldown is the shortest time between two alerts of the rule for
+	// one leg and peer, DefaultAlertCooldown when zero.
+	Cooldown time.Duration
+}
+
+// AlertSink receives the alerts of an AlertDetector. Alert is called
+// from the sampler's workers and should not block.
+type AlertSink interface {
+	Alert(a Alert)
+}
+
+// AlertSinkFunc adapts a function to an AlertSink
+type AlertSinkFunc func(Alert)
+
+// Alert calls f(a)
+func (f AlertSinkFunc) Alert(a Alert) {
+	f(a)
+}
+
+// LogAlertSink writes alerts to a logger, the standard one if nil
+type LogAlertSink struct {
+	Logger *log.Logger
+}
+
+// Alert logs a
+func (l LogAlertSink) Alert(a Alert) {
+	logTo(l.Logger, "[WARN] socks: %v", a)
+}
+
+func logTo(l *log.Logger, format string, args ...interface{}) {
+	if l == nil {
+		l = log.Default()
+	}
+	l.Printf(format, args...)
+}
+
+// ChanAlertSink hands alerts to an embedder over a channel. Alerts
+// that find the channel full are dropped.
+type ChanAlertSink chan<- Alert
+
+// Alert sends a unless the channel is full
+func (c ChanAlertSink) Alert(a Alert) {
+	select {
+	case c <- a:
+	default:
+	}
+}
+
+// WebhookAlertSink posts each alert as JSON to a local endpoint. Posts
+// happen in the background; alerts that arrive while its queue is full
+// are dropped and counted.
+type WebhookAlertSink struct {
+	url    string
+	client *http.Client
+	logger *log.Logger
+	queue  chan Alert
+
+	mu      sync.Mutex
+	dropped int
+	closed  bool
+	done    chan struct{}
+}
+
+// NewWebhookAlertSink creates a sink posting to rawURL, which must be
+// an http or https URL on a loopback address, giving up on each post
+// after timeout, 5s by default. Failed posts are logged to logger, the
+// standard one if nil.
+func NewWebhookAlertSink(rawURL string, timeout time.Duration, logger *log.Logger) (*WebhookAlertSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Unsupported webhook scheme %q", u.Scheme)
+	}
+	if host := u.Hostname(); host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("Webhook host %q is not a loopback address", host)
+		}
+	}
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	w := &WebhookAlertSink{
+		url:    rawURL,
+		client: &http.Client{Timeout: timeout},
+		logger: logger,
+		queue:  make(chan Alert, 64),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Alert queues a for posting
+func (w *WebhookAlertSink) Alert(a Alert) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.queue <- a:
+	default:
+		w.dropped++
+	}
+}
+
+// Dropped returns how many alerts were dropped on a full queue
+func (w *WebhookAlertSink) Dropped() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dropped
+}
+
+// Close posts the alerts still queued and stops the sink
+func (w *WebhookAlertSink) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	<-w.done
+	return nil
+}
+
+func (w *WebhookAlertSink) run() {
+	defer close(w.done)
+	for a := range w.queue {
+		if err := w.post(a); err != nil {
+			logTo(w.logger, "[ERR] socks: Failed to post alert: %v", err)
+		}
+	}
+}
+
+func (w *WebhookAlertSink) post(a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", w.url, resp.Status)
+	}
+	return nil
+}
+
+// AlertDetector judges the sample streams of monitored legs against
+// its rules and hands the alerts to its sinks. A rule fires when its
+// condition starts to hold on a leg, then stays quiet for that kind of
+// leg and peer until its cooldown has passed, counting what it drops.
+type AlertDetector struct {
+	rules []compiledAlert
+	sinks []AlertSink
+
+	mu   sync.Mutex
+	last map[alertKey]*alertHistory
+}
+
+type compiledAlert struct {
+	AlertRule
+	matcher *addrMatcher
+}
+
+// alertKey de-duplicates the alerts of a rule per leg and peer
+type alertKey struct {
+	rule int
+	leg  Leg
+	peer string
+}
+
+type alertHistory struct {
+	at         time.Time
+	suppressed int
+}
+
+// NewAlertDetector validates rules and builds an AlertDetector
+func NewAlertDetector(rules []AlertRule, sinks ...AlertSink) (*AlertDetector, error) {
+	d := &AlertDetector{sinks: sinks, last: make(map[alertKey]*alertHistory)}
+	for i, rule := range rules {
+		switch rule.Kind {
+		case AlertRTTSpike, AlertRetransmits, AlertZeroWindow, AlertStuckSend:
+		default:
+			return nil, fmt.Errorf("alert rule %d: unknown kind %q", i+1, rule.Kind)
+		}
+		switch rule.Leg {
+		case "", LegClient, LegUpstream, LegHost:
+		default:
+			return nil, fmt.Errorf("alert rule %d: unknown leg %q", i+1, rule.Leg)
+		}
+		if rule.Threshold < 0 {
+			return nil, fmt.Errorf("alert rule %d: negative threshold", i+1)
+		}
+		c := compiledAlert{AlertRule: rule}
+		if c.Threshold == 0 {
+			c.Threshold = rule.Kind.defaultThreshold()
+		}
+		if c.Cooldown == 0 {
+			c.Cooldown = DefaultAlertCooldown
+		}
+		if rule.Match != "" {
+			m, err := compileAddrMatcher(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("alert rule %d: match %v", i+1, err)
+			}
+			c.matcher = &m
+		}
+		d.rules = append(d.rules, c)
+	}
+	return d, nil
+}
+
+// Stream starts judging the samples of one leg
+func (d *AlertDetector) Stream() *AlertStream {
+	return &AlertStream{d: d, since: make([]time.Time, len(d.rules)), firing: make([]bool, len(d.rules))}
+}
+
+// raise hands a to the sinks unless the rule is cooling down for the
+// leg and peer
+func (d *AlertDetector) raise(rule int, a Alert) {
+	key := alertKey{rule: rule, leg: a.Leg, peer: peerOf(a.Remote)}
+	cooldown := d.rules[rule].Cooldown
+	d.mu.Lock()
+	h := d.last[key]
+	if h != nil && a.Time.Sub(h.at) < cooldown {
+		h.suppressed++
+		d.mu.Unlock()
+		return
+	}
+	if h == nil {
+		h = &alertHistory{}
+		d.last[key] = h
+	}
+	a.Suppressed, h.suppressed, h.at = h.suppressed, 0, a.Time
+	if len(d.last) > 4096 {
+		for k, old := range d.last {
+			if a.Time.Sub(old.at) >= d.rules[k.rule].Cooldown && old.suppressed == 0 {
+				delete(d.last, k)
+			}
+		}
+	}
+	d.mu.Unlock()
+	for _, s := range d.sinks {
+		s.Alert(a)
+	}
+}
+
+// peerOf returns the host part of addr, so that every connection to
+// one peer shares a cooldown
+func peerOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// AlertStream is the state of one leg's sample stream. It is not safe
+// for concurrent use.
+type AlertStream struct {
+	d *AlertDetector
+
+	// baseline is the moving average of the RTTs that were not spikes
+	baseline time.Duration
+	samples  int
+
+	// since is when each rule's condition started to hold, firing
+	// whether it fired since
+	since  []time.Time
+	firing []bool
+}
+
+// Observe judges one sample of the leg. Final samples are ignored.
+func (st *AlertStream) Observe(ls LegSample) {
+	if ls.Final || ls.Sample == nil {
+		return
+	}
+	spiking := false
+	for i := range st.d.rules {
+		rule := &st.d.rules[i]
+		if !rule.applies(ls) {
+			continue
+		}
+		value, held := st.measure(rule, ls)
+		if rule.Kind == AlertRTTSpike {
+			spiking = spiking || held
+		}
+		if !held {
+			st.since[i], st.firing[i] = time.Time{}, false
+			continue
+		}
+		if st.since[i].IsZero() {
+			st.since[i] = ls.Sample.Time
+		}
+		if st.firing[i] || ls.Sample.Time.Sub(st.since[i]) < rule.For {
+			continue
+		}
+		st.firing[i] = true
+		a := Alert{
+			Kind:      rule.Kind,
+			Leg:       ls.Leg,
+			Time:      ls.Sample.Time,
+			Value:     value,
+			Threshold: rule.Threshold,
+		}
+		if ls.Local != nil {
+			a.Local = ls.Local.String()
+		}
+		if ls.Remote != nil {
+			a.Remote = ls.Remote.String()
+		}
+		if ls.Request != nil && ls.Request.DestAddr != nil {
+			dest := ls.Request.DestAddr
+			host := dest.FQDN
+			if host == "" {
+				host = dest.IP.String()
+			}
+			a.Dest = net.JoinHostPort(host, strconv.Itoa(dest.Port))
+		}
+		st.d.raise(i, a)
+	}
+
+	// Spikes would drag the baseline up and hide the next ones
+	if rtt := ls.Sample.RTT; rtt > 0 && !spiking {
+		if st.samples == 0 {
+			st.baseline = rtt
+		} else {
+			st.baseline += (rtt - st.baseline) / 8
+		}
+		st.samples++
+	}
+}
+
+// applies reports whether the rule judges ls
+func (r *compiledAlert) applies(ls LegSample) bool {
+	if r.Leg != "" && r.Leg != ls.Leg {
+		return false
+	}
+	if r.matcher != nil {
+		return ls.Request != nil && ls.Request.DestAddr != nil && r.matcher.matches(ls.Request.DestAddr)
+	}
+	return true
+}
+
+// measure returns the rule's measure of ls and whether it crosses the
+// threshold
+func (st *AlertStream) measure(r *compiledAlert, ls LegSample) (float64, bool) {
+	s, d := ls.Sample, ls.Delta
+	switch r.Kind {
+	case AlertRTTSpike:
+		if st.samples < alertBaselineSamples || st.baseline == 0 {
+			return 0, false
+		}
+		v := float64(s.RTT) / float64(st.baseline)
+		return v, v > r.Threshold
+	case AlertRetransmits:
+		if d == nil || d.DataSegsOut < alertMinSegs {
+			return 0, false
+		}
+		return d.RetransRatio, d.RetransRatio > r.Threshold
+	case AlertZeroWindow:
+		// Unanswered probes with nothing queued are keepalives
+		v := float64(s.WindowProbes)
+		return v, s.NotSentBytes > 0 && v >= r.Threshold
+	case AlertStuckSend:
+		v := float64(s.NotSentBytes)
+		return v, d != nil && d.BytesAcked == 0 && v >= r.Threshold
+	}
+	return 0, false
+}
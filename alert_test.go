@@ -0,0 +1,214 @@
+package socks5
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kennnnny/RRDproxy/sampler"
+)
+
+// alertFeed feeds synthetic samples of one upstream leg to a stream
+type alertFeed struct {
+	st   *AlertStream
+	now  time.Time
+	req  *Request
+	peer net.Addr
+}
+
+func newAlertFeed(d *AlertDetector) *alertFeed {
+	return &alertFeed{
+		st:   d.Stream(),
+		now:  time.Unix(1000, 0),
+		req:  &Request{DestAddr: &AddrSpec{FQDN: "slow.example", Port: 443}},
+		peer: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443},
+	}
+}
+
+func (f *alertFeed) next(s sampler.Sample, d *sampler.Delta) {
+	f.now = f.now.Add(time.Second)
+	s.Time = f.now
+	f.st.Observe(LegSample{
+		Leg:     LegUpstream,
+		Request: f.req,
+		Local:   &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000},
+		Remote:  f.peer,
+		Sample:  &s,
+		Delta:   d,
+	})
+}
+
+func collectAlerts(t *testing.T, rules ...AlertRule) (*AlertDetector, *[]Alert) {
+	var alerts []Alert
+	d, err := NewAlertDetector(rules, AlertSinkFunc(func(a Alert) { alerts = append(alerts, a) }))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return d, &alerts
+}
+
+func TestAlert_RTTSpike(t *testing.T) {
+	d, alerts := collectAlerts(t, AlertRule{Kind: AlertRTTSpike, Cooldown: 10 * time.Second})
+	f := newAlertFeed(d)
+	for i := 0; i < alertBaselineSamples; i++ {
+		f.next(sampler.Sample{RTT: 10 * time.Millisecond}, nil)
+	}
+	if len(*alerts) != 0 {
+		t.Fatalf("alert before a spike: %v", *alerts)
+	}
+
+	// A lasting spike is one alert and does not move the baseline
+	f.next(sampler.Sample{RTT: 50 * time.Millisecond}, nil)
+	f.next(sampler.Sample{RTT: 50 * time.Millisecond}, nil)
+	if len(*alerts) != 1 {
+		t.Fatalf("expected one alert, got %v", *alerts)
+	}
+	a := (*alerts)[0]
+	if a.Kind != AlertRTTSpike || a.Leg != LegUpstream || a.Value != 5 || a.Threshold != 3 || a.Dest != "slow.example:443" || a.Remote != "192.0.2.1:443" {
+		t.Fatalf("bad alert: %+v", a)
+	}
+
+	// A second spike within the cooldown is suppressed, and counted
+	// by the first alert after it
+	f.next(sampler.Sample{RTT: 10 * time.Millisecond}, nil)
+	f.next(sampler.Sample{RTT: 50 * time.Millisecond}, nil)
+	if len(*alerts) != 1 {
+		t.Fatalf("expected the spike to be suppressed, got %v", *alerts)
+	}
+	for i := 0; i < 10; i++ {
+		f.next(sampler.Sample{RTT: 10 * time.Millisecond}, nil)
+	}
+	f.next(sampler.Sample{RTT: 50 * time.Millisecond}, nil)
+	if len(*alerts) != 2 || (*alerts)[1].Suppressed != 1 {
+		t.Fatalf("expected an alert after the cooldown, got %+v", *alerts)
+	}
+}
+
+func TestAlert_Cooldown_SharedPerPeer(t *testing.T) {
+	d, alerts := collectAlerts(t, AlertRule{Kind: AlertRetransmits})
+	lossy := &sampler.Delta{DataSegsOut: 100, RetransRatio: 0.2}
+
+	// Every connection to one peer shares the cooldown
+	a, b := newAlertFeed(d), newAlertFeed(d)
+	b.peer = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 8443}
+	a.next(sampler.Sample{}, lossy)
+	b.next(sampler.Sample{}, lossy)
+	if len(*alerts) != 1 {
+		t.Fatalf("expected one alert per peer, got %v", *alerts)
+	}
+
+	c := newAlertFeed(d)
+	c.peer = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 443}
+	c.next(sampler.Sample{}, lossy)
+	if len(*alerts) != 2 {
+		t.Fatalf("expected an alert for another peer, got %v", *alerts)
+	}
+}
+
+func TestAlert_Kinds(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   AlertRule
+		sample sampler.Sample
+		delta  *sampler.Delta
+		want   bool
+	}{
+		{"retransmits", AlertRule{Kind: AlertRetransmits}, sampler.Sample{}, &sampler.Delta{DataSegsOut: 100, RetransRatio: 0.1}, true},
+		{"few segments", AlertRule{Kind: AlertRetransmits}, sampler.Sample{}, &sampler.Delta{DataSegsOut: 5, RetransRatio: 0.4}, false},
+		{"below threshold", AlertRule{Kind: AlertRetransmits, Threshold: 0.2}, sampler.Sample{}, &sampler.Delta{DataSegsOut: 100, RetransRatio: 0.1}, false},
+		{"zero window", AlertRule{Kind: AlertZeroWindow}, sampler.Sample{WindowProbes: 2, NotSentBytes: 4096}, nil, true},
+		{"keepalive", AlertRule{Kind: AlertZeroWindow}, sampler.Sample{WindowProbes: 2}, nil, false},
+		{"stuck", AlertRule{Kind: AlertStuckSend}, sampler.Sample{NotSentBytes: 4096}, &sampler.Delta{}, true},
+		{"draining", AlertRule{Kind: AlertStuckSend}, sampler.Sample{NotSentBytes: 4096}, &sampler.Delta{BytesAcked: 1}, false},
+		{"other leg", AlertRule{Kind: AlertStuckSend, Leg: LegClient}, sampler.Sample{NotSentBytes: 4096}, &sampler.Delta{}, false},
+		{"matched", AlertRule{Kind: AlertStuckSend, Match: "*.example"}, sampler.Sample{NotSentBytes: 4096}, &sampler.Delta{}, true},
+		{"not matched", AlertRule{Kind: AlertStuckSend, Match: "*.example.org"}, sampler.Sample{NotSentBytes: 4096}, &sampler.Delta{}, false},
+	}
+	for _, tt := range tests {
+		d, alerts := collectAlerts(t, tt.rule)
+		newAlertFeed(d).next(tt.sample, tt.delta)
+		if got := len(*alerts) == 1; got != tt.want {
+			t.Errorf("%s: alerted %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAlert_For(t *testing.T) {
+	d, alerts := collectAlerts(t, AlertRule{Kind: AlertStuckSend, For: 3 * time.Second})
+	f := newAlertFeed(d)
+	stuck := sampler.Sample{NotSentBytes: 4096}
+	for i := 0; i < 3; i++ {
+		f.next(stuck, &sampler.Delta{})
+	}
+	f.next(stuck, &sampler.Delta{BytesAcked: 100})
+	f.next(stuck, &sampler.Delta{})
+	if len(*alerts) != 0 {
+		t.Fatalf("alert before the condition held long enough: %v", *alerts)
+	}
+	for i := 0; i < 3; i++ {
+		f.next(stuck, &sampler.Delta{})
+	}
+	if len(*alerts) != 1 || (*alerts)[0].Value != 4096 {
+		t.Fatalf("expected one alert, got %+v", *alerts)
+	}
+}
+
+func TestNewAlertDetector_Errors(t *testing.T) {
+	for _, rule := range []AlertRule{
+		{Kind: "latency"},
+		{Kind: AlertRTTSpike, Leg: "sideways"},
+		{Kind: AlertRTTSpike, Threshold: -1},
+		{Kind: AlertRTTSpike, Match: "10.0.0.0/99"},
+	} {
+		if _, err := NewAlertDetector([]AlertRule{rule}); err == nil {
+			t.Errorf("expected an error for %+v", rule)
+		}
+	}
+}
+
+func TestChanAlertSink(t *testing.T) {
+	ch := make(chan Alert, 1)
+	sink := ChanAlertSink(ch)
+	sink.Alert(Alert{Kind: AlertRTTSpike})
+	sink.Alert(Alert{Kind: AlertZeroWindow}) // dropped, not blocking
+	if a := <-ch; a.Kind != AlertRTTSpike {
+		t.Fatalf("bad alert: %+v", a)
+	}
+}
+
+func TestWebhookAlertSink(t *testing.T) {
+	got := make(chan Alert, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a Alert
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Errorf("err: %v", err)
+		}
+		got <- a
+	}))
+	defer srv.Close()
+
+	w, err := NewWebhookAlertSink(srv.URL, time.Second, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	w.Alert(Alert{Kind: AlertStuckSend, Leg: LegClient, Value: 4096})
+	w.Close()
+	w.Alert(Alert{Kind: AlertStuckSend}) // ignored once closed
+	a := <-got
+	if a.Kind != AlertStuckSend || a.Leg != LegClient || a.Value != 4096 {
+		t.Fatalf("bad alert: %+v", a)
+	}
+	if len(got) != 0 {
+		t.Fatalf("posted after Close")
+	}
+
+	for _, u := range []string{"http://192.0.2.1/alerts", "ftp://127.0.0.1/", "http://alerts.example/"} {
+		if _, err := NewWebhookAlertSink(u, 0, nil); err == nil || !strings.Contains(err.Error(), "ebhook") {
+			t.Errorf("%s: expected an error, got %v", u, err)
+		}
+	}
+}
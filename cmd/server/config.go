@@ -0,0 +1,915 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kennnnny/RRDproxy"
+)
+
+// serverConfig is what a config file describes
+type serverConfig struct {
+	listeners []listenerConfig
+	socks     *socks5.Config
+	// webhook is the alert sink to close when the config is replaced
+	webhook *socks5.WebhookAlertSink
+	// dot is the DoT resolver whose idle connections to close then
+	dot *socks5.DoTResolver
+	// pools are the upstream pools whose health checks to stop then
+	pools []*socks5.UpstreamPool
+}
+
+// close releases what the config holds once it was replaced or failed
+// to load
+func (c *serverConfig) close() {
+	if c.webhook != nil {
+		c.webhook.Close()
+	}
+	if c.dot != nil {
+		c.dot.CloseIdleConnections()
+	}
+	for _, p := range c.pools {
+		p.Close()
+	}
+}
+
+// listenerConfig describes one address to accept connections on and
+// the policy overrides for its connections
+type listenerConfig struct {
+	name        string
+	network     string
+	address     string
+	transparent bool
+	tlsCert     string
+	tlsKey      string
+	authMethods []socks5.Authenticator
+	rules       socks5.RuleSet
+	monitor     socks5.MonitorPolicy
+}
+
+// configErrors lists every problem found in a config file
+type configErrors []error
+
+func (e configErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// section reads the keys of one table. Problems are recorded against
+// the full key name, keys that are never read are reported as unknown.
+type section struct {
+	file string
+	path string
+	t    *tomlTable
+	used map[string]bool
+	errs *configErrors
+}
+
+func (s *section) key(k string) string {
+	if s.path == "" {
+		return k
+	}
+	return s.path + "." + k
+}
+
+func (s *section) fail(k string, format string, args ...interface{}) {
+	line := 0
+	if s.t != nil {
+		line = s.t.line
+		if v, ok := s.t.values[k]; ok {
+			line = v.line
+		}
+	}
+	*s.errs = append(*s.errs, fmt.Errorf("%s:%d: %s: %s", s.file, line, s.key(k), fmt.Sprintf(format, args...)))
+}
+
+func (s *section) get(k string) (interface{}, bool) {
+	if s.t == nil {
+		return nil, false
+	}
+	s.used[k] = true
+	v, ok := s.t.values[k]
+	return v.v, ok
+}
+
+func (s *section) str(k, def string) string {
+	v, ok := s.get(k)
+	if !ok {
+		return def
+	}
+	str, ok := v.(string)
+	if !ok {
+		s.fail(k, "expected a string")
+		return def
+	}
+	return str
+}
+
+func (s *section) strs(k string) []string {
+	v, ok := s.get(k)
+	if !ok {
+		return nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		s.fail(k, "expected an array of strings")
+		return nil
+	}
+	out := make([]string, 0, len(list))
+	for _, e := range list {
+		str, ok := e.(string)
+		if !ok {
+			s.fail(k, "expected an array of strings")
+			return nil
+		}
+		out = append(out, str)
+	}
+	return out
+}
+
+func (s *section) boolean(k string, def bool) bool {
+	v, ok := s.get(k)
+	if !ok {
+		return def
+	}
+	b, ok := v.(bool)
+	if !ok {
+		s.fail(k, "expected true or false")
+		return def
+	}
+	return b
+}
+
+func (s *section) integer(k string, def int) int {
+	v, ok := s.get(k)
+	if !ok {
+		return def
+	}
+	n, ok := v.(int64)
+	if !ok || n < 0 {
+		s.fail(k, "expected a non-negative integer")
+		return def
+	}
+	return int(n)
+}
+
+func (s *section) number(k string, def float64) float64 {
+	v, ok := s.get(k)
+	if !ok {
+		return def
+	}
+	var f float64
+	switch n := v.(type) {
+	case int64:
+		f = float64(n)
+	case float64:
+		f = n
+	default:
+		ok = false
+	}
+	if !ok || f < 0 {
+		s.fail(k, "expected a non-negative number")
+		return def
+	}
+	return f
+}
+
+func (s *section) duration(k string) time.Duration {
+	str := s.str(k, "")
+	if str == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil || d < 0 {
+		s.fail(k, "invalid duration %q", str)
+		return 0
+	}
+	return d
+}
+
+// finish reports the keys of the table nobody asked for
+func (s *section) finish() {
+	if s.t == nil {
+		return
+	}
+	for _, k := range s.t.keys {
+		if !s.used[k] {
+			s.fail(k, "unknown key")
+		}
+	}
+}
+
+// configDecoder hands out the sections of a parsed file and remembers
+// which ones were read
+type configDecoder struct {
+	file string
+	doc  *tomlDoc
+	used map[string]bool
+	errs configErrors
+}
+
+func (d *configDecoder) table(name string) *section {
+	d.used[name] = true
+	return &section{file: d.file, path: name, t: d.doc.tables[name], used: make(map[string]bool), errs: &d.errs}
+}
+
+func (d *configDecoder) array(name string) []*section {
+	d.used[name] = true
+	var out []*section
+	for i, t := range d.doc.arrays[name] {
+		out = append(out, &section{
+			file: d.file,
+			path: fmt.Sprintf("%s[%d]", name, i),
+			t:    t,
+			used: make(map[string]bool),
+			errs: &d.errs,
+		})
+	}
+	return out
+}
+
+// fail records a problem with the table or array of tables name as a
+// whole
+func (d *configDecoder) fail(name string, err error) {
+	line := 0
+	if t, ok := d.doc.tables[name]; ok {
+		line = t.line
+	} else if ts := d.doc.arrays[name]; len(ts) > 0 {
+		line = ts[0].line
+	}
+	d.errs = append(d.errs, fmt.Errorf("%s:%d: %s: %v", d.file, line, name, err))
+}
+
+// finish reports tables nobody asked for
+func (d *configDecoder) finish() {
+	for _, name := range d.doc.order {
+		if !d.used[name] {
+			line := 0
+			if t, ok := d.doc.tables[name]; ok {
+				line = t.line
+			} else {
+				line = d.doc.arrays[name][0].line
+			}
+			d.errs = append(d.errs, fmt.Errorf("%s:%d: %s: unknown table", d.file, line, name))
+		}
+	}
+}
+
+// loadConfig reads and validates the config file at path
+func loadConfig(path string) (*serverConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	doc, err := parseTOML(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	d := &configDecoder{file: path, doc: doc, used: make(map[string]bool)}
+	conf := &serverConfig{socks: &socks5.Config{}}
+
+	root := d.table("")
+	root.finish()
+
+	d.decodeAuth(conf.socks)
+	d.decodeListeners(conf)
+	if len(conf.listeners) == 0 {
+		d.errs = append(d.errs, fmt.Errorf("%s: listener: at least one [[listener]] is required", path))
+	}
+
+	d.decodeResolver(conf)
+	d.decodeRules(conf.socks)
+	d.decodeRewrites(conf.socks)
+	d.decodeDialer(conf)
+
+	timeouts := d.table("timeouts")
+	conf.socks.HandshakeTimeout = timeouts.duration("handshake")
+	conf.socks.DialTimeout = timeouts.duration("dial")
+	conf.socks.IdleTimeout = timeouts.duration("idle")
+	conf.socks.MaxSessionLifetime = timeouts.duration("lifetime")
+	conf.socks.LingerTimeout = timeouts.duration("linger")
+	timeouts.finish()
+
+	limits := d.table("limits")
+	conf.socks.MaxConnections = limits.integer("max_connections", 0)
+	limits.finish()
+
+	monitor := d.table("monitor")
+	conf.socks.DisableMonitor = !monitor.boolean("enabled", true)
+	conf.socks.MonitorInterval = monitor.duration("interval")
+	conf.socks.MonitorJitter = monitor.duration("jitter")
+	conf.socks.MonitorWorkers = monitor.integer("workers", 0)
+	monitor.finish()
+
+	mss := d.table("mss")
+	conf.socks.DisableMSSClamp = !mss.boolean("clamp", true)
+	conf.socks.MSS = mss.integer("normal", 0)
+	conf.socks.RetransmitMSS = mss.integer("retransmit", 0)
+	mss.finish()
+
+	d.decodeTuning(conf.socks)
+
+	profiles := d.table("profiles")
+	opts := socks5.PathProfileOptions{
+		Path:         profiles.str("path", ""),
+		IPv4Bits:     profiles.integer("ipv4_prefix", 0),
+		IPv6Bits:     profiles.integer("ipv6_prefix", 0),
+		HalfLife:     profiles.duration("half_life"),
+		MaxAge:       profiles.duration("max_age"),
+		SaveInterval: profiles.duration("save_interval"),
+	}
+	if profiles.boolean("enabled", false) {
+		p, err := socks5.NewPathProfiles(opts)
+		if err != nil {
+			profiles.fail("path", "%v", err)
+		}
+		conf.socks.PathProfiles = p
+	}
+	profiles.finish()
+
+	mtu := d.table("mtu")
+	prober := &socks5.MTUProber{
+		MinMSS:    mtu.integer("min_mss", 0),
+		Precision: mtu.integer("precision", 0),
+		MaxAge:    mtu.duration("max_age"),
+		MaxPaths:  mtu.integer("max_paths", 0),
+	}
+	if mtu.boolean("probe", false) {
+		conf.socks.MTUProber = prober
+	}
+	mtu.finish()
+
+	d.decodeAlerts(conf)
+
+	d.finish()
+	if len(d.errs) > 0 {
+		conf.close()
+		return nil, d.errs
+	}
+	return conf, nil
+}
+
+func (d *configDecoder) decodeAuth(conf *socks5.Config) {
+	auth := d.table("auth")
+	creds := d.table("auth.credentials")
+	if creds.t != nil {
+		store := make(socks5.StaticCredentials)
+		for _, user := range creds.t.keys {
+			store[user] = creds.str(user, "")
+		}
+		conf.Credentials = store
+	}
+	conf.AuthMethods = authMethods(auth, "methods", conf.Credentials)
+	auth.finish()
+	creds.finish()
+}
+
+// authMethods builds the authenticators named under key
+func authMethods(s *section, key string, creds socks5.CredentialStore) []socks5.Authenticator {
+	var methods []socks5.Authenticator
+	for _, m := range s.strs(key) {
+		switch m {
+		case "none":
+			methods = append(methods, socks5.NoAuthAuthenticator{})
+		case "userpass":
+			if creds == nil {
+				s.fail(key, "userpass needs [auth.credentials]")
+				continue
+			}
+			methods = append(methods, socks5.UserPassAuthenticator{Credentials: creds})
+		default:
+			s.fail(key, "unknown method %q", m)
+		}
+	}
+	return methods
+}
+
+func (d *configDecoder) decodeListeners(conf *serverConfig) {
+	names := make(map[string]bool)
+	for i, s := range d.array("listener") {
+		l := listenerConfig{
+			name:        s.str("name", fmt.Sprintf("listener%d", i)),
+			network:     s.str("network", "tcp"),
+			address:     s.str("address", ""),
+			transparent: s.boolean("transparent", false),
+			tlsCert:     s.str("tls_cert", ""),
+			tlsKey:      s.str("tls_key", ""),
+			authMethods: authMethods(s, "auth_methods", conf.socks.Credentials),
+		}
+		if names[l.name] {
+			s.fail("name", "duplicate listener name %q", l.name)
+		}
+		names[l.name] = true
+
+		switch l.network {
+		case "tcp":
+			if l.address == "" {
+				s.fail("address", "missing listen address")
+			} else if _, _, err := net.SplitHostPort(l.address); err != nil {
+				s.fail("address", "%v", err)
+			}
+		case "unix":
+			if l.address == "" {
+				s.fail("address", "missing socket path")
+			}
+			if l.transparent {
+				s.fail("transparent", "only TCP listeners can be transparent")
+			}
+		default:
+			s.fail("network", "unknown network %q, expected tcp or unix", l.network)
+		}
+		if (l.tlsCert == "") != (l.tlsKey == "") {
+			s.fail("tls_cert", "tls_cert and tls_key go together")
+		} else if l.tlsCert != "" {
+			if _, err := tls.LoadX509KeyPair(l.tlsCert, l.tlsKey); err != nil {
+				s.fail("tls_cert", "%v", err)
+			}
+		}
+
+		if allow := s.strs("allow"); allow != nil {
+			rules := &socks5.PermitCommand{}
+			for _, cmd := range allow {
+				switch cmd {
+				case "connect":
+					rules.EnableConnect = true
+				case "bind":
+					rules.EnableBind = true
+				case "associate":
+					rules.EnableAssociate = true
+				default:
+					s.fail("allow", "unknown command %q, expected connect, bind or associate", cmd)
+				}
+			}
+			l.rules = rules
+		}
+		if _, ok := s.t.values["monitor"]; ok {
+			l.monitor = socks5.MonitorDisabled
+			if s.boolean("monitor", false) {
+				l.monitor = socks5.MonitorEnabled
+			}
+		}
+		s.finish()
+		conf.listeners = append(conf.listeners, l)
+	}
+}
+
+// listen opens the listener described by l
+func (l listenerConfig) listen() (*socks5.Listener, error) {
+	ln, err := net.Listen(l.network, l.address)
+	if err != nil {
+		return nil, err
+	}
+	if l.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(l.tlsCert, l.tlsKey)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	policy := l.policy()
+	policy.Listener, policy.Transparent = ln, l.transparent
+	return policy, nil
+}
+
+// policy returns the overrides of l for its connections, which a
+// reload swaps in without reopening the listener
+func (l listenerConfig) policy() *socks5.Listener {
+	return &socks5.Listener{
+		Name:        l.name,
+		AuthMethods: l.authMethods,
+		Rules:       l.rules,
+		Monitor:     l.monitor,
+	}
+}
+
+func (d *configDecoder) decodeResolver(sc *serverConfig) {
+	conf := sc.socks
+	s := d.table("resolver")
+	upstreams := s.strs("upstreams")
+	timeout := s.duration("timeout")
+
+	var resolver socks5.NameResolver
+	switch typ := s.str("type", "system"); typ {
+	case "system":
+		resolver = socks5.DNSResolver{}
+	case "doh":
+		resolver = &socks5.DoHResolver{Upstreams: upstreams, Timeout: timeout}
+	case "dot":
+		sc.dot = &socks5.DoTResolver{Upstreams: upstreams, Timeout: timeout}
+		resolver = sc.dot
+	default:
+		s.fail("type", "unknown resolver %q, expected system, doh or dot", typ)
+	}
+	if typ := s.str("type", "system"); typ != "system" && len(upstreams) == 0 {
+		s.fail("upstreams", "%s resolver needs at least one upstream", typ)
+	}
+
+	switch prefer := s.str("prefer", "ipv4"); prefer {
+	case "ipv4":
+		conf.IPPreference = socks5.PreferIPv4
+	case "ipv6":
+		conf.IPPreference = socks5.PreferIPv6
+	case "ipv4-only":
+		conf.IPPreference = socks5.IPv4Only
+	case "ipv6-only":
+		conf.IPPreference = socks5.IPv6Only
+	default:
+		s.fail("prefer", "unknown preference %q, expected ipv4, ipv6, ipv4-only or ipv6-only", prefer)
+	}
+	conf.FallbackDelay = s.duration("fallback_delay")
+
+	if path := s.str("hosts_file", ""); path != "" {
+		hosts, err := readHosts(path)
+		if err != nil {
+			s.fail("hosts_file", "%v", err)
+		}
+		resolver = socks5.NewRoutingResolver(hosts, nil, resolver)
+	}
+	s.finish()
+
+	cache := d.table("resolver.cache")
+	if cache.boolean("enabled", false) {
+		resolver = &socks5.CachingResolver{
+			Resolver:    resolver,
+			DefaultTTL:  cache.duration("default_ttl"),
+			NegativeTTL: cache.duration("negative_ttl"),
+			StaleTTL:    cache.duration("stale_ttl"),
+			MaxEntries:  cache.integer("max_entries", 0),
+		}
+	} else {
+		for _, k := range []string{"default_ttl", "negative_ttl", "stale_ttl", "max_entries"} {
+			cache.get(k)
+		}
+	}
+	cache.finish()
+	conf.Resolver = resolver
+}
+
+func readHosts(path string) (map[string][]net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return socks5.ParseHosts(f)
+}
+
+func (d *configDecoder) decodeRules(conf *socks5.Config) {
+	s := d.table("rules")
+	if s.t != nil {
+		conf.Rules = &socks5.PermitCommand{
+			EnableConnect:   s.boolean("connect", true),
+			EnableBind:      s.boolean("bind", true),
+			EnableAssociate: s.boolean("associate", true),
+		}
+	}
+	s.finish()
+}
+
+func (d *configDecoder) decodeRewrites(conf *socks5.Config) {
+	var rules []socks5.RewriteRule
+	for _, s := range d.array("rewrite") {
+		rule := socks5.RewriteRule{Match: s.str("match", ""), Target: s.str("target", "")}
+		if rule.Match == "" {
+			s.fail("match", "missing pattern")
+		}
+		if rule.Target == "" {
+			s.fail("target", "missing target")
+		}
+		if rule.Match != "" && rule.Target != "" {
+			if _, err := socks5.NewTableRewriter([]socks5.RewriteRule{rule}); err != nil {
+				failRule(s, err, "match", "target")
+			}
+		}
+		s.finish()
+		rules = append(rules, rule)
+	}
+	if len(rules) > 0 {
+		if rw, err := socks5.NewTableRewriter(rules); err != nil {
+			d.fail("rewrite", err)
+		} else {
+			conf.Rewriter = rw
+		}
+	}
+}
+
+func (d *configDecoder) decodeTuning(conf *socks5.Config) {
+	var rules []socks5.TuningRule
+	for _, s := range d.array("tuning") {
+		rule := socks5.TuningRule{
+			User:  s.str("user", ""),
+			Match: s.str("match", ""),
+			Leg:   socks5.Leg(s.str("leg", "")),
+			Tuning: socks5.SocketTuning{
+				SendBuffer:        s.integer("send_buffer", 0),
+				ReceiveBuffer:     s.integer("receive_buffer", 0),
+				Nagle:             s.boolean("nagle", false),
+				KeepAliveIdle:     s.duration("keepalive_idle"),
+				KeepAliveInterval: s.duration("keepalive_interval"),
+				KeepAliveCount:    s.integer("keepalive_count", 0),
+				NotSentLowWater:   s.integer("notsent_lowat", 0),
+				UserTimeout:       s.duration("user_timeout"),
+			},
+		}
+		switch rule.Leg {
+		case "", socks5.LegClient, socks5.LegUpstream:
+			if _, err := socks5.NewSocketTuner([]socks5.TuningRule{rule}); err != nil {
+				failRule(s, err, "match")
+			}
+		default:
+			s.fail("leg", "expected \"client\" or \"upstream\"")
+		}
+		s.finish()
+		rules = append(rules, rule)
+	}
+	if len(rules) > 0 {
+		if t, err := socks5.NewSocketTuner(rules); err != nil {
+			d.fail("tuning", err)
+		} else {
+			conf.Tuner = t
+		}
+	}
+
+	growth := d.table("tuning.growth")
+	if growth.boolean("enabled", false) {
+		conf.BufferGrowth = &socks5.BufferGrowth{Max: growth.integer("max", 0)}
+	} else {
+		growth.integer("max", 0)
+	}
+	growth.finish()
+}
+
+func (d *configDecoder) decodeAlerts(conf *serverConfig) {
+	alerts := d.table("alerts")
+	var sinks []socks5.AlertSink
+	if alerts.boolean("log", true) {
+		sinks = append(sinks, socks5.LogAlertSink{})
+	}
+	if hook := alerts.str("webhook", ""); hook != "" {
+		w, err := socks5.NewWebhookAlertSink(hook, alerts.duration("webhook_timeout"), nil)
+		if err != nil {
+			alerts.fail("webhook", "%v", err)
+		} else {
+			sinks = append(sinks, w)
+			conf.webhook = w
+		}
+	} else {
+		alerts.duration("webhook_timeout")
+	}
+	cooldown := alerts.duration("cooldown")
+	alerts.finish()
+
+	var rules []socks5.AlertRule
+	for _, s := range d.array("alerts.rule") {
+		rule := socks5.AlertRule{
+			Kind:      socks5.AlertKind(s.str("kind", "")),
+			Match:     s.str("match", ""),
+			Leg:       socks5.Leg(s.str("leg", "")),
+			Threshold: s.number("threshold", 0),
+			For:       s.duration("for"),
+			Cooldown:  s.duration("cooldown"),
+		}
+		if rule.Cooldown == 0 {
+			rule.Cooldown = cooldown
+		}
+		valid := true
+		switch rule.Kind {
+		case socks5.AlertRTTSpike, socks5.AlertRetransmits, socks5.AlertZeroWindow, socks5.AlertStuckSend:
+		default:
+			s.fail("kind", "expected \"rtt_spike\", \"retransmits\", \"zero_window\" or \"stuck_send\"")
+			valid = false
+		}
+		switch rule.Leg {
+		case "", socks5.LegClient, socks5.LegUpstream:
+		default:
+			s.fail("leg", "expected \"client\" or \"upstream\"")
+			valid = false
+		}
+		if valid {
+			if _, err := socks5.NewAlertDetector([]socks5.AlertRule{rule}); err != nil {
+				failRule(s, err, "match", "threshold")
+			}
+		}
+		s.finish()
+		rules = append(rules, rule)
+	}
+	if len(rules) > 0 {
+		if a, err := socks5.NewAlertDetector(rules, sinks...); err != nil {
+			d.fail("alerts.rule", err)
+		} else {
+			conf.socks.Alerts = a
+		}
+	}
+}
+
+func (d *configDecoder) decodeDialer(sc *serverConfig) {
+	conf := sc.socks
+	// Direct connections leave from the egress rules, if any
+	var egress []socks5.EgressRule
+	for _, s := range d.array("dialer.egress") {
+		rule := socks5.EgressRule{
+			User:      s.str("user", ""),
+			Match:     s.str("match", ""),
+			Interface: s.str("interface", ""),
+		}
+		for _, a := range s.strs("addrs") {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				s.fail("addrs", "invalid IP address %q", a)
+				continue
+			}
+			rule.Addrs = append(rule.Addrs, ip)
+		}
+		if len(rule.Addrs) == 0 && rule.Interface == "" {
+			s.fail("addrs", "needs addresses or an interface")
+		} else if _, err := socks5.NewEgressDialer([]socks5.EgressRule{rule}); err != nil {
+			failRule(s, err, "match")
+		}
+		s.finish()
+		egress = append(egress, rule)
+	}
+	var direct socks5.Dialer = socks5.DialerFunc((&net.Dialer{}).DialContext)
+	if len(egress) > 0 {
+		if e, err := socks5.NewEgressDialer(egress); err != nil {
+			d.fail("dialer.egress", err)
+		} else {
+			direct = e
+		}
+	}
+
+	pools := d.decodePools(sc, direct)
+	s := d.table("dialer")
+	def, chained := upstreamsOf(s, direct, pools)
+	s.finish()
+
+	var routes []socks5.DialRoute
+	names := make(map[string]bool)
+	for _, r := range d.array("dialer.route") {
+		route := socks5.DialRoute{
+			Name:  r.str("name", ""),
+			Match: r.str("match", ""),
+		}
+		route.Dialer, _ = upstreamsOf(r, direct, pools)
+		if route.Name == "" && route.Match == "" {
+			r.fail("match", "a route needs a name or a match pattern")
+		} else if names[route.Name] {
+			r.fail("name", "duplicate route name %q", route.Name)
+		} else if _, err := socks5.NewRouteDialer([]socks5.DialRoute{route}, def); err != nil {
+			failRule(r, err, "match")
+		}
+		if route.Name != "" {
+			names[route.Name] = true
+		}
+		r.finish()
+		routes = append(routes, route)
+	}
+
+	if len(routes) == 0 && len(egress) == 0 && !chained {
+		return
+	}
+	dialer := def
+	if len(routes) > 0 {
+		if rd, err := socks5.NewRouteDialer(routes, def); err != nil {
+			d.fail("dialer.route", err)
+		} else {
+			dialer = rd
+		}
+	}
+	conf.Dialer = dialer
+}
+
+// decodePools builds the upstream pools, each member reached through
+// direct, by name. Pools that failed to build are nil.
+func (d *configDecoder) decodePools(sc *serverConfig, direct socks5.Dialer) map[string]*socks5.UpstreamPool {
+	pools := make(map[string]*socks5.UpstreamPool)
+	for _, s := range d.array("dialer.pool") {
+		name := s.str("name", "")
+		conf := socks5.PoolConfig{
+			MaxFails:            s.integer("max_fails", 0),
+			EjectDuration:       s.duration("eject_duration"),
+			HealthCheckAddr:     s.str("health_check", ""),
+			HealthCheckInterval: s.duration("health_check_interval"),
+			HealthCheckTimeout:  s.duration("health_check_timeout"),
+		}
+		switch strategy := s.str("strategy", "round_robin"); strategy {
+		case "round_robin":
+			conf.Strategy = socks5.RoundRobin
+		case "least_connections":
+			conf.Strategy = socks5.LeastConnections
+		case "consistent_hash":
+			conf.Strategy = socks5.ConsistentHash
+		default:
+			s.fail("strategy", "unknown strategy %q, expected round_robin, least_connections or consistent_hash", strategy)
+		}
+		for _, raw := range s.strs("upstreams") {
+			p, err := socks5.ParseUpstreamURL(raw)
+			if err != nil {
+				s.fail("upstreams", "%v", err)
+				continue
+			}
+			conf.Members = append(conf.Members, socks5.PoolMember{Name: p.String(), Dialer: socks5.Chain(direct, p)})
+		}
+		if name == "" {
+			s.fail("name", "a pool needs a name")
+		} else if _, ok := pools[name]; ok {
+			s.fail("name", "duplicate pool name %q", name)
+		} else if pool, err := socks5.NewUpstreamPool(conf); err != nil {
+			s.fail("upstreams", "%v", err)
+			pools[name] = nil
+		} else {
+			pools[name] = pool
+			sc.pools = append(sc.pools, pool)
+		}
+		s.finish()
+	}
+	return pools
+}
+
+// upstreamsOf returns the chain of upstream proxies listed under
+// "upstreams" or the pool named by "pool", reached through direct, or
+// direct itself when there are neither
+func upstreamsOf(s *section, direct socks5.Dialer, pools map[string]*socks5.UpstreamPool) (socks5.Dialer, bool) {
+	name := s.str("pool", "")
+	if name == "" {
+		return chainOf(s, "upstreams", direct)
+	}
+	if _, ok := s.get("upstreams"); ok {
+		s.fail("pool", "pool and upstreams are exclusive")
+	}
+	pool, ok := pools[name]
+	if !ok {
+		s.fail("pool", "unknown pool %q", name)
+	}
+	if pool == nil {
+		return direct, false
+	}
+	return pool, true
+}
+
+// ruleErr drops the "rule N:" prefix of a validation error for a
+// single rule, the key it is reported against already says which one
+func ruleErr(err error) string {
+	msg := err.Error()
+	if i := strings.Index(msg, ": "); i >= 0 {
+		return msg[i+2:]
+	}
+	return msg
+}
+
+// failRule reports the validation error of the rule in s against the
+// first of keys it names, or the first key if it names none
+func failRule(s *section, err error, keys ...string) {
+	msg := ruleErr(err)
+	key := keys[0]
+	for _, k := range keys {
+		if strings.Contains(msg, k) {
+			key = k
+			break
+		}
+	}
+	s.fail(key, "%s", msg)
+}
+
+// chainOf returns the chain of upstream proxies listed under key,
+// reached through forward, or forward itself when there are none
+func chainOf(s *section, key string, forward socks5.Dialer) (socks5.Dialer, bool) {
+	var hops []*socks5.UpstreamProxy
+	for _, raw := range s.strs(key) {
+		p, err := socks5.ParseUpstreamURL(raw)
+		if err != nil {
+			s.fail(key, "%v", err)
+			continue
+		}
+		hops = append(hops, p)
+	}
+	if len(hops) == 0 {
+		return forward, false
+	}
+	return socks5.Chain(forward, hops...), true
+}
+
+// listenersChanged reports whether a reload asks for listeners on
+// other addresses, which only take effect after a restart. Their
+// policies are reloaded.
+func listenersChanged(a, b []listenerConfig) bool {
+	key := func(ls []listenerConfig) string {
+		s := make([]string, len(ls))
+		for i, l := range ls {
+			s[i] = fmt.Sprintf("%s %s %s %v %s %s", l.name, l.network, l.address, l.transparent, l.tlsCert, l.tlsKey)
+		}
+		sort.Strings(s)
+		return strings.Join(s, ",")
+	}
+	return key(a) != key(b)
+}
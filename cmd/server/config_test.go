@@ -0,0 +1,490 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kennnnny/RRDproxy"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "socks5-config")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "server.toml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig_Example(t *testing.T) {
+	conf, err := loadConfig("server.toml")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(conf.listeners) != 1 || conf.listeners[0].name != "public" || conf.listeners[0].address != ":1080" {
+		t.Fatalf("bad listeners: %+v", conf.listeners)
+	}
+	if len(conf.socks.AuthMethods) != 1 || conf.socks.AuthMethods[0].GetCode() != socks5.UserPassAuth {
+		t.Fatalf("bad auth methods: %+v", conf.socks.AuthMethods)
+	}
+	if !conf.socks.Credentials.Valid("alice", "secret") {
+		t.Fatalf("credentials not loaded")
+	}
+	if _, ok := conf.socks.Resolver.(*socks5.CachingResolver); !ok {
+		t.Fatalf("expected a caching resolver, got %T", conf.socks.Resolver)
+	}
+	if conf.socks.IdleTimeout != 5*time.Minute || conf.socks.LingerTimeout != 30*time.Second {
+		t.Fatalf("bad timeouts: %v %v", conf.socks.IdleTimeout, conf.socks.LingerTimeout)
+	}
+	if conf.socks.MaxConnections != 1024 || conf.socks.MSS != 1400 || conf.socks.RetransmitMSS != 200 {
+		t.Fatalf("bad limits: %+v", conf.socks)
+	}
+	if conf.socks.MonitorInterval != 500*time.Millisecond || conf.socks.MonitorJitter != 100*time.Millisecond {
+		t.Fatalf("bad monitor timing: %v %v", conf.socks.MonitorInterval, conf.socks.MonitorJitter)
+	}
+	if conf.socks.Dialer != nil {
+		t.Fatalf("expected the default dialer")
+	}
+}
+
+func TestLoadConfig_Dialer(t *testing.T) {
+	path := writeConfig(t, `
+[[listener]]
+address = "127.0.0.1:1080"
+
+[dialer]
+upstreams = [
+  "socks5://proxy.example:1080",  # first hop
+  "http://gw.example:3128",
+]
+
+[[dialer.route]]
+name = "direct"
+`)
+	conf, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf.socks.Dialer == nil {
+		t.Fatalf("expected a dialer")
+	}
+}
+
+func TestLoadConfig_Pool(t *testing.T) {
+	conf, err := loadConfig(writeConfig(t, `
+[[listener]]
+address = "127.0.0.1:1080"
+
+[dialer]
+pool = "exits"
+
+[[dialer.pool]]
+name = "exits"
+upstreams = ["socks5://a.example:1080", "http://b.example:3128"]
+strategy = "least_connections"
+
+[[dialer.route]]
+match = "*.corp.example"
+pool = "exits"
+`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(conf.pools) != 1 || len(conf.pools[0].Status()) != 2 {
+		t.Fatalf("bad pools: %+v", conf.pools)
+	}
+	if _, ok := conf.socks.Dialer.(*socks5.RouteDialer); !ok {
+		t.Fatalf("expected a route dialer, got %T", conf.socks.Dialer)
+	}
+	conf.close()
+
+	_, err = loadConfig(writeConfig(t, `
+[[listener]]
+address = "127.0.0.1:1080"
+
+[dialer]
+pool = "missing"
+
+[[dialer.pool]]
+name = "exits"
+strategy = "random"
+
+[[dialer.route]]
+match = "*.corp.example"
+pool = "exits"
+upstreams = ["socks5://a.example:1080"]
+`))
+	if err == nil {
+		t.Fatalf("expected errors")
+	}
+	for _, want := range []string{
+		"dialer.pool: unknown pool \"missing\"",
+		"dialer.pool[0].strategy: unknown strategy",
+		"dialer.pool[0].upstreams: Upstream pool has no members",
+		"dialer.route[0].pool: pool and upstreams are exclusive",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("missing %q in:\n%v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "unknown pool \"exits\"") {
+		t.Fatalf("failed pool reported as unknown:\n%v", err)
+	}
+}
+
+func TestLoadConfig_Tuning(t *testing.T) {
+	path := writeConfig(t, `
+[[listener]]
+address = "127.0.0.1:1080"
+
+[[tuning]]
+match = "*.example.com"
+leg = "upstream"
+send_buffer = 4194304
+keepalive_idle = "60s"
+
+[[tuning]]
+leg = "sideways"
+colour = "blue"
+
+[tuning.growth]
+enabled = true
+max = 8388608
+`)
+	_, err := loadConfig(path)
+	if err == nil {
+		t.Fatalf("expected errors")
+	}
+	for _, want := range []string{
+		":12: tuning[1].leg: expected",
+		":13: tuning[1].colour: unknown key",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %q in:\n%v", want, err)
+		}
+	}
+
+	path = writeConfig(t, `
+[[listener]]
+address = "127.0.0.1:1080"
+
+[[tuning]]
+match = "*.example.com"
+leg = "upstream"
+send_buffer = 4194304
+
+[tuning.growth]
+enabled = true
+max = 8388608
+`)
+	conf, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf.socks.Tuner == nil || conf.socks.BufferGrowth == nil || conf.socks.BufferGrowth.Max != 8388608 {
+		t.Fatalf("bad tuning: %+v %+v", conf.socks.Tuner, conf.socks.BufferGrowth)
+	}
+}
+
+func TestLoadConfig_Profiles(t *testing.T) {
+	dir := filepath.Dir(writeConfig(t, ""))
+	path := writeConfig(t, `
+[[listener]]
+address = "127.0.0.1:1080"
+
+[profiles]
+enabled = true
+path = "`+filepath.Join(dir, "profiles.json")+`"
+half_life = "30m"
+`)
+	conf, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf.socks.PathProfiles == nil {
+		t.Fatalf("expected path profiles")
+	}
+	if conf.socks.MTUProber != nil {
+		t.Fatalf("MTU probing is off by default")
+	}
+
+	path = writeConfig(t, `
+[[listener]]
+address = "127.0.0.1:1080"
+
+[profiles]
+enabled = true
+ipv4_prefix = 40
+`)
+	if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "profiles.path: Invalid prefix lengths") {
+		t.Fatalf("expected a prefix error, got %v", err)
+	}
+}
+
+func TestLoadConfig_MTU(t *testing.T) {
+	if conf, err := loadConfig(writeConfig(t, `
+[[listener]]
+address = "127.0.0.1:1080"
+
+[mtu]
+probe = true
+min_mss = 1000
+`)); err != nil || conf.socks.MTUProber == nil || conf.socks.MTUProber.MinMSS != 1000 {
+		t.Fatalf("bad MTU prober: %v", err)
+	}
+}
+
+func TestLoadConfig_DoT(t *testing.T) {
+	conf, err := loadConfig(writeConfig(t, `
+[[listener]]
+address = "127.0.0.1:1080"
+
+[resolver]
+type = "dot"
+upstreams = ["192.0.2.53"]
+`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	// The resolver is kept to close its idle connections on reload
+	if conf.dot == nil || conf.socks.Resolver != socks5.NameResolver(conf.dot) {
+		t.Fatalf("DoT resolver not kept: %T", conf.socks.Resolver)
+	}
+	conf.close()
+}
+
+func TestLoadConfig_Alerts(t *testing.T) {
+	conf, err := loadConfig(writeConfig(t, `
+[[listener]]
+address = "127.0.0.1:1080"
+
+[alerts]
+log = false
+webhook = "http://127.0.0.1:9100/alerts"
+
+[[alerts.rule]]
+kind = "retransmits"
+threshold = 0.1
+for = "2s"
+`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conf.webhook.Close()
+	if conf.socks.Alerts == nil || conf.webhook == nil {
+		t.Fatalf("expected an alert detector posting to the webhook")
+	}
+
+	_, err = loadConfig(writeConfig(t, `
+[[listener]]
+address = "127.0.0.1:1080"
+
+[alerts]
+webhook = "http://alerts.example/"
+
+[[alerts.rule]]
+kind = "latency"
+leg = "sideways"
+threshold = "high"
+`))
+	if err == nil {
+		t.Fatalf("expected errors")
+	}
+	for _, want := range []string{
+		":6: alerts.webhook: Webhook host",
+		":9: alerts.rule[0].kind: expected",
+		":10: alerts.rule[0].leg: expected",
+		":11: alerts.rule[0].threshold: expected a non-negative number",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %q in:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	path := writeConfig(t, `
+[[listener]]
+address = "no-port"
+
+[timeouts]
+idle = "5 minutes"
+
+[resolver]
+type = "doh"
+prefer = "ipv5"
+
+[dialer]
+upstreams = ["ftp://proxy.example"]
+
+[mss]
+normal = "big"
+colour = "blue"
+
+[unknown]
+`)
+	_, err := loadConfig(path)
+	if err == nil {
+		t.Fatalf("expected errors")
+	}
+	for _, want := range []string{
+		":3: listener[0].address:",
+		":6: timeouts.idle: invalid duration",
+		"resolver.upstreams: doh resolver needs at least one upstream",
+		":10: resolver.prefer: unknown preference",
+		":13: dialer.upstreams:",
+		":16: mss.normal: expected a non-negative integer",
+		":17: mss.colour: unknown key",
+		":19: unknown: unknown table",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %q in:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_Listeners(t *testing.T) {
+	path := writeConfig(t, `
+[auth]
+methods = ["none"]
+
+[auth.credentials]
+foo = "bar"
+
+[[listener]]
+address = ":1080"
+
+[[listener]]
+name = "local"
+network = "unix"
+address = "/tmp/socks.sock"
+auth_methods = ["userpass"]
+allow = ["connect"]
+monitor = false
+`)
+	conf, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(conf.listeners) != 2 {
+		t.Fatalf("bad listeners: %+v", conf.listeners)
+	}
+	def, local := conf.listeners[0], conf.listeners[1]
+	if def.name != "listener0" || def.network != "tcp" || def.authMethods != nil || def.rules != nil || def.monitor != socks5.MonitorDefault {
+		t.Fatalf("bad default listener: %+v", def)
+	}
+	if local.network != "unix" || len(local.authMethods) != 1 || local.authMethods[0].GetCode() != socks5.UserPassAuth {
+		t.Fatalf("bad local listener: %+v", local)
+	}
+	if p, ok := local.rules.(*socks5.PermitCommand); !ok || !p.EnableConnect || p.EnableBind {
+		t.Fatalf("bad local rules: %+v", local.rules)
+	}
+	if local.monitor != socks5.MonitorDisabled {
+		t.Fatalf("bad local monitor policy: %v", local.monitor)
+	}
+
+	// Policies are reloaded, addresses need a restart
+	again, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	again.listeners[1].monitor = socks5.MonitorEnabled
+	if listenersChanged(conf.listeners, again.listeners) {
+		t.Fatalf("policy change taken for a listener change")
+	}
+	again.listeners[0].address = ":1081"
+	if !listenersChanged(conf.listeners, again.listeners) {
+		t.Fatalf("address change not detected")
+	}
+}
+
+func TestLoadConfig_ListenerErrors(t *testing.T) {
+	path := writeConfig(t, `
+[[listener]]
+name = "a"
+address = ":1080"
+network = "udp"
+
+[[listener]]
+name = "a"
+address = ":1081"
+tls_cert = "cert.pem"
+allow = ["listen"]
+`)
+	_, err := loadConfig(path)
+	if err == nil {
+		t.Fatalf("expected errors")
+	}
+	for _, want := range []string{
+		":5: listener[0].network: unknown network",
+		":8: listener[1].name: duplicate listener name",
+		":10: listener[1].tls_cert: tls_cert and tls_key go together",
+		":11: listener[1].allow: unknown command",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %q in:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoadConfig_Syntax(t *testing.T) {
+	path := writeConfig(t, "[[listener]]\naddress = \":1080\n")
+	_, err := loadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "line 2: address: unterminated string") {
+		t.Fatalf("bad error: %v", err)
+	}
+}
+
+func TestParseTOML(t *testing.T) {
+	doc, err := parseTOML(strings.NewReader(`
+name = "a # not a comment" # comment
+n = 1_000
+f = 0.25
+on = true
+list = ['x', "y\"z"]
+
+[[item]]
+k = 1
+[[item]]
+k = 2
+
+[ "auth" . credentials ]
+"alice@corp" = "x"
+'a.b' = "y"
+`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	root := doc.tables[""]
+	if root.values["name"].v != "a # not a comment" {
+		t.Fatalf("bad string: %v", root.values["name"].v)
+	}
+	if root.values["n"].v != int64(1000) || root.values["f"].v != 0.25 || root.values["on"].v != true {
+		t.Fatalf("bad scalars: %v", root.values)
+	}
+	list := root.values["list"].v.([]interface{})
+	if len(list) != 2 || list[0] != "x" || list[1] != `y"z` {
+		t.Fatalf("bad list: %v", list)
+	}
+	if len(doc.arrays["item"]) != 2 || doc.arrays["item"][1].values["k"].v != int64(2) {
+		t.Fatalf("bad array of tables: %v", doc.arrays["item"])
+	}
+	creds := doc.tables["auth.credentials"]
+	if creds == nil || creds.values["alice@corp"].v != "x" || creds.values["a.b"].v != "y" {
+		t.Fatalf("bad quoted keys: %+v", creds)
+	}
+
+	for _, bad := range []string{"a b = 1", "\"a = 1", "[a..b]", "[\"a\" b]"} {
+		if _, err := parseTOML(strings.NewReader(bad)); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
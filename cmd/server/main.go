@@ -4,38 +4,108 @@ import (
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/kennnnny/RRDproxy"
 )
 
 var (
-	port     string
-	login    string
-	password string
+	port       string
+	login      string
+	password   string
+	configPath string
 )
 
 func init() {
 	flag.StringVar(&port, "p", "8080", "socks5 listen port")
 	flag.StringVar(&login, "user", "", "socks5 username")
 	flag.StringVar(&password, "password", "", "socks5 password")
-	flag.Parse()
+	flag.StringVar(&configPath, "config", "", "config file, reloaded on SIGHUP (overrides the other flags)")
 }
 
 func main() {
-	conf := &socks5.Config{}
-	conf.Logger = log.New(os.Stderr, "", log.LstdFlags|log.Lshortfile)
-	if login != "" && password != "" {
-		conf.Credentials = socks5.StaticCredentials(map[string]string{login: password})
-	} else {
-		conf.Logger.Println("WARN: no authentication provided (free use mode)")
+	flag.Parse()
+	logger := log.New(os.Stderr, "", log.LstdFlags|log.Lshortfile)
+
+	conf, err := initialConfig()
+	if err != nil {
+		logger.Fatal(err)
 	}
-	server, err := socks5.New(conf)
+	conf.socks.Logger = logger
+	if conf.socks.Credentials == nil && len(conf.socks.AuthMethods) == 0 {
+		logger.Println("WARN: no authentication provided (free use mode)")
+	}
+	server, err := socks5.New(conf.socks)
 	if err != nil {
 		panic(err)
 	}
 
-	conf.Logger.Printf("SOCKS5 server started on port %s", port)
-	if err := server.ListenAndServe("tcp", ":"+port); err != nil {
-		panic(err)
+	if configPath != "" {
+		go reloadOnSignal(server, conf, logger)
+	}
+
+	var listeners []*socks5.Listener
+	for _, lc := range conf.listeners {
+		l, err := lc.listen()
+		if err != nil {
+			panic(err)
+		}
+		logger.Printf("%s: listening on %s %s (transparent: %v)", lc.name, lc.network, lc.address, lc.transparent)
+		listeners = append(listeners, l)
+	}
+	panic(server.ServeListeners(listeners...))
+}
+
+// initialConfig reads the config file, or builds the config from the
+// command line flags when there is none
+func initialConfig() (*serverConfig, error) {
+	if configPath != "" {
+		return loadConfig(configPath)
+	}
+	conf := &serverConfig{
+		listeners: []listenerConfig{{name: "default", network: "tcp", address: ":" + port}},
+		socks:     &socks5.Config{},
+	}
+	if login != "" && password != "" {
+		conf.socks.Credentials = socks5.StaticCredentials(map[string]string{login: password})
+	}
+	return conf, nil
+}
+
+// reloadOnSignal rereads the config file on every SIGHUP. A file that
+// does not validate leaves the running configuration untouched.
+func reloadOnSignal(server *socks5.Server, running *serverConfig, logger *log.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	started := running.listeners
+	for range hup {
+		// Hand what was learned so far to the reloaded profiles
+		if profiles := running.socks.PathProfiles; profiles != nil {
+			if err := profiles.Save(); err != nil {
+				logger.Printf("[ERR] reload: %v", err)
+			}
+		}
+		conf, err := loadConfig(configPath)
+		if err != nil {
+			logger.Printf("[ERR] reload: %v", err)
+			continue
+		}
+		conf.socks.Logger = logger
+		var policies []*socks5.Listener
+		for _, lc := range conf.listeners {
+			policies = append(policies, lc.policy())
+		}
+		if err := server.Reload(conf.socks, policies...); err != nil {
+			logger.Printf("[ERR] reload: %v", err)
+			conf.close()
+			continue
+		}
+		if listenersChanged(started, conf.listeners) {
+			logger.Println("WARN: reload: new listener addresses take effect after a restart")
+		}
+		running.close()
+		running = conf
+		logger.Printf("Reloaded %s", configPath)
 	}
 }
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The config file is written in a subset of TOML: [tables],
+// [[arrays of tables]], and key = value pairs whose values are strings,
+// integers, floats, booleans or arrays of those. Arrays may span lines.
+// Keys are bare or quoted, so "alice@corp" = "secret" names a user.
+
+// tomlValue is a parsed value and the line it was found on
+type tomlValue struct {
+	v    interface{}
+	line int
+}
+
+// tomlTable holds the keys of one table in the order they were given
+type tomlTable struct {
+	name   string
+	line   int
+	keys   []string
+	values map[string]tomlValue
+}
+
+func newTOMLTable(name string, line int) *tomlTable {
+	return &tomlTable{name: name, line: line, values: make(map[string]tomlValue)}
+}
+
+// tomlDoc is a parsed file. The root table has an empty name.
+type tomlDoc struct {
+	tables map[string]*tomlTable
+	arrays map[string][]*tomlTable
+	order  []string
+}
+
+// tomlError points at the line a problem was found on
+type tomlError struct {
+	line int
+	msg  string
+}
+
+func (e *tomlError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.msg)
+}
+
+func parseTOML(r io.Reader) (*tomlDoc, error) {
+	doc := &tomlDoc{
+		tables: map[string]*tomlTable{"": newTOMLTable("", 0)},
+		arrays: make(map[string][]*tomlTable),
+	}
+	cur := doc.tables[""]
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "[["):
+			if !strings.HasSuffix(line, "]]") {
+				return nil, &tomlError{lineNo, "unterminated table header"}
+			}
+			name, err := tableName(line[2 : len(line)-2])
+			if err != nil {
+				return nil, &tomlError{lineNo, err.Error()}
+			}
+			if _, ok := doc.tables[name]; ok {
+				return nil, &tomlError{lineNo, fmt.Sprintf("%s is already a table", name)}
+			}
+			cur = newTOMLTable(name, lineNo)
+			if _, ok := doc.arrays[name]; !ok {
+				doc.order = append(doc.order, name)
+			}
+			doc.arrays[name] = append(doc.arrays[name], cur)
+
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") {
+				return nil, &tomlError{lineNo, "unterminated table header"}
+			}
+			name, err := tableName(line[1 : len(line)-1])
+			if err != nil {
+				return nil, &tomlError{lineNo, err.Error()}
+			}
+			if _, ok := doc.tables[name]; ok {
+				return nil, &tomlError{lineNo, fmt.Sprintf("table %s defined twice", name)}
+			}
+			if _, ok := doc.arrays[name]; ok {
+				return nil, &tomlError{lineNo, fmt.Sprintf("%s is already an array of tables", name)}
+			}
+			cur = newTOMLTable(name, lineNo)
+			doc.tables[name] = cur
+			doc.order = append(doc.order, name)
+
+		default:
+			key, rest, err := parseKey(line)
+			if err != nil {
+				return nil, &tomlError{lineNo, err.Error()}
+			}
+			rest = strings.TrimSpace(rest)
+			if !strings.HasPrefix(rest, "=") {
+				return nil, &tomlError{lineNo, fmt.Sprintf("expected key = value, got %q", line)}
+			}
+			raw := strings.TrimSpace(rest[1:])
+			start := lineNo
+			// Arrays continue until their brackets balance
+			for strings.HasPrefix(raw, "[") && !balanced(raw) && scanner.Scan() {
+				lineNo++
+				raw += " " + strings.TrimSpace(stripComment(scanner.Text()))
+			}
+			v, rest, err := parseValue(raw)
+			if err == nil && strings.TrimSpace(rest) != "" {
+				err = fmt.Errorf("unexpected %q after value", strings.TrimSpace(rest))
+			}
+			if err != nil {
+				return nil, &tomlError{start, fmt.Sprintf("%s: %v", key, err)}
+			}
+			if _, ok := cur.values[key]; ok {
+				return nil, &tomlError{start, fmt.Sprintf("%s defined twice", key)}
+			}
+			cur.keys = append(cur.keys, key)
+			cur.values[key] = tomlValue{v, start}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// stripComment removes a # comment that is not inside a string
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func balanced(s string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+// tableName returns the dotted name of a table header, its parts
+// unquoted
+func tableName(s string) (string, error) {
+	var parts []string
+	rest := s
+	for {
+		part, r, err := parseKey(rest)
+		if err != nil {
+			return "", fmt.Errorf("invalid table name %q", s)
+		}
+		parts = append(parts, part)
+		rest = strings.TrimSpace(r)
+		if rest == "" {
+			return strings.Join(parts, "."), nil
+		}
+		if rest[0] != '.' {
+			return "", fmt.Errorf("invalid table name %q", s)
+		}
+		rest = rest[1:]
+	}
+}
+
+// parseKey parses the bare or quoted key at the start of s and returns
+// the rest
+func parseKey(s string) (string, string, error) {
+	s = strings.TrimLeft(s, " \t")
+	if s != "" && (s[0] == '"' || s[0] == '\'') {
+		v, rest, err := parseValue(s)
+		if err != nil {
+			return "", "", err
+		}
+		return v.(string), rest, nil
+	}
+	end := strings.IndexAny(s, "=. \t")
+	if end < 0 {
+		end = len(s)
+	}
+	if !validKey(s[:end]) {
+		return "", "", fmt.Errorf("invalid key %q", strings.TrimSpace(s))
+	}
+	return s[:end], s[end:], nil
+}
+
+func validKey(k string) bool {
+	if k == "" {
+		return false
+	}
+	for _, c := range k {
+		if !(c == '_' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseValue parses the value at the start of s and returns the rest
+func parseValue(s string) (interface{}, string, error) {
+	if s == "" {
+		return nil, "", fmt.Errorf("missing value")
+	}
+	switch s[0] {
+	case '"':
+		return parseBasicString(s)
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case '[':
+		var list []interface{}
+		rest := strings.TrimSpace(s[1:])
+		for {
+			if strings.HasPrefix(rest, "]") {
+				return list, rest[1:], nil
+			}
+			v, r, err := parseValue(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			list = append(list, v)
+			rest = strings.TrimSpace(r)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return nil, "", fmt.Errorf("expected , or ] in array")
+			}
+		}
+	}
+
+	end := strings.IndexAny(s, ",] \t")
+	if end < 0 {
+		end = len(s)
+	}
+	word, rest := s[:end], s[end:]
+	switch word {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+	word = strings.Replace(word, "_", "", -1)
+	if n, err := strconv.ParseInt(word, 0, 64); err == nil {
+		return n, rest, nil
+	}
+	f, err := strconv.ParseFloat(word, 64)
+	if err != nil || strings.HasPrefix(word, "0x") {
+		return nil, "", fmt.Errorf("invalid value %q", word)
+	}
+	return f, rest, nil
+}
+
+func parseBasicString(s string) (interface{}, string, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			i++
+			if i == len(s) {
+				break
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '"', '\\':
+				b.WriteByte(s[i])
+			default:
+				return nil, "", fmt.Errorf("invalid escape \\%c", s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return nil, "", fmt.Errorf("unterminated string")
+}
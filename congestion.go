@@ -0,0 +1,102 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mikioh/tcp"
+	"github.com/mikioh/tcpinfo"
+)
+
+type congestionKey struct{}
+
+// WithCongestionControl selects the congestion control algorithm for
+// one leg of the connection, such as "bbr" or "cubic". A RuleSet can
+// use it to pick an algorithm per destination. The algorithm must be
+// allowed in net.ipv4.tcp_allowed_congestion_control (Linux only).
+func WithCongestionControl(ctx context.Context, leg Leg, algorithm string) context.Context {
+	cc := make(map[Leg]string)
+	for l, a := range congestionFromContext(ctx) {
+		cc[l] = a
+	}
+	cc[leg] = algorithm
+	return context.WithValue(ctx, congestionKey{}, cc)
+}
+
+func congestionFromContext(ctx context.Context) map[Leg]string {
+	cc, _ := ctx.Value(congestionKey{}).(map[Leg]string)
+	return cc
+}
+
+// CongestionSwitch moves a leg to another congestion control algorithm
+// once a sample shows a long or lossy path, for example from cubic to
+// BBR. Each leg is switched at most once.
+type CongestionSwitch struct {
+	// Algorithm is the algorithm to switch to.
+	Algorithm string
+
+	// MinRTT is the smoothed RTT from which to switch, zero for any.
+	MinRTT time.Duration
+
+	// MinRetransRatio is the share of data segments retransmitted over
+	// the last interval from which to switch, zero for any.
+	MinRetransRatio float64
+
+	// Legs limits the switch to some legs, empty for all of them.
+	Legs []Leg
+}
+
+// want reports whether ls calls for switching its leg
+func (c *CongestionSwitch) want(ls LegSample) bool {
+	if ls.Sample.CCAlgorithm == c.Algorithm {
+		return false
+	}
+	if len(c.Legs) > 0 {
+		found := false
+		for _, l := range c.Legs {
+			found = found || l == ls.Leg
+		}
+		if !found {
+			return false
+		}
+	}
+	if ls.Sample.RTT < c.MinRTT {
+		return false
+	}
+	if c.MinRetransRatio > 0 && (ls.Delta == nil || ls.Delta.RetransRatio < c.MinRetransRatio) {
+		return false
+	}
+	return true
+}
+
+// setCongestion sets TCP_CONGESTION on the socket carrying c
+func setCongestion(c net.Conn, algorithm string) error {
+	raw, ok := socketOf(c)
+	if !ok {
+		return fmt.Errorf("No TCP socket under %T", c)
+	}
+	tc, err := tcp.NewConn(raw)
+	if err != nil {
+		return err
+	}
+	return tc.SetOption(tcpinfo.CCAlgorithm(algorithm))
+}
+
+// applyCongestion sets the algorithms a RuleSet chose for the session
+func (s *Server) applyCongestion(ctx context.Context, client conn, target net.Conn) {
+	for leg, algorithm := range congestionFromContext(ctx) {
+		c := target
+		if leg == LegClient {
+			nc, ok := client.(net.Conn)
+			if !ok {
+				continue
+			}
+			c = nc
+		}
+		if err := setCongestion(c, algorithm); err != nil {
+			s.config.Logger.Printf("[ERR] socks: Failed to set %s congestion control on the %s leg: %v", algorithm, leg, err)
+		}
+	}
+}
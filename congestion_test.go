@@ -0,0 +1,169 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kennnnny/RRDproxy/sampler"
+	"github.com/mikioh/tcp"
+)
+
+func TestWithCongestionControl(t *testing.T) {
+	base := WithCongestionControl(context.Background(), LegUpstream, "bbr")
+	both := WithCongestionControl(base, LegClient, "cubic")
+	if cc := congestionFromContext(base); len(cc) != 1 || cc[LegUpstream] != "bbr" {
+		t.Fatalf("bad base choice: %v", cc)
+	}
+	if cc := congestionFromContext(both); len(cc) != 2 || cc[LegClient] != "cubic" || cc[LegUpstream] != "bbr" {
+		t.Fatalf("bad combined choice: %v", cc)
+	}
+	if cc := congestionFromContext(context.Background()); cc != nil {
+		t.Fatalf("unexpected choice: %v", cc)
+	}
+}
+
+func TestCongestionSwitch_Want(t *testing.T) {
+	cs := &CongestionSwitch{Algorithm: "bbr", MinRTT: 100 * time.Millisecond, MinRetransRatio: 0.01, Legs: []Leg{LegUpstream}}
+	sample := func(leg Leg, algo string, rtt time.Duration, ratio float64) LegSample {
+		return LegSample{
+			Leg:    leg,
+			Sample: &sampler.Sample{CCAlgorithm: algo, RTT: rtt},
+			Delta:  &sampler.Delta{RetransRatio: ratio},
+		}
+	}
+	cases := []struct {
+		ls   LegSample
+		want bool
+	}{
+		{sample(LegUpstream, "cubic", 150*time.Millisecond, 0.05), true},
+		{sample(LegUpstream, "bbr", 150*time.Millisecond, 0.05), false},
+		{sample(LegClient, "cubic", 150*time.Millisecond, 0.05), false},
+		{sample(LegUpstream, "cubic", 10*time.Millisecond, 0.05), false},
+		{sample(LegUpstream, "cubic", 150*time.Millisecond, 0), false},
+		{LegSample{Leg: LegUpstream, Sample: &sampler.Sample{CCAlgorithm: "cubic", RTT: time.Second}}, false},
+	}
+	for i, c := range cases {
+		if got := cs.want(c.ls); got != c.want {
+			t.Fatalf("case %d: got %v", i, got)
+		}
+	}
+}
+
+// congestionRules picks a congestion control algorithm for the upstream
+type congestionRules struct {
+	algorithm string
+}
+
+func (r congestionRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return WithCongestionControl(ctx, LegUpstream, r.algorithm), true
+}
+
+func TestCongestionControl_Rules(t *testing.T) {
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer s.Close()
+	if err := setCongestion(c, "reno"); err != nil {
+		t.Skipf("reno not allowed: %v", err)
+	}
+
+	echo := startEcho(t)
+	defer echo.Close()
+	samples := make(chan LegSample, 64)
+	serv, err := New(&Config{
+		Rules:           congestionRules{"reno"},
+		Logger:          log.New(ioutil.Discard, "", 0),
+		DisableMSSClamp: true,
+		MonitorInterval: 10 * time.Millisecond,
+		MonitorSample: func(ls LegSample) {
+			select {
+			case samples <- ls:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	p := &UpstreamProxy{Type: UpstreamSOCKS5, Addr: l.Addr().String()}
+	conn, err := p.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	io.ReadFull(conn, make([]byte, 4))
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case ls := <-samples:
+			if ls.Leg == LegUpstream {
+				if ls.Sample.CCAlgorithm != "reno" {
+					t.Fatalf("upstream runs %q", ls.Sample.CCAlgorithm)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no upstream sample")
+		}
+	}
+}
+
+func TestCongestionSwitch_Monitor(t *testing.T) {
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer s.Close()
+	if err := setCongestion(c, "reno"); err != nil {
+		t.Skipf("reno not allowed: %v", err)
+	}
+	before, err := sampleOf(c)
+	if err != nil || before.CCAlgorithm != "reno" {
+		t.Fatalf("bad sample before the switch: %+v %v", before, err)
+	}
+	target := "bbr"
+	if err := setCongestion(s, target); err != nil {
+		target = "cubic"
+	}
+
+	serv, err := New(&Config{
+		Logger:           log.New(ioutil.Discard, "", 0),
+		MonitorSample:    func(LegSample) {},
+		CongestionSwitch: &CongestionSwitch{Algorithm: target},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m := serv.startMonitors(nil, c, s)
+	defer m.stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if after, err := sampleOf(c); err == nil && after.CCAlgorithm == target {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("client leg not switched to %s", target)
+}
+
+// sampleOf reads one sample from the socket under c
+func sampleOf(c net.Conn) (*sampler.Sample, error) {
+	raw, _ := socketOf(c)
+	tc, err := tcp.NewConn(raw)
+	if err != nil {
+		return nil, err
+	}
+	return sampler.Read(tc)
+}
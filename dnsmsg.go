@@ -0,0 +1,221 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	dnsTypeA     = uint16(1)
+	dnsTypeCNAME = uint16(5)
+	dnsTypeAAAA  = uint16(28)
+	dnsClassINET = uint16(1)
+
+	dnsRcodeSuccess     = 0
+	dnsRcodeServerFail  = 2
+	dnsRcodeNameError   = 3
+	dnsHeaderLen        = 12
+	dnsMaxNameLen       = 255
+	dnsMaxLabelLen      = 63
+	dnsMaxPointerChases = 16
+)
+
+var (
+	errDNSShortMessage = fmt.Errorf("DNS message too short")
+	errDNSBadName      = fmt.Errorf("Malformed DNS name")
+)
+
+// dnsQuestion is an entry of the question section
+type dnsQuestion struct {
+	Name string
+	Type uint16
+}
+
+// dnsRecord is a resource record; Data holds the raw RDATA
+type dnsRecord struct {
+	Name string
+	Type uint16
+	TTL  uint32
+	Data []byte
+}
+
+// dnsMessage is the subset of RFC 1035 messages the resolvers need:
+// a header, questions and answers. Authority and additional records
+// are skipped when unpacking.
+type dnsMessage struct {
+	ID               uint16
+	Response         bool
+	RecursionDesired bool
+	Rcode            int
+	Questions        []dnsQuestion
+	Answers          []dnsRecord
+}
+
+// newDNSQuery builds a recursive query for a single name and type
+func newDNSQuery(id uint16, name string, qtype uint16) *dnsMessage {
+	return &dnsMessage{
+		ID:               id,
+		RecursionDesired: true,
+		Questions:        []dnsQuestion{{Name: name, Type: qtype}},
+	}
+}
+
+// pack encodes the message in wire format without name compression
+func (m *dnsMessage) pack() ([]byte, error) {
+	b := make([]byte, dnsHeaderLen, 512)
+	binary.BigEndian.PutUint16(b[0:], m.ID)
+	var flags uint16
+	if m.Response {
+		flags |= 1 << 15
+	}
+	if m.RecursionDesired {
+		flags |= 1 << 8
+	}
+	flags |= uint16(m.Rcode & 0xf)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.Answers)))
+
+	var err error
+	for _, q := range m.Questions {
+		if b, err = appendDNSName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = appendUint16(b, q.Type)
+		b = appendUint16(b, dnsClassINET)
+	}
+	for _, rr := range m.Answers {
+		if b, err = appendDNSName(b, rr.Name); err != nil {
+			return nil, err
+		}
+		b = appendUint16(b, rr.Type)
+		b = appendUint16(b, dnsClassINET)
+		b = append(b, byte(rr.TTL>>24), byte(rr.TTL>>16), byte(rr.TTL>>8), byte(rr.TTL))
+		b = appendUint16(b, uint16(len(rr.Data)))
+		b = append(b, rr.Data...)
+	}
+	return b, nil
+}
+
+// unpack decodes a wire format message
+func (m *dnsMessage) unpack(b []byte) error {
+	if len(b) < dnsHeaderLen {
+		return errDNSShortMessage
+	}
+	m.ID = binary.BigEndian.Uint16(b[0:])
+	flags := binary.BigEndian.Uint16(b[2:])
+	m.Response = flags&(1<<15) != 0
+	m.RecursionDesired = flags&(1<<8) != 0
+	m.Rcode = int(flags & 0xf)
+	qdCount := int(binary.BigEndian.Uint16(b[4:]))
+	anCount := int(binary.BigEndian.Uint16(b[6:]))
+
+	off := dnsHeaderLen
+	m.Questions = nil
+	for i := 0; i < qdCount; i++ {
+		name, n, err := readDNSName(b, off)
+		if err != nil {
+			return err
+		}
+		off = n
+		if off+4 > len(b) {
+			return errDNSShortMessage
+		}
+		m.Questions = append(m.Questions, dnsQuestion{
+			Name: name,
+			Type: binary.BigEndian.Uint16(b[off:]),
+		})
+		off += 4
+	}
+
+	m.Answers = nil
+	for i := 0; i < anCount; i++ {
+		name, n, err := readDNSName(b, off)
+		if err != nil {
+			return err
+		}
+		off = n
+		if off+10 > len(b) {
+			return errDNSShortMessage
+		}
+		rr := dnsRecord{
+			Name: name,
+			Type: binary.BigEndian.Uint16(b[off:]),
+			TTL:  binary.BigEndian.Uint32(b[off+4:]),
+		}
+		rdLen := int(binary.BigEndian.Uint16(b[off+8:]))
+		off += 10
+		if off+rdLen > len(b) {
+			return errDNSShortMessage
+		}
+		rr.Data = b[off : off+rdLen]
+		off += rdLen
+		m.Answers = append(m.Answers, rr)
+	}
+	return nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// appendDNSName appends name as a sequence of length-prefixed labels
+func appendDNSName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > dnsMaxNameLen-2 {
+		return nil, errDNSBadName
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > dnsMaxLabelLen {
+				return nil, errDNSBadName
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// readDNSName decodes a possibly compressed name starting at off and
+// returns it together with the offset just past it
+func readDNSName(b []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for chases := 0; ; {
+		if off >= len(b) {
+			return "", 0, errDNSShortMessage
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, errDNSShortMessage
+			}
+			if chases++; chases > dnsMaxPointerChases {
+				return "", 0, errDNSBadName
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+
+		case l <= dnsMaxLabelLen:
+			if off+1+l > len(b) {
+				return "", 0, errDNSShortMessage
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+
+		default:
+			return "", 0, errDNSBadName
+		}
+	}
+}
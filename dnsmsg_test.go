@@ -0,0 +1,69 @@
+package socks5
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDNSMessage_RoundTrip(t *testing.T) {
+	m := &dnsMessage{
+		ID:        42,
+		Response:  true,
+		Rcode:     dnsRcodeSuccess,
+		Questions: []dnsQuestion{{Name: "example.com", Type: dnsTypeA}},
+		Answers: []dnsRecord{
+			{Name: "example.com", Type: dnsTypeA, TTL: 300, Data: []byte{10, 0, 0, 1}},
+		},
+	}
+	b, err := m.pack()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var out dnsMessage
+	if err := out.unpack(b); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.ID != 42 || !out.Response || len(out.Questions) != 1 || len(out.Answers) != 1 {
+		t.Fatalf("bad: %+v", out)
+	}
+	if out.Questions[0].Name != "example.com" || out.Answers[0].TTL != 300 {
+		t.Fatalf("bad: %+v", out)
+	}
+	if !bytes.Equal(out.Answers[0].Data, []byte{10, 0, 0, 1}) {
+		t.Fatalf("bad: %v", out.Answers[0].Data)
+	}
+}
+
+func TestDNSMessage_Compression(t *testing.T) {
+	// Header, question for a.example and an answer whose name is a
+	// pointer to the question name
+	b := []byte{
+		0, 1, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0,
+		1, 'a', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0, 0, 1, 0, 1,
+		0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, 1,
+	}
+	var m dnsMessage
+	if err := m.unpack(b); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(m.Answers) != 1 || m.Answers[0].Name != "a.example" {
+		t.Fatalf("bad: %+v", m)
+	}
+
+	// A pointer loop must not hang
+	loop := append([]byte(nil), b[:12]...)
+	loop[5] = 1
+	loop[7] = 0
+	loop = append(loop, 0xc0, 12, 0, 1, 0, 1)
+	if err := m.unpack(loop); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestDNSMessage_BadName(t *testing.T) {
+	long := bytes.Repeat([]byte{'a'}, 64)
+	if _, err := newDNSQuery(1, string(long)+".com", dnsTypeA).pack(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,156 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// EgressRule binds outbound connections it matches to a local address
+// or network interface
+type EgressRule struct {
+	// User matches the authenticated user name, empty matches anyone.
+	User string
+
+	// Match is a destination pattern as in RewriteRule.Match,
+	// empty matches any destination.
+	Match string
+
+	// Addrs are local addresses to bind. They are used round-robin
+	// among those of the destination's address family. A destination
+	// given by name is resolved and its addresses tried in turn.
+	Addrs []net.IP
+
+	// Interface binds to a device with SO_BINDTODEVICE (Linux only).
+	Interface string
+}
+
+// EgressDialer is a Dialer connecting directly from the local address
+// or interface chosen by the first matching rule. Destinations matching
+// no rule leave the choice to the kernel. The bound address is what
+// CONNECT reports as BND.ADDR.
+type EgressDialer struct {
+	rules []*compiledEgress
+
+	// lookupIP resolves destinations given by name, replaced in tests
+	lookupIP func(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+type compiledEgress struct {
+	EgressRule
+	matcher *addrMatcher
+
+	mu   sync.Mutex
+	next int
+}
+
+// NewEgressDialer validates rules and builds an EgressDialer
+func NewEgressDialer(rules []EgressRule) (*EgressDialer, error) {
+	e := &EgressDialer{lookupIP: net.DefaultResolver.LookupIP}
+	for i, rule := range rules {
+		if len(rule.Addrs) == 0 && rule.Interface == "" {
+			return nil, fmt.Errorf("egress rule %d: needs addresses or an interface", i+1)
+		}
+		c := &compiledEgress{EgressRule: rule}
+		if rule.Match != "" {
+			m, err := compileAddrMatcher(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("egress rule %d: match %v", i+1, err)
+			}
+			c.matcher = &m
+		}
+		e.rules = append(e.rules, c)
+	}
+	return e, nil
+}
+
+func (e *EgressDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dest, err := addrSpecFromString(addr)
+	if err != nil {
+		return nil, err
+	}
+	var user string
+	if req, ok := RequestFromContext(ctx); ok {
+		if req.AuthContext != nil {
+			user = req.AuthContext.Payload["Username"]
+		}
+		if req.realDestAddr != nil && req.realDestAddr.Port == dest.Port {
+			dest.FQDN = req.realDestAddr.FQDN
+		}
+	}
+
+	var d net.Dialer
+	var match *compiledEgress
+	for _, rule := range e.rules {
+		if rule.matches(user, dest) {
+			match = rule
+			break
+		}
+	}
+	if match != nil && match.Interface != "" {
+		d.Control = bindToDevice(match.Interface)
+	}
+	d.Control = chainControl(ctx, d.Control)
+	if match == nil || len(match.Addrs) == 0 {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	// A name is resolved here so that each of its addresses is dialed
+	// from a local address of the same family
+	host, port, _ := net.SplitHostPort(addr)
+	ips := []net.IP{dest.IP}
+	if dest.IP == nil {
+		if ips, err = e.lookupIP(ctx, "ip", host); err != nil {
+			return nil, err
+		}
+	}
+	err = fmt.Errorf("No egress address for %v", dest)
+	for _, ip := range ips {
+		local := match.pick(ip)
+		if local == nil {
+			continue
+		}
+		d.LocalAddr = &net.TCPAddr{IP: local}
+		conn, derr := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if derr == nil {
+			return conn, nil
+		}
+		err = derr
+	}
+	return nil, err
+}
+
+func (c *compiledEgress) matches(user string, dest *AddrSpec) bool {
+	if c.User != "" && c.User != user {
+		return false
+	}
+	return c.matcher == nil || c.matcher.matches(dest)
+}
+
+// pick returns the next local address of the same family as dest
+func (c *compiledEgress) pick(dest net.IP) net.IP {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < len(c.Addrs); i++ {
+		ip := c.Addrs[(c.next+i)%len(c.Addrs)]
+		if (ip.To4() != nil) == (dest.To4() != nil) {
+			c.next += i + 1
+			return ip
+		}
+	}
+	return nil
+}
+
+// bindToDevice returns a net.Dialer Control function binding the socket
+// to iface
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) { err = setBindToDevice(fd, iface) }); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
@@ -0,0 +1,7 @@
+package socks5
+
+import "syscall"
+
+func setBindToDevice(fd uintptr, iface string) error {
+	return syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+}
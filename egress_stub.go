@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import "fmt"
+
+func setBindToDevice(fd uintptr, iface string) error {
+	return fmt.Errorf("Binding to interface %s is only supported on Linux", iface)
+}
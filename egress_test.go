@@ -0,0 +1,172 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestEgressDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	e, err := NewEgressDialer([]EgressRule{
+		{User: "foo", Addrs: []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("::1"), net.ParseIP("127.0.0.3")}},
+		{User: "bar", Addrs: []net.IP{net.ParseIP("::1")}},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	dialAs := func(user string) (net.Conn, error) {
+		req := &Request{AuthContext: &AuthContext{UserPassAuth, map[string]string{"Username": user}}}
+		ctx := context.WithValue(context.Background(), requestKey{}, req)
+		return e.DialContext(ctx, "tcp", l.Addr().String())
+	}
+
+	// IPv4 addresses are used in turn, the IPv6 one is skipped
+	for _, expected := range []string{"127.0.0.2", "127.0.0.3", "127.0.0.2"} {
+		conn, err := dialAs("foo")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if ip := conn.LocalAddr().(*net.TCPAddr).IP.String(); ip != expected {
+			t.Fatalf("bad local address: %v", ip)
+		}
+		conn.Close()
+	}
+
+	if _, err := dialAs("bar"); err == nil {
+		t.Fatalf("expected no usable egress address")
+	}
+
+	conn, err := dialAs("baz")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+}
+
+func TestEgressDialer_Name(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// The IPv6 address comes first, but the name has only an IPv4 one
+	e, _ := NewEgressDialer([]EgressRule{{Addrs: []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.2")}}})
+	e.lookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		if host != "v4.example" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []net.IP{net.IPv6loopback, net.IPv4(127, 0, 0, 1)}, nil
+	}
+	for i := 0; i < 2; i++ {
+		conn, err := e.DialContext(context.Background(), "tcp", net.JoinHostPort("v4.example", port))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if ip := conn.LocalAddr().(*net.TCPAddr).IP.String(); ip != "127.0.0.2" {
+			t.Fatalf("bad local address: %v", ip)
+		}
+		conn.Close()
+	}
+
+	if _, err := e.DialContext(context.Background(), "tcp", net.JoinHostPort("missing.example", port)); err == nil {
+		t.Fatalf("expected lookup failure")
+	}
+}
+
+func TestEgressDialer_Interface(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_BINDTODEVICE is Linux only")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	e, _ := NewEgressDialer([]EgressRule{{Match: "127.0.0.0/8", Interface: "lo"}})
+	conn, err := e.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Skipf("cannot bind to lo here: %v", err)
+	}
+	conn.Close()
+
+	e, _ = NewEgressDialer([]EgressRule{{Match: "127.0.0.0/8", Interface: "no-such-if0"}})
+	if _, err := e.DialContext(context.Background(), "tcp", l.Addr().String()); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestRequest_Connect_EgressBindAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	e, _ := NewEgressDialer([]EgressRule{{Match: "127.0.0.1", Addrs: []net.IP{net.ParseIP("127.0.0.4")}}})
+	s := &Server{config: &Config{
+		Rules:    PermitAll(),
+		Resolver: DNSResolver{},
+		Logger:   log.New(os.Stdout, "", log.LstdFlags),
+		Dial:     e.DialContext,
+	}}
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
+	buf.Write(port)
+
+	resp := &MockConn{}
+	req, err := NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s.handleRequest(req, resp)
+
+	// BND.ADDR carries the bound source address
+	out := resp.buf.Bytes()
+	if len(out) < 8 || out[1] != successReply || !bytes.Equal(out[4:8], []byte{127, 0, 0, 4}) {
+		t.Fatalf("bad: %v", out)
+	}
+}
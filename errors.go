@@ -0,0 +1,144 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ErrorCategory is a stable classification of why a request failed,
+// suitable for logs and metrics
+type ErrorCategory string
+
+const (
+	CategoryRefused            ErrorCategory = "connection_refused"
+	CategoryNetworkUnreachable ErrorCategory = "network_unreachable"
+	CategoryHostUnreachable    ErrorCategory = "host_unreachable"
+	CategoryTimeout            ErrorCategory = "timeout"
+	CategoryResolve            ErrorCategory = "resolve_failed"
+	CategoryRuleDenied         ErrorCategory = "rule_denied"
+	CategoryServerFailure      ErrorCategory = "server_failure"
+	CategoryUnknown            ErrorCategory = "unknown"
+)
+
+// replyForCategory is the RFC 1928 reply code sent for each category.
+// Config.ErrorReplies overrides it, and categories listed in neither
+// are answered with serverFailure.
+var replyForCategory = map[ErrorCategory]uint8{
+	CategoryRefused:            connectionRefused,
+	CategoryNetworkUnreachable: networkUnreachable,
+	CategoryHostUnreachable:    hostUnreachable,
+	CategoryTimeout:            ttlExpired,
+	CategoryResolve:            hostUnreachable,
+	CategoryRuleDenied:         ruleFailure,
+	CategoryServerFailure:      serverFailure,
+	CategoryUnknown:            hostUnreachable,
+}
+
+// RequestError is returned when a request fails after it was read.
+// Reply is the code sent to the client.
+type RequestError struct {
+	Category ErrorCategory
+	Reply    uint8
+	Err      error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%v [%s]", e.Err, e.Category)
+}
+
+// Unwrap returns the underlying error
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// ClassifyError maps an error from resolving or dialing a destination
+// to a category, looking at resolver errors, errno values, timeouts and
+// the reply of upstream proxies
+func ClassifyError(err error) ErrorCategory {
+	// An upstream proxy that cannot be reached is our failure, not a
+	// refusal by the destination
+	var hopErr *upstreamHopError
+	if errors.As(err, &hopErr) {
+		return CategoryServerFailure
+	}
+
+	var replyErr *upstreamReplyError
+	if errors.As(err, &replyErr) {
+		switch replyErr.Reply {
+		case connectionRefused:
+			return CategoryRefused
+		case networkUnreachable:
+			return CategoryNetworkUnreachable
+		case hostUnreachable:
+			return CategoryHostUnreachable
+		case ttlExpired:
+			return CategoryTimeout
+		case ruleFailure:
+			return CategoryRuleDenied
+		}
+		return CategoryServerFailure
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return CategoryTimeout
+		}
+		return CategoryResolve
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED:
+			return CategoryRefused
+		case syscall.ENETUNREACH:
+			return CategoryNetworkUnreachable
+		case syscall.EHOSTUNREACH, syscall.EHOSTDOWN:
+			return CategoryHostUnreachable
+		case syscall.ETIMEDOUT:
+			return CategoryTimeout
+		}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return CategoryTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return CategoryTimeout
+	}
+	if err == noSuitableAddress {
+		return CategoryHostUnreachable
+	}
+	return CategoryUnknown
+}
+
+// classify applies Config.ClassifyError before the default mapping
+func (s *Server) classify(err error) ErrorCategory {
+	if s.config.ClassifyError != nil {
+		if category := s.config.ClassifyError(err); category != "" {
+			return category
+		}
+	}
+	return ClassifyError(err)
+}
+
+// failRequest answers the client with the reply code of category and
+// returns a RequestError wrapping msg
+func (s *Server) failRequest(conn conn, req *Request, category ErrorCategory, msg error) error {
+	reply, ok := s.config.ErrorReplies[category]
+	if !ok {
+		reply, ok = replyForCategory[category]
+	}
+	if !ok {
+		reply = serverFailure
+	}
+	if err := replyTo(conn, req, reply, nil); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+	return &RequestError{Category: category, Reply: reply, Err: msg}
+}
@@ -0,0 +1,95 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	opErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	cases := []struct {
+		err      error
+		expected ErrorCategory
+	}{
+		{opErr(syscall.ECONNREFUSED), CategoryRefused},
+		{opErr(syscall.ENETUNREACH), CategoryNetworkUnreachable},
+		{opErr(syscall.EHOSTUNREACH), CategoryHostUnreachable},
+		{opErr(syscall.ETIMEDOUT), CategoryTimeout},
+		{fmt.Errorf("wrapped: %w", opErr(syscall.ECONNREFUSED)), CategoryRefused},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, CategoryResolve},
+		{&net.DNSError{Err: "i/o timeout", IsTimeout: true}, CategoryTimeout},
+		{context.DeadlineExceeded, CategoryTimeout},
+		{&upstreamReplyError{Reply: connectionRefused}, CategoryRefused},
+		{&upstreamReplyError{Reply: ruleFailure}, CategoryRuleDenied},
+		{&upstreamReplyError{Reply: serverFailure}, CategoryServerFailure},
+		{noSuitableAddress, CategoryHostUnreachable},
+		{fmt.Errorf("something else"), CategoryUnknown},
+	}
+	for _, c := range cases {
+		if got := ClassifyError(c.err); got != c.expected {
+			t.Fatalf("%v: got %v, expected %v", c.err, got, c.expected)
+		}
+	}
+}
+
+func TestRequest_Connect_ReplyCodes(t *testing.T) {
+	cases := []struct {
+		err      error
+		classify func(error) ErrorCategory
+		replies  map[ErrorCategory]uint8
+		reply    uint8
+		category ErrorCategory
+	}{
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, nil, nil, networkUnreachable, CategoryNetworkUnreachable},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, nil, nil, connectionRefused, CategoryRefused},
+		{fmt.Errorf("quota exceeded"), func(err error) ErrorCategory {
+			if err.Error() == "quota exceeded" {
+				return CategoryRuleDenied
+			}
+			return ""
+		}, nil, ruleFailure, CategoryRuleDenied},
+		{fmt.Errorf("tenant suspended"), func(err error) ErrorCategory {
+			return "tenant_suspended"
+		}, nil, serverFailure, "tenant_suspended"},
+		{fmt.Errorf("tenant suspended"), func(err error) ErrorCategory {
+			return "tenant_suspended"
+		}, map[ErrorCategory]uint8{"tenant_suspended": ruleFailure}, ruleFailure, "tenant_suspended"},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, nil,
+			map[ErrorCategory]uint8{CategoryRefused: hostUnreachable}, hostUnreachable, CategoryRefused},
+	}
+	for _, c := range cases {
+		dialErr := c.err
+		s := &Server{config: &Config{
+			Rules:    PermitAll(),
+			Resolver: DNSResolver{},
+			Logger:   log.New(os.Stdout, "", log.LstdFlags),
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return nil, dialErr
+			},
+			ClassifyError: c.classify,
+			ErrorReplies:  c.replies,
+		}}
+
+		resp := &MockConn{}
+		req, err := NewRequest(bytes.NewBuffer([]byte{5, 1, 0, 1, 192, 0, 2, 1, 0, 80}))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		err = s.handleRequest(req, resp)
+		reqErr, ok := err.(*RequestError)
+		if !ok || reqErr.Category != c.category || reqErr.Reply != c.reply {
+			t.Fatalf("%v: bad error: %#v", c.err, err)
+		}
+		if out := resp.buf.Bytes(); out[1] != c.reply {
+			t.Fatalf("%v: bad reply: %v", c.err, out)
+		}
+	}
+}
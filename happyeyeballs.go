@@ -0,0 +1,203 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// defaultFallbackDelay is the Connection Attempt Delay recommended by
+// RFC 8305
+const defaultFallbackDelay = 250 * time.Millisecond
+
+var (
+	noSuitableAddress = fmt.Errorf("No address of a suitable family")
+)
+
+// IPPreference controls which address families are dialed and in what
+// order
+type IPPreference uint8
+
+const (
+	// PreferIPv4 dials IPv4 first and races IPv6 after the fallback delay
+	PreferIPv4 IPPreference = iota
+	// PreferIPv6 dials IPv6 first and races IPv4 after the fallback delay
+	PreferIPv6
+	// IPv4Only never dials IPv6
+	IPv4Only
+	// IPv6Only never dials IPv4
+	IPv6Only
+)
+
+func (p IPPreference) String() string {
+	switch p {
+	case PreferIPv4:
+		return "prefer-ipv4"
+	case PreferIPv6:
+		return "prefer-ipv6"
+	case IPv4Only:
+		return "ipv4-only"
+	case IPv6Only:
+		return "ipv6-only"
+	}
+	return "IPPreference(" + strconv.Itoa(int(p)) + ")"
+}
+
+// orderAddrs drops the families excluded by pref and interleaves the
+// rest, starting with the preferred family, as described in RFC 8305
+// section 4
+func orderAddrs(ips []net.IP, pref IPPreference) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v4, v6
+	switch pref {
+	case PreferIPv6:
+		first, second = v6, v4
+	case IPv4Only:
+		second = nil
+	case IPv6Only:
+		first, second = v6, nil
+	}
+
+	out := make([]net.IP, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// HappyEyeballsDialer races connection attempts to every address of a
+// destination (RFC 8305). Attempts start in preference order, each one
+// FallbackDelay after the previous or as soon as the previous fails,
+// and the first connection to complete wins.
+type HappyEyeballsDialer struct {
+	// Dial makes a single connection attempt.
+	// Defaults to net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Resolver is used by DialContext to look up host names.
+	// Defaults to DNSResolver.
+	Resolver NameResolver
+
+	// Preference filters and orders the candidate addresses.
+	Preference IPPreference
+
+	// FallbackDelay is the time to wait for an attempt before starting
+	// the next one. Defaults to 250ms.
+	FallbackDelay time.Duration
+}
+
+// DialContext resolves the host of addr and races all of its addresses.
+// It can be used as Config.Dial.
+func (h *HappyEyeballsDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port %q: %v", portStr, err)
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		resolver := h.Resolver
+		if resolver == nil {
+			resolver = DNSResolver{}
+		}
+		if _, ips, err = AsMultiResolver(resolver).ResolveAll(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	return h.DialAddrs(ctx, network, ips, port)
+}
+
+// DialAddrs races connection attempts to ips on port
+func (h *HappyEyeballsDialer) DialAddrs(ctx context.Context, network string, ips []net.IP, port int) (net.Conn, error) {
+	ips = orderAddrs(ips, h.Preference)
+	if len(ips) == 0 {
+		return nil, noSuitableAddress
+	}
+
+	dial := h.Dial
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	delay := h.FallbackDelay
+	if delay <= 0 {
+		delay = defaultFallbackDelay
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next].String(), strconv.Itoa(port))
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, network, addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	var firstErr error
+	start()
+	for pending > 0 {
+		var timer *time.Timer
+		var fallback <-chan time.Time
+		if next < len(ips) {
+			timer = time.NewTimer(delay)
+			fallback = timer.C
+		}
+
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close any attempt that completes after the winner
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				start()
+			}
+
+		case <-fallback:
+			start()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return nil, firstErr
+}
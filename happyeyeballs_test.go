@@ -0,0 +1,135 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOrderAddrs(t *testing.T) {
+	a4 := net.ParseIP("192.0.2.1")
+	b4 := net.ParseIP("192.0.2.2")
+	a6 := net.ParseIP("2001:db8::1")
+	b6 := net.ParseIP("2001:db8::2")
+	ips := []net.IP{a4, b4, a6, b6}
+
+	cases := []struct {
+		pref     IPPreference
+		expected []net.IP
+	}{
+		{PreferIPv4, []net.IP{a4, a6, b4, b6}},
+		{PreferIPv6, []net.IP{a6, a4, b6, b4}},
+		{IPv4Only, []net.IP{a4, b4}},
+		{IPv6Only, []net.IP{a6, b6}},
+	}
+	for _, c := range cases {
+		if out := orderAddrs(ips, c.pref); !reflect.DeepEqual(out, c.expected) {
+			t.Fatalf("%v: bad: %v", c.pref, out)
+		}
+	}
+
+	if out := orderAddrs([]net.IP{a4}, IPv6Only); len(out) != 0 {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+// scriptedDial fails or stalls per address and records the dial order
+type scriptedDial struct {
+	mu     sync.Mutex
+	order  []string
+	fail   map[string]bool
+	stall  map[string]bool
+	target string
+}
+
+func (s *scriptedDial) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	s.mu.Lock()
+	s.order = append(s.order, addr)
+	s.mu.Unlock()
+	switch {
+	case s.fail[addr]:
+		return nil, fmt.Errorf("connection refused")
+	case s.stall[addr]:
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, s.target)
+}
+
+func (s *scriptedDial) dialed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.order...)
+}
+
+func TestHappyEyeballs_Fallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	// The preferred IPv6 address stalls, IPv4 must win after the delay
+	s := &scriptedDial{
+		stall:  map[string]bool{"[2001:db8::1]:80": true},
+		target: l.Addr().String(),
+	}
+	h := &HappyEyeballsDialer{Dial: s.dial, Preference: PreferIPv6, FallbackDelay: 20 * time.Millisecond}
+
+	start := time.Now()
+	conn, err := h.DialAddrs(context.Background(), "tcp", []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, 80)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("fallback started before the delay")
+	}
+	if order := s.dialed(); !reflect.DeepEqual(order, []string{"[2001:db8::1]:80", "192.0.2.1:80"}) {
+		t.Fatalf("bad order: %v", order)
+	}
+}
+
+func TestHappyEyeballs_FastFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	// A refused attempt starts the next one without waiting
+	s := &scriptedDial{
+		fail:   map[string]bool{"192.0.2.1:80": true},
+		target: l.Addr().String(),
+	}
+	h := &HappyEyeballsDialer{Dial: s.dial, FallbackDelay: time.Minute}
+
+	conn, err := h.DialAddrs(context.Background(), "tcp", []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}, 80)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+}
+
+func TestHappyEyeballs_AllFail(t *testing.T) {
+	s := &scriptedDial{fail: map[string]bool{"192.0.2.1:80": true, "[2001:db8::1]:80": true}}
+	h := &HappyEyeballsDialer{Dial: s.dial}
+
+	_, err := h.DialAddrs(context.Background(), "tcp", []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, 80)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if len(s.dialed()) != 2 {
+		t.Fatalf("expected both addresses to be tried: %v", s.dialed())
+	}
+
+	h.Preference = IPv6Only
+	if _, err := h.DialAddrs(context.Background(), "tcp", []net.IP{net.ParseIP("192.0.2.1")}, 80); err != noSuitableAddress {
+		t.Fatalf("err: %v", err)
+	}
+}
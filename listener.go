@@ -0,0 +1,114 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+)
+
+// MonitorPolicy decides whether connections of a Listener are monitored
+type MonitorPolicy uint8
+
+const (
+	// MonitorDefault follows Config.DisableMonitor
+	MonitorDefault MonitorPolicy = iota
+	MonitorEnabled
+	MonitorDisabled
+)
+
+// Listener is a listener served alongside others by one Server, with
+// policy overriding the server's Config for its connections.
+type Listener struct {
+	// Name identifies the listener. It prefixes the log lines of its
+	// connections and rules can read it with ListenerName.
+	Name string
+
+	// Listener accepts the connections. TCP listeners are clamped and
+	// monitored, the connections of a tls.NewListener are monitored on
+	// the TCP connection beneath, Unix socket listeners are neither.
+	Listener net.Listener
+
+	// Transparent serves connections redirected by iptables instead of
+	// SOCKS clients, see ServeTransparent.
+	Transparent bool
+
+	// AuthMethods and Credentials replace those of the Config when
+	// either one is set.
+	AuthMethods []Authenticator
+	Credentials CredentialStore
+
+	// Rules replaces the RuleSet of the Config when set.
+	Rules RuleSet
+
+	// Monitor overrides Config.DisableMonitor.
+	Monitor MonitorPolicy
+}
+
+type listenerKey struct{}
+
+// ListenerName returns the name of the Listener that accepted the
+// connection a request came from
+func ListenerName(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(listenerKey{}).(string)
+	return name, ok
+}
+
+// ServeListener serves connections from l with its policy
+func (s *Server) ServeListener(l *Listener) error {
+	if l.Transparent {
+		return s.serve(l.Listener, l, func(srv *Server, conn net.Conn) error {
+			return srv.serveTransparentConn(conn, l.Listener.Addr())
+		})
+	}
+	return s.serve(l.Listener, l, func(srv *Server, conn net.Conn) error { return srv.ServeConn(conn) })
+}
+
+// ServeListeners serves all listeners concurrently. When one of them
+// fails the others are closed and its error is returned. It fails at
+// once when there is nothing to serve.
+func (s *Server) ServeListeners(listeners ...*Listener) error {
+	if len(listeners) == 0 {
+		return fmt.Errorf("No listeners to serve")
+	}
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *Listener) { errCh <- s.ServeListener(l) }(l)
+	}
+	err := <-errCh
+	for _, l := range listeners {
+		l.Listener.Close()
+	}
+	for i := 1; i < len(listeners); i++ {
+		<-errCh
+	}
+	return err
+}
+
+// forListener returns a server whose Config has the overrides of l
+// applied, or s itself when there is no listener policy
+func (s *Server) forListener(l *Listener) *Server {
+	if l == nil {
+		return s
+	}
+	conf := *s.config
+	if l.AuthMethods != nil || l.Credentials != nil {
+		conf.AuthMethods = l.AuthMethods
+		conf.Credentials = l.Credentials
+	}
+	if l.Rules != nil {
+		conf.Rules = l.Rules
+	}
+	switch l.Monitor {
+	case MonitorEnabled:
+		conf.DisableMonitor = false
+	case MonitorDisabled:
+		conf.DisableMonitor = true
+	}
+	if l.Name != "" {
+		conf.Logger = log.New(conf.Logger.Writer(), conf.Logger.Prefix()+l.Name+": ", conf.Logger.Flags()|log.Lmsgprefix)
+	}
+	srv, _ := New(&conf)
+	srv.listener = l.Name
+	return srv
+}
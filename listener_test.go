@@ -0,0 +1,216 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// listenerRules allows requests from the named listeners and records
+// the names it was asked about
+type listenerRules struct {
+	allow map[string]bool
+
+	mu   sync.Mutex
+	seen []string
+}
+
+func (r *listenerRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	name, _ := ListenerName(ctx)
+	r.mu.Lock()
+	r.seen = append(r.seen, name)
+	r.mu.Unlock()
+	return ctx, r.allow[name]
+}
+
+func TestServeListeners_None(t *testing.T) {
+	serv, err := New(&Config{Logger: log.New(ioutil.Discard, "", 0)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := serv.ServeListeners(); err == nil {
+		t.Fatalf("expected an error without listeners")
+	}
+}
+
+func TestServeListeners(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	tcpL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "socks5-listener")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "socks.sock")
+	unixL, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	// Borrow the httptest certificate for the TLS listener
+	cert := httptest.NewTLSServer(http.NotFoundHandler())
+	defer cert.Close()
+	rawTLS, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tlsL := tls.NewListener(rawTLS, cert.TLS)
+
+	rules := &listenerRules{allow: map[string]bool{"public": true, "local": true, "secure": true}}
+	serv, err := New(&Config{
+		Rules:           rules,
+		Logger:          log.New(ioutil.Discard, "", 0),
+		DisableMSSClamp: true,
+		DisableMonitor:  true,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- serv.ServeListeners(
+			&Listener{Name: "public", Listener: tcpL, Credentials: StaticCredentials{"foo": "bar"}},
+			&Listener{Name: "local", Listener: unixL},
+			&Listener{Name: "secure", Listener: tlsL, Monitor: MonitorEnabled},
+		)
+	}()
+
+	// The TCP listener requires credentials
+	public := &UpstreamProxy{Type: UpstreamSOCKS5, Addr: tcpL.Addr().String(), Username: "foo", Password: "bar"}
+	pingPong(t, public, echo.Addr().String())
+	public.Password = "wrong"
+	if _, err := public.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Fatalf("expected auth failure on the public listener")
+	}
+
+	// The Unix socket keeps the server's auth-less default
+	local := &UpstreamProxy{
+		Type: UpstreamSOCKS5,
+		Addr: "local",
+		Forward: DialerFunc(func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		}),
+	}
+	pingPong(t, local, echo.Addr().String())
+
+	// So does the TLS listener
+	rootCAs := cert.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	secure := &UpstreamProxy{
+		Type: UpstreamSOCKS5,
+		Addr: rawTLS.Addr().String(),
+		Forward: DialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return tls.Dial(network, addr, &tls.Config{RootCAs: rootCAs, ServerName: "example.com"})
+		}),
+	}
+	pingPong(t, secure, echo.Addr().String())
+
+	rules.mu.Lock()
+	seen := rules.seen
+	rules.mu.Unlock()
+	if len(seen) != 3 || seen[0] != "public" || seen[1] != "local" || seen[2] != "secure" {
+		t.Fatalf("bad listener names: %v", seen)
+	}
+
+	// Closing one listener stops them all
+	tcpL.Close()
+	if err := <-done; err == nil {
+		t.Fatalf("expected an accept error")
+	}
+	if _, err := net.Dial("unix", sock); err == nil {
+		t.Fatalf("unix listener still open")
+	}
+}
+
+func TestServeListener_Rules(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	serv, err := New(&Config{
+		Logger:          log.New(ioutil.Discard, "", 0),
+		DisableMSSClamp: true,
+		DisableMonitor:  true,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.ServeListener(&Listener{Name: "closed", Listener: l, Rules: PermitNone()})
+
+	p := &UpstreamProxy{Type: UpstreamSOCKS5, Addr: l.Addr().String()}
+	if _, err := p.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Fatalf("expected the listener's rules to deny the request")
+	}
+}
+
+func TestServeListener_Reload(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	conf := func(rules RuleSet) *Config {
+		return &Config{
+			Rules:           rules,
+			Logger:          log.New(ioutil.Discard, "", 0),
+			DisableMSSClamp: true,
+			DisableMonitor:  true,
+		}
+	}
+	serv, err := New(conf(PermitNone()))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.ServeListener(&Listener{Name: "public", Listener: l, Credentials: StaticCredentials{"foo": "bar"}})
+
+	p := &UpstreamProxy{Type: UpstreamSOCKS5, Addr: l.Addr().String(), Username: "foo", Password: "bar"}
+	if _, err := p.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Fatalf("expected the rules to deny the request")
+	}
+
+	// The listener picks up the reloaded rules and keeps its own
+	// credentials
+	if err := serv.Reload(conf(PermitAll())); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pingPong(t, p, echo.Addr().String())
+	p.Password = "wrong"
+	if _, err := p.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Fatalf("expected auth failure after the reload")
+	}
+
+	// A reloaded policy replaces the listener's, revoking foo
+	if err := serv.Reload(conf(PermitAll()), &Listener{Name: "public", Credentials: StaticCredentials{"baz": "qux"}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	p.Password = "bar"
+	if _, err := p.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Fatalf("expected the revoked user to fail")
+	}
+	p.Username, p.Password = "baz", "qux"
+	pingPong(t, p, echo.Addr().String())
+
+	// Later reloads keep it unless they name the listener
+	if err := serv.Reload(conf(PermitAll())); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pingPong(t, p, echo.Addr().String())
+}
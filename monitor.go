@@ -0,0 +1,388 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/kennnnny/RRDproxy/sampler"
+	"github.com/mikioh/tcp"
+	"github.com/mikioh/tcpinfo"
+	"github.com/mikioh/tcpopt"
+)
+
+// Leg names one side of a relayed session
+type Leg string
+
+const (
+	// LegClient is the connection from the client to the server
+	LegClient Leg = "client"
+	// LegUpstream is the connection from the server to the destination
+	// or the next proxy
+	LegUpstream Leg = "upstream"
+	// LegHost is any other socket on the host, reported by MonitorHost
+	LegHost Leg = "host"
+)
+
+// LegSample is one TCP_INFO sample of one leg of a session
+type LegSample struct {
+	Leg     Leg
+	Request *Request
+	Local   net.Addr
+	Remote  net.Addr
+	Sample  *sampler.Sample
+	// Delta is the change since the previous sample of the leg, nil
+	// for the first one. For the final sample it covers the whole
+	// session.
+	Delta *sampler.Delta
+	// Final marks the summary taken when the session ended
+	Final bool
+}
+
+// Monitor monitors net.conn and shows tcp.infos
+func (s *Server) Monitor(tc *tcp.Conn) {
+	s.MonitorLeg(context.Background(), tc, LegClient, nil)
+}
+
+// MonitorLeg samples one leg of a session on the server's shared
+// sampler until ctx is done or the connection fails, then emits a
+// final summary.
+func (s *Server) MonitorLeg(ctx context.Context, tc *tcp.Conn, leg Leg, req *Request) {
+	lm := s.monitorLeg(tc, leg, req)
+	select {
+	case <-ctx.Done():
+	case <-lm.handle.Done():
+	}
+	lm.stop()
+}
+
+// legMonitor is one leg registered with the shared sampler
+type legMonitor struct {
+	s      *Server
+	tc     *tcp.Conn
+	leg    Leg
+	req    *Request
+	handle *sampler.Handle
+
+	// switched is set once the congestion control was changed
+	switched bool
+
+	// sndbuf and rcvbuf are the buffer sizes BufferGrowth starts from
+	sndbuf, rcvbuf int
+
+	// prev is the previous sample, blackholed is set while the leg
+	// stalls like an MTU blackhole and everBlackholed once it did
+	prev           *sampler.Sample
+	blackholed     bool
+	everBlackholed bool
+
+	// alerts judges the leg's samples for the alert detector
+	alerts *AlertStream
+
+	// startMSS is the MSS the upstream leg was dialed with, zero if the
+	// kernel picked it
+	startMSS int
+}
+
+// monitorLeg registers tc with the shared sampler
+func (s *Server) monitorLeg(tc *tcp.Conn, leg Leg, req *Request) *legMonitor {
+	lm := &legMonitor{s: s, tc: tc, leg: leg, req: req}
+	if s.config.BufferGrowth != nil {
+		lm.sndbuf, lm.rcvbuf = bufferSizes(tc)
+	}
+	if s.config.Alerts != nil {
+		lm.alerts = s.config.Alerts.Stream()
+	}
+	if leg == LegUpstream {
+		lm.startMSS = s.startMSS(lm.remoteIP())
+	}
+	lm.handle = s.config.Sampler.Register(tc, lm.sample)
+	return lm
+}
+
+// sample handles one sample taken by the shared sampler. An upstream
+// leg that stalls like an MTU blackhole teaches the MTUProber, other
+// legs hold the MSS clamp down until they recover.
+func (lm *legMonitor) sample(sample *sampler.Sample, delta *sampler.Delta) {
+	ls := lm.emit(sample, delta, false)
+	if lm.alerts != nil {
+		lm.alerts.Observe(ls)
+	}
+
+	//switch congestion control on paths the policy picks
+	conf := lm.s.config
+	if cs := conf.CongestionSwitch; cs != nil && !lm.switched && cs.want(ls) {
+		lm.switched = true
+		if err := lm.tc.SetOption(tcpinfo.CCAlgorithm(cs.Algorithm)); err != nil {
+			conf.Logger.Printf("[ERR] socks: Failed to switch the %s leg to %s: %v", lm.leg, cs.Algorithm, err)
+		} else {
+			conf.Logger.Printf("[INFO] socks: Switched the %s leg to %s from %s (rtt %v)", lm.leg, cs.Algorithm, sample.CCAlgorithm, sample.RTT)
+		}
+	}
+
+	//grow buffers to the bandwidth-delay product
+	if g := conf.BufferGrowth; g != nil && delta != nil {
+		lm.grow(g, sample, delta)
+	}
+
+	//lower MSS only for MTU problems, not congestion loss
+	verdict := classifyPath(lm.prev, sample, delta)
+	lm.prev = sample
+	switch verdict {
+	case pathOK:
+		if lm.blackholed {
+			lm.blackholed = false
+			lm.release()
+		}
+	case pathMTUChanged:
+		if p := conf.MTUProber; p != nil && lm.leg == LegUpstream {
+			p.PathMTU(lm.remoteIP(), int(sample.SenderMSS))
+		}
+	case pathBlackhole:
+		if lm.blackholed {
+			break
+		}
+		lm.blackholed, lm.everBlackholed = true, true
+		// The prober learns per destination and only new connections to
+		// it start at the size it picks, the live leg keeps its MSS.
+		// Client addresses have no place in it.
+		if p := conf.MTUProber; p != nil && lm.leg == LegUpstream {
+			mss := p.Blackhole(lm.remoteIP(), int(sample.SenderMSS))
+			conf.Logger.Printf("[INFO] socks: MTU blackhole on the %s leg to %v at MSS %d, connections to it start at %d", lm.leg, lm.tc.RemoteAddr(), sample.SenderMSS, mss)
+			break
+		}
+		conf.Logger.Printf("[INFO] socks: MTU blackhole on the %s leg to %v at MSS %d, clamping new connections to %d", lm.leg, lm.tc.RemoteAddr(), sample.SenderMSS, conf.RetransmitMSS)
+		lm.lower(conf.RetransmitMSS)
+	}
+}
+
+// lower holds the host's MSS clamp at mss or below until the leg
+// releases it, unless the Config leaves the clamp alone
+func (lm *legMonitor) lower(mss int) {
+	conf := lm.s.config
+	if conf.DisableMSSClamp {
+		return
+	}
+	if err := clamp.lower(lm, mss); err != nil {
+		conf.Logger.Printf("[ERR] socks: Failed to move the MSS clamp: %v", err)
+	}
+}
+
+// release drops the leg's hold on the MSS clamp, if any
+func (lm *legMonitor) release() {
+	if err := clamp.release(lm); err != nil {
+		lm.s.config.Logger.Printf("[ERR] socks: Failed to move the MSS clamp: %v", err)
+	}
+}
+
+// grow raises the leg's buffers by at least a quarter when the
+// bandwidth-delay product calls for it
+func (lm *legMonitor) grow(g *BufferGrowth, sample *sampler.Sample, delta *sampler.Delta) {
+	conf := lm.s.config
+	rtt := sample.ReceiverRTT
+	if rtt == 0 {
+		rtt = sample.RTT
+	}
+	snd := g.target(delta.DeliveryRate, sample.RTT)
+	rcv := g.target(delta.ReceiveRate, rtt)
+	if !(lm.sndbuf > 0 && snd > lm.sndbuf+lm.sndbuf/4) && !(lm.rcvbuf > 0 && rcv > lm.rcvbuf+lm.rcvbuf/4) {
+		return
+	}
+
+	// Setting a size ends autotuning, which may have gone past the
+	// target already
+	curSnd, curRcv := bufferSizes(lm.tc)
+	if curSnd > lm.sndbuf {
+		lm.sndbuf = curSnd
+	}
+	if curRcv > lm.rcvbuf {
+		lm.rcvbuf = curRcv
+	}
+	if lm.sndbuf > 0 && snd > lm.sndbuf+lm.sndbuf/4 {
+		if err := lm.tc.SetOption(tcpopt.SendBuffer(snd)); err != nil {
+			conf.Logger.Printf("[ERR] socks: Failed to grow the %s leg's send buffer: %v", lm.leg, err)
+		} else {
+			lm.sndbuf = snd
+		}
+	}
+	if lm.rcvbuf > 0 && rcv > lm.rcvbuf+lm.rcvbuf/4 {
+		if err := lm.tc.SetOption(tcpopt.ReceiveBuffer(rcv)); err != nil {
+			conf.Logger.Printf("[ERR] socks: Failed to grow the %s leg's receive buffer: %v", lm.leg, err)
+		} else {
+			lm.rcvbuf = rcv
+		}
+	}
+}
+
+// stop unregisters the leg, emits its summary and teaches it to the
+// path profiles
+func (lm *legMonitor) stop() {
+	final, delta := lm.handle.Close()
+	if lm.blackholed {
+		lm.release()
+	}
+	if final == nil {
+		return
+	}
+	lm.emit(final, delta, true)
+	if lm.leg != LegUpstream {
+		return
+	}
+	if p := lm.s.config.PathProfiles; p != nil {
+		p.Learn(lm.remoteIP(), final, delta, lm.startMSS)
+	}
+	if p := lm.s.config.MTUProber; p != nil && !lm.everBlackholed && delta != nil && delta.BytesAcked > 0 {
+		p.Delivered(lm.remoteIP(), int(final.SenderMSS))
+	}
+}
+
+// startMSS returns the MSS a connection to ip is dialed with, the
+// prober's size taking precedence over the profile's as its Control
+// function runs last
+func (s *Server) startMSS(ip net.IP) int {
+	if ip == nil {
+		return 0
+	}
+	if p := s.config.MTUProber; p != nil {
+		if mss := p.MSS(ip); mss > 0 {
+			return mss
+		}
+	}
+	if p := s.config.PathProfiles; p != nil {
+		if prof, ok := p.Lookup(ip); ok {
+			return prof.MSS
+		}
+	}
+	return 0
+}
+
+// remoteIP returns the address of the leg's peer
+func (lm *legMonitor) remoteIP() net.IP {
+	if addr, ok := lm.tc.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+func (lm *legMonitor) emit(sample *sampler.Sample, delta *sampler.Delta, final bool) LegSample {
+	ls := LegSample{
+		Leg:     lm.leg,
+		Request: lm.req,
+		Local:   lm.tc.LocalAddr(),
+		Remote:  lm.tc.RemoteAddr(),
+		Sample:  sample,
+		Delta:   delta,
+		Final:   final,
+	}
+	if lm.s.config.MonitorSample != nil {
+		lm.s.config.MonitorSample(ls)
+	}
+	return ls
+}
+
+// MonitorHost reports the sockets collected by c every MonitorInterval
+// as LegHost samples until ctx is done or collecting fails
+func (s *Server) MonitorHost(ctx context.Context, c *sampler.Collector) error {
+	ticker := time.NewTicker(s.config.MonitorInterval)
+	defer ticker.Stop()
+	streams := make(map[string]*AlertStream)
+	for {
+		socks, err := c.Collect()
+		if err != nil {
+			return err
+		}
+		seen := make(map[string]*AlertStream, len(socks))
+		for _, sock := range socks {
+			ls := LegSample{
+				Leg:    LegHost,
+				Local:  sock.Local,
+				Remote: sock.Remote,
+				Sample: sock.Sample,
+				Delta:  sock.Delta,
+			}
+			if s.config.MonitorSample != nil {
+				s.config.MonitorSample(ls)
+			}
+			if s.config.Alerts != nil {
+				key := sock.Local.String() + " " + sock.Remote.String()
+				st := streams[key]
+				if st == nil {
+					st = s.config.Alerts.Stream()
+				}
+				seen[key] = st
+				st.Observe(ls)
+			}
+		}
+		// Forget the sockets that are gone
+		streams = seen
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// sessionMonitor holds the monitored legs of a session
+type sessionMonitor struct {
+	legs []*legMonitor
+}
+
+// startMonitors registers every leg of the session that is a TCP
+// socket with the shared sampler, looking through wrappers that hide it
+func (s *Server) startMonitors(req *Request, client conn, target net.Conn) *sessionMonitor {
+	m := &sessionMonitor{}
+	if s.config.DisableMonitor || s.config.Sampler == nil {
+		return m
+	}
+	legs := []struct {
+		leg  Leg
+		conn interface{}
+	}{{LegClient, client}, {LegUpstream, target}}
+	for _, l := range legs {
+		c, ok := l.conn.(net.Conn)
+		if !ok {
+			continue
+		}
+		raw, ok := socketOf(c)
+		if !ok {
+			continue
+		}
+		tc, err := tcp.NewConn(raw)
+		if err != nil {
+			continue
+		}
+		m.legs = append(m.legs, s.monitorLeg(tc, l.leg, req))
+	}
+	return m
+}
+
+// stop unregisters the legs and emits their summaries
+func (m *sessionMonitor) stop() {
+	for _, lm := range m.legs {
+		lm.stop()
+	}
+}
+
+// socketOf returns the TCP socket carrying c. Unlike tcpConnOf it looks
+// through every wrapper, including TLS, since sampling does not touch
+// the stream.
+func socketOf(c net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			return v, true
+		case *tcp.Conn:
+			c = v.Conn
+		case *poolConn:
+			c = v.Conn
+		case *bufferedConn:
+			c = v.Conn
+		case *tls.Conn:
+			c = v.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
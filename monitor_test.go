@@ -0,0 +1,194 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kennnnny/RRDproxy/sampler"
+)
+
+func TestMonitor_BothLegs(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	samples := make(chan LegSample, 64)
+	serv, err := New(&Config{
+		Logger:          log.New(ioutil.Discard, "", 0),
+		DisableMSSClamp: true,
+		MonitorInterval: 10 * time.Millisecond,
+		MonitorSample: func(ls LegSample) {
+			select {
+			case samples <- ls:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	p := &UpstreamProxy{Type: UpstreamSOCKS5, Addr: l.Addr().String()}
+	conn, err := p.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	io.ReadFull(conn, make([]byte, 4))
+
+	seen := make(map[Leg]LegSample)
+	timeout := time.After(2 * time.Second)
+	for len(seen) < 2 {
+		select {
+		case ls := <-samples:
+			seen[ls.Leg] = ls
+		case <-timeout:
+			t.Fatalf("missing legs, saw %v", seen)
+		}
+	}
+	if r := seen[LegUpstream].Remote.String(); r != echo.Addr().String() {
+		t.Fatalf("upstream leg sampled %v", r)
+	}
+	if r := seen[LegClient].Local.String(); r != l.Addr().String() {
+		t.Fatalf("client leg sampled %v", r)
+	}
+	if seen[LegClient].Request == nil {
+		t.Fatalf("missing request")
+	}
+
+	// Ending the session stops both monitors with a summary each
+	conn.Close()
+	final := make(map[Leg]LegSample)
+	for len(final) < 2 {
+		select {
+		case ls := <-samples:
+			if ls.Final {
+				final[ls.Leg] = ls
+			}
+		case <-timeout:
+			t.Fatalf("missing final samples, saw %v", final)
+		}
+	}
+	for leg, ls := range final {
+		if ls.Sample == nil || ls.Delta == nil {
+			t.Fatalf("bad %s summary: %+v", leg, ls)
+		}
+	}
+}
+
+func TestMonitor_NotStartedOnFailedHandshake(t *testing.T) {
+	samples := make(chan LegSample, 1)
+	serv, err := New(&Config{
+		Logger:          log.New(ioutil.Discard, "", 0),
+		DisableMSSClamp: true,
+		MonitorSample:   func(ls LegSample) { samples <- ls },
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Write([]byte{4, 1})
+	io.Copy(ioutil.Discard, conn)
+	conn.Close()
+
+	select {
+	case ls := <-samples:
+		t.Fatalf("unexpected sample: %+v", ls)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMonitorHost(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	conn, err := net.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	col, err := sampler.NewCollector(sampler.Filter{
+		LocalPorts: []int{conn.LocalAddr().(*net.TCPAddr).Port},
+	})
+	if err != nil {
+		t.Skipf("sock_diag unavailable: %v", err)
+	}
+	defer col.Close()
+
+	samples := make(chan LegSample, 16)
+	serv, err := New(&Config{
+		Logger:          log.New(ioutil.Discard, "", 0),
+		MonitorInterval: 10 * time.Millisecond,
+		MonitorSample: func(ls LegSample) {
+			select {
+			case samples <- ls:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serv.MonitorHost(ctx, col) }()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case ls := <-samples:
+			if ls.Leg != LegHost || ls.Remote.String() != echo.Addr().String() {
+				t.Fatalf("bad host sample: %+v", ls)
+			}
+			if i == 1 && ls.Delta == nil {
+				t.Fatalf("missing delta on the second collection")
+			}
+		case err := <-done:
+			t.Skipf("sock_diag unavailable: %v", err)
+		case <-time.After(time.Second):
+			t.Fatalf("no host samples")
+		}
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestSocketOf(t *testing.T) {
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer s.Close()
+
+	for _, wrapped := range []net.Conn{c, &poolConn{Conn: c}, &bufferedConn{Conn: &poolConn{Conn: c}}} {
+		if got, ok := socketOf(wrapped); !ok || got != c {
+			t.Fatalf("%T not unwrapped", wrapped)
+		}
+	}
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	if _, ok := socketOf(p1); ok {
+		t.Fatalf("pipe has no socket")
+	}
+}
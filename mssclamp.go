@@ -0,0 +1,120 @@
+package socks5
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// runIptables runs iptables with args, replaced in tests
+var runIptables = defaultRunIptables
+
+func defaultRunIptables(args ...string) error {
+	out, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// mssClamp is the TCPMSS rule at the head of the host's mangle
+// POSTROUTING chain. There is one per host, so every Server of the
+// process shares it.
+type mssClamp struct {
+	mu        sync.Mutex
+	installed bool
+	// base is the MSS of the Config that installed the rule, mss the
+	// one it clamps to now
+	base, mss int
+	// holds are the sizes legs lowered the rule to, by leg. The rule
+	// clamps to the smallest of them and base.
+	holds map[interface{}]int
+}
+
+var clamp mssClamp
+
+// ensure installs the rule clamping to base the first time it is
+// called, and moves it to a new base after a reload. Failures are
+// reported once, not on every connection.
+func (c *mssClamp) ensure(base int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.installed {
+		if base == c.base {
+			return nil
+		}
+		c.base = base
+		return c.apply()
+	}
+	c.installed, c.base = true, base
+	if err := runIptables("-t", "mangle", "-F"); err != nil {
+		return err
+	}
+	mss := c.target()
+	if err := runIptables(clampRule("-I", mss)...); err != nil {
+		return err
+	}
+	c.mss = mss
+	return nil
+}
+
+// lower holds the rule at mss or below until key releases it
+func (c *mssClamp) lower(key interface{}, mss int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.holds == nil {
+		c.holds = make(map[interface{}]int)
+	}
+	c.holds[key] = mss
+	return c.apply()
+}
+
+// release drops the hold of key, the rule going back up once no other
+// hold keeps it down
+func (c *mssClamp) release(key interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.holds[key]; !ok {
+		return nil
+	}
+	delete(c.holds, key)
+	return c.apply()
+}
+
+// target is the size the rule should clamp to, called with c.mu held
+func (c *mssClamp) target() int {
+	mss := c.base
+	for _, held := range c.holds {
+		if held < mss {
+			mss = held
+		}
+	}
+	return mss
+}
+
+// apply moves the rule to the target size, called with c.mu held
+func (c *mssClamp) apply() error {
+	if mss := c.target(); c.installed && mss != c.mss {
+		return c.replace(mss)
+	}
+	return nil
+}
+
+// replace rewrites the rule, called with c.mu held
+func (c *mssClamp) replace(mss int) error {
+	if err := runIptables(clampRule("-R", mss)...); err != nil {
+		return err
+	}
+	c.mss = mss
+	return nil
+}
+
+func clampRule(op string, mss int) []string {
+	args := []string{"-t", "mangle", op, "POSTROUTING"}
+	if op == "-R" {
+		args = append(args, "1")
+	}
+	return append(args, "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS", "--set-mss", strconv.Itoa(mss))
+}
@@ -0,0 +1,356 @@
+package socks5
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kennnnny/RRDproxy/sampler"
+)
+
+// maxTCPOptions is the most a segment's TCP options take off its MSS
+const maxTCPOptions = 40
+
+// PathProfile is what sessions taught about the path to a destination
+// prefix
+type PathProfile struct {
+	Prefix string `json:"prefix"`
+
+	// MSS is the segment size to start connections with, zero to
+	// leave it to the kernel. MSSUpdated is when a session last showed
+	// it.
+	MSS        int       `json:"mss,omitempty"`
+	MSSUpdated time.Time `json:"mss_updated,omitempty"`
+
+	// RTT and LossRate are moving averages over the sessions, LossRate
+	// being the share of data segments retransmitted
+	RTT      time.Duration `json:"rtt"`
+	LossRate float64       `json:"loss_rate"`
+
+	// Congestion is the algorithm that delivered fastest so far
+	Congestion string `json:"congestion,omitempty"`
+
+	// Rates is the moving average delivery rate per algorithm in bytes
+	// per second
+	Rates map[string]float64 `json:"rates,omitempty"`
+
+	Sessions int       `json:"sessions"`
+	Updated  time.Time `json:"updated"`
+}
+
+// PathProfileOptions configures a PathProfiles store. Zero fields take
+// the defaults noted.
+type PathProfileOptions struct {
+	// IPv4Bits and IPv6Bits are the prefix lengths destinations are
+	// grouped by, 24 and 48 by default
+	IPv4Bits int
+	IPv6Bits int
+
+	// HalfLife is the age at which a profile counts half as much as a
+	// new session, an hour by default. It is also how long a learned
+	// MSS is used without a session showing it again, after which
+	// connections go back to full-sized segments. Profiles older than
+	// MaxAge, a day by default, are forgotten.
+	HalfLife time.Duration
+	MaxAge   time.Duration
+
+	// Path is the file profiles are loaded from and saved to, none if
+	// empty. They are saved at most every SaveInterval, a minute by
+	// default, as sessions end.
+	Path         string
+	SaveInterval time.Duration
+
+	// Logger reports saves that fail in the background. A Server
+	// sets its own Logger when this is nil.
+	Logger *log.Logger
+}
+
+// PathProfiles learns a PathProfile per destination prefix from the
+// final samples of upstream legs and applies it to new connections
+type PathProfiles struct {
+	opts PathProfileOptions
+
+	mu       sync.Mutex
+	profiles map[string]*PathProfile
+	lastSave time.Time
+	saving   bool
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewPathProfiles returns a store, loading the profiles saved at
+// opts.Path if the file exists
+func NewPathProfiles(opts PathProfileOptions) (*PathProfiles, error) {
+	if opts.IPv4Bits == 0 {
+		opts.IPv4Bits = 24
+	}
+	if opts.IPv6Bits == 0 {
+		opts.IPv6Bits = 48
+	}
+	if opts.IPv4Bits < 0 || opts.IPv4Bits > 32 || opts.IPv6Bits < 0 || opts.IPv6Bits > 128 {
+		return nil, fmt.Errorf("Invalid prefix lengths /%d and /%d", opts.IPv4Bits, opts.IPv6Bits)
+	}
+	if opts.HalfLife == 0 {
+		opts.HalfLife = time.Hour
+	}
+	if opts.MaxAge == 0 {
+		opts.MaxAge = 24 * time.Hour
+	}
+	if opts.SaveInterval == 0 {
+		opts.SaveInterval = time.Minute
+	}
+	p := &PathProfiles{opts: opts, profiles: make(map[string]*PathProfile), now: time.Now}
+	if opts.Path != "" {
+		if err := p.load(); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// prefix returns the key of ip's profile
+func (p *PathProfiles) prefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(p.opts.IPv4Bits, 32)), Mask: net.CIDRMask(p.opts.IPv4Bits, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(p.opts.IPv6Bits, 128)), Mask: net.CIDRMask(p.opts.IPv6Bits, 128)}).String()
+}
+
+// Lookup returns a copy of the profile covering ip, if one is fresh
+func (p *PathProfiles) Lookup(ip net.IP) (PathProfile, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := p.prefix(ip)
+	prof, ok := p.profiles[key]
+	if !ok {
+		return PathProfile{}, false
+	}
+	now := p.now()
+	if now.Sub(prof.Updated) > p.opts.MaxAge {
+		delete(p.profiles, key)
+		return PathProfile{}, false
+	}
+	if prof.MSS > 0 && now.Sub(prof.MSSUpdated) > p.opts.HalfLife {
+		prof.MSS = 0
+	}
+	return *prof, true
+}
+
+// weight returns how much a profile last updated at t still counts
+func (p *PathProfiles) weight(t time.Time) float64 {
+	age := p.now().Sub(t)
+	if age <= 0 {
+		return 1
+	}
+	return math.Pow(0.5, float64(age)/float64(p.opts.HalfLife))
+}
+
+// Learn folds the summary of a session with ip into its profile. A
+// session counts as much as the profile's past decayed by its age,
+// and no less than a fifth.
+//
+// startMSS is the MSS the connection was started with, zero if the
+// kernel picked it. A session started with a lowered MSS says nothing
+// about the path's segment size unless the kernel went lower still.
+func (p *PathProfiles) Learn(ip net.IP, sample *sampler.Sample, delta *sampler.Delta, startMSS int) {
+	if ip == nil || sample == nil || delta == nil {
+		return
+	}
+	p.mu.Lock()
+	key := p.prefix(ip)
+	prof, ok := p.profiles[key]
+	now := p.now()
+	if !ok || now.Sub(prof.Updated) > p.opts.MaxAge {
+		prof = &PathProfile{Prefix: key, RTT: sample.RTT, LossRate: delta.RetransRatio, Rates: make(map[string]float64)}
+		p.profiles[key] = prof
+	}
+	alpha := math.Max(0.2, 1-p.weight(prof.Updated)*float64(prof.Sessions)/float64(prof.Sessions+1))
+	prof.RTT = time.Duration((1-alpha)*float64(prof.RTT) + alpha*float64(sample.RTT))
+	prof.LossRate = (1-alpha)*prof.LossRate + alpha*delta.RetransRatio
+
+	// Loss alone is no reason to lower the MSS, only what the kernel
+	// settled on is. SenderMSS leaves out the TCP options, so a clamped
+	// session shows less than it started with unless the path allowed
+	// more. A path that recovers shows it once the learned MSS lapses,
+	// see Lookup. Without a start MSS the kernel started from the one it
+	// advertised, and anything not below it is no news.
+	if startMSS == 0 {
+		startMSS = int(sample.AdvertisedMSS)
+	}
+	if mss := int(sample.SenderMSS); mss > 0 && mss < startMSS-maxTCPOptions {
+		prof.MSS, prof.MSSUpdated = mss, now
+	}
+
+	if algo := sample.CCAlgorithm; algo != "" && delta.DeliveryRate > 0 {
+		if rate, ok := prof.Rates[algo]; ok {
+			prof.Rates[algo] = (1-alpha)*rate + alpha*delta.DeliveryRate
+		} else {
+			prof.Rates[algo] = delta.DeliveryRate
+		}
+		best := 0.0
+		for algo, rate := range prof.Rates {
+			if rate > best {
+				best, prof.Congestion = rate, algo
+			}
+		}
+	}
+	prof.Sessions++
+	prof.Updated = now
+
+	save := p.opts.Path != "" && !p.saving && now.Sub(p.lastSave) >= p.opts.SaveInterval
+	if save {
+		p.saving = true
+	}
+	p.mu.Unlock()
+	if save {
+		go func() {
+			err := p.Save()
+			p.mu.Lock()
+			p.saving = false
+			logger := p.opts.Logger
+			p.mu.Unlock()
+			if err != nil && logger != nil {
+				logger.Printf("[ERR] socks: Failed to save path profiles: %v", err)
+			}
+		}()
+	}
+}
+
+// setLogger sets the Logger of a store that has none
+func (p *PathProfiles) setLogger(logger *log.Logger) {
+	p.mu.Lock()
+	if p.opts.Logger == nil {
+		p.opts.Logger = logger
+	}
+	p.mu.Unlock()
+}
+
+// pathProfilesFile is the saved form of the store
+type pathProfilesFile struct {
+	Version  int            `json:"version"`
+	Profiles []*PathProfile `json:"profiles"`
+}
+
+// Save writes the fresh profiles to the store's file, replacing it
+// atomically
+func (p *PathProfiles) Save() error {
+	if p.opts.Path == "" {
+		return nil
+	}
+	p.mu.Lock()
+	file := pathProfilesFile{Version: 1}
+	now := p.now()
+	for key, prof := range p.profiles {
+		if now.Sub(prof.Updated) > p.opts.MaxAge {
+			delete(p.profiles, key)
+			continue
+		}
+		c := *prof
+		file.Profiles = append(file.Profiles, &c)
+	}
+	p.lastSave = now
+	p.mu.Unlock()
+
+	b, err := json.MarshalIndent(&file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p.opts.Path), filepath.Base(p.opts.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p.opts.Path)
+}
+
+// load reads the store's file, skipping profiles past MaxAge
+func (p *PathProfiles) load() error {
+	b, err := ioutil.ReadFile(p.opts.Path)
+	if err != nil {
+		return err
+	}
+	var file pathProfilesFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return fmt.Errorf("Failed to load path profiles from %s: %v", p.opts.Path, err)
+	}
+	if file.Version != 1 {
+		return fmt.Errorf("Unsupported path profiles version %d in %s", file.Version, p.opts.Path)
+	}
+	now := p.now()
+	for _, prof := range file.Profiles {
+		if now.Sub(prof.Updated) > p.opts.MaxAge {
+			continue
+		}
+		if prof.Rates == nil {
+			prof.Rates = make(map[string]float64)
+		}
+		p.profiles[prof.Prefix] = prof
+	}
+	return nil
+}
+
+// control returns a net.Dialer Control function starting connections
+// with the profile of the address dialed. A congestion control chosen
+// by the rules is set after the dial and takes precedence.
+func (p *PathProfiles) control() func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil
+		}
+		prof, ok := p.Lookup(ip)
+		if !ok {
+			return nil
+		}
+		c.Control(func(fd uintptr) { setPathOptions(fd, prof.MSS, prof.Congestion) })
+		return nil
+	}
+}
+
+type dialControlKey struct{}
+
+// withDialControl hands a Control function to the dialers that honor
+// it, the default one and EgressDialer. It runs after any handed over
+// before.
+func withDialControl(ctx context.Context, fn func(network, address string, c syscall.RawConn) error) context.Context {
+	return context.WithValue(ctx, dialControlKey{}, chainControl(ctx, fn))
+}
+
+// chainControl runs fn, if any, after the Control function from ctx
+func chainControl(ctx context.Context, fn func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	first, ok := ctx.Value(dialControlKey{}).(func(network, address string, c syscall.RawConn) error)
+	if !ok {
+		return fn
+	}
+	if fn == nil {
+		return first
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if err := first(network, address, c); err != nil {
+			return err
+		}
+		return fn(network, address, c)
+	}
+}
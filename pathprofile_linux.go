@@ -0,0 +1,14 @@
+package socks5
+
+import "syscall"
+
+// setPathOptions sets the MSS and congestion control a connection
+// starts with, where given. Failures leave the kernel's choice.
+func setPathOptions(fd uintptr, mss int, congestion string) {
+	if mss > 0 {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, mss)
+	}
+	if congestion != "" {
+		syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, congestion)
+	}
+}
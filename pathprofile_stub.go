@@ -0,0 +1,6 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+func setPathOptions(fd uintptr, mss int, congestion string) {}
@@ -0,0 +1,246 @@
+package socks5
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kennnnny/RRDproxy/sampler"
+)
+
+// learn teaches p a session with ip summarized as the monitor does,
+// the kernel having picked the MSS from a 1500 byte MTU
+func learn(p *PathProfiles, ip string, rtt time.Duration, mss uint, algo string, loss, rate float64) {
+	p.Learn(net.ParseIP(ip),
+		&sampler.Sample{RTT: rtt, SenderMSS: mss, AdvertisedMSS: 1460, CCAlgorithm: algo},
+		&sampler.Delta{RetransRatio: loss, DeliveryRate: rate}, 0)
+}
+
+func TestPathProfiles_Learn(t *testing.T) {
+	p, err := NewPathProfiles(PathProfileOptions{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	learn(p, "192.0.2.10", 100*time.Millisecond, 1448, "cubic", 0, 1e6)
+	learn(p, "192.0.2.20", 200*time.Millisecond, 1448, "bbr", 0, 3e6)
+
+	// Both fall in one /24 and average
+	prof, ok := p.Lookup(net.ParseIP("192.0.2.99"))
+	if !ok || prof.Prefix != "192.0.2.0/24" || prof.Sessions != 2 {
+		t.Fatalf("bad profile: %+v", prof)
+	}
+	// The MSS the kernel started with is nothing learned
+	if prof.RTT != 150*time.Millisecond || prof.MSS != 0 || prof.Congestion != "bbr" {
+		t.Fatalf("bad profile: %+v", prof)
+	}
+	if _, ok := p.Lookup(net.ParseIP("198.51.100.1")); ok {
+		t.Fatalf("unexpected profile for another prefix")
+	}
+
+	// Loss alone leaves the MSS alone, the kernel lowering it does not
+	learn(p, "192.0.2.30", 150*time.Millisecond, 1448, "bbr", 0.3, 3e6)
+	if prof, _ := p.Lookup(net.ParseIP("192.0.2.1")); prof.MSS != 0 || prof.LossRate < 0.02 {
+		t.Fatalf("lossy path learned an MSS: %+v", prof)
+	}
+	learn(p, "192.0.2.30", 150*time.Millisecond, 1380, "bbr", 0, 3e6)
+	if prof, _ := p.Lookup(net.ParseIP("192.0.2.1")); prof.MSS != 1380 {
+		t.Fatalf("lowered MSS not learned: %+v", prof)
+	}
+
+	// A session started with the learned MSS does not lower it, one
+	// where the kernel went lower still does
+	p.Learn(net.ParseIP("192.0.2.30"), &sampler.Sample{RTT: 150 * time.Millisecond, SenderMSS: 1356}, &sampler.Delta{}, 1380)
+	if prof, _ := p.Lookup(net.ParseIP("192.0.2.1")); prof.MSS != 1380 {
+		t.Fatalf("clamped session lowered the MSS: %+v", prof)
+	}
+	p.Learn(net.ParseIP("192.0.2.30"), &sampler.Sample{RTT: 150 * time.Millisecond, SenderMSS: 1200}, &sampler.Delta{}, 1380)
+	if prof, _ := p.Lookup(net.ParseIP("192.0.2.1")); prof.MSS != 1200 {
+		t.Fatalf("smaller MSS not learned: %+v", prof)
+	}
+
+	// and the MSS lapses once no session has shown it for HalfLife,
+	// although the profile stays
+	now = now.Add(90 * time.Minute)
+	p.Learn(net.ParseIP("192.0.2.30"), &sampler.Sample{RTT: 150 * time.Millisecond, SenderMSS: 1200}, &sampler.Delta{}, 1200)
+	if prof, ok := p.Lookup(net.ParseIP("192.0.2.1")); !ok || prof.MSS != 0 {
+		t.Fatalf("stale MSS still used: %+v", prof)
+	}
+
+	// A stale profile gives way to a new session faster
+	now = now.Add(3 * time.Hour)
+	learn(p, "192.0.2.30", 20*time.Millisecond, 1448, "bbr", 0, 3e6)
+	if prof, _ := p.Lookup(net.ParseIP("192.0.2.1")); prof.RTT > 40*time.Millisecond {
+		t.Fatalf("stale RTT not replaced: %v", prof.RTT)
+	}
+
+	// and is forgotten past MaxAge
+	now = now.Add(25 * time.Hour)
+	if _, ok := p.Lookup(net.ParseIP("192.0.2.1")); ok {
+		t.Fatalf("expired profile still used")
+	}
+}
+
+func TestPathProfiles_Persist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5-profiles")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "profiles.json")
+
+	p, err := NewPathProfiles(PathProfileOptions{Path: path, IPv6Bits: 64})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	learn(p, "2001:db8::1", 80*time.Millisecond, 1380, "bbr", 0.01, 2e6)
+	learn(p, "203.0.113.5", 10*time.Millisecond, 1448, "cubic", 0, 5e6)
+	if err := p.Save(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	q, err := NewPathProfiles(PathProfileOptions{Path: path, IPv6Bits: 64})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	prof, ok := q.Lookup(net.ParseIP("2001:db8::ffff"))
+	if !ok || prof.Prefix != "2001:db8::/64" || prof.MSS != 1380 || prof.Congestion != "bbr" || prof.RTT != 80*time.Millisecond {
+		t.Fatalf("bad reloaded profile: %+v", prof)
+	}
+	if _, ok := q.Lookup(net.ParseIP("203.0.113.200")); !ok {
+		t.Fatalf("missing reloaded IPv4 profile")
+	}
+
+	// Nothing to load is no error, garbage is
+	if _, err := NewPathProfiles(PathProfileOptions{Path: filepath.Join(dir, "missing.json")}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ioutil.WriteFile(path, []byte("{"), 0600)
+	if _, err := NewPathProfiles(PathProfileOptions{Path: path}); err == nil {
+		t.Fatalf("expected a load error")
+	}
+}
+
+// chanWriter hands every write to a channel
+type chanWriter chan string
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	w <- string(b)
+	return len(b), nil
+}
+
+func TestPathProfiles_SaveError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks5-profiles")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A server hands its Logger to the store, which reports failing
+	// background saves through it
+	p, err := NewPathProfiles(PathProfileOptions{Path: filepath.Join(dir, "missing", "profiles.json")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	logs := make(chanWriter, 1)
+	if _, err := New(&Config{Logger: log.New(logs, "", 0), PathProfiles: p}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	learn(p, "192.0.2.10", 100*time.Millisecond, 1448, "cubic", 0, 1e6)
+	select {
+	case line := <-logs:
+		if !strings.Contains(line, "Failed to save path profiles") {
+			t.Fatalf("bad log: %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("save error not logged")
+	}
+}
+
+func TestPathProfiles_Dial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	p, _ := NewPathProfiles(PathProfileOptions{})
+	learn(p, "127.0.0.1", time.Millisecond, 1000, "reno", 0, 1e6)
+
+	d := net.Dialer{Control: p.control()}
+	conn, err := d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	raw, _ := conn.(*net.TCPConn).SyscallConn()
+	var mss int
+	raw.Control(func(fd uintptr) {
+		mss, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG)
+	})
+	if mss == 0 || mss > 1000 {
+		t.Fatalf("connection not started with the learned MSS: %d", mss)
+	}
+
+	// reno may not be allowed in this kernel
+	if err := setCongestion(conn, "reno"); err != nil {
+		t.Skipf("reno not allowed: %v", err)
+	}
+	if s, err := sampleOf(conn); err != nil || s.CCAlgorithm != "reno" {
+		t.Fatalf("connection not started with the learned congestion control: %+v %v", s, err)
+	}
+}
+
+func TestPathProfiles_Session(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	p, _ := NewPathProfiles(PathProfileOptions{})
+	serv, err := New(&Config{
+		Logger:          log.New(ioutil.Discard, "", 0),
+		DisableMSSClamp: true,
+		MonitorInterval: 10 * time.Millisecond,
+		MonitorSample:   func(LegSample) {},
+		PathProfiles:    p,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	pingPong(t, &UpstreamProxy{Type: UpstreamSOCKS5, Addr: l.Addr().String()}, echo.Addr().String())
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if prof, ok := p.Lookup(net.ParseIP("127.0.0.1")); ok {
+			if prof.Sessions != 1 || prof.MSS == 0 {
+				t.Fatalf("bad learned profile: %+v", prof)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("session not learned")
+}
@@ -0,0 +1,278 @@
+package socks5
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kennnnny/RRDproxy/sampler"
+)
+
+// pathVerdict is what one sample interval says about a path
+type pathVerdict int
+
+const (
+	// pathOK saw no retransmissions
+	pathOK pathVerdict = iota
+	// pathCongestion retransmitted while data kept being acknowledged,
+	// loss that smaller segments would not fix
+	pathCongestion
+	// pathMTUChanged saw the kernel lower the path MTU, so ICMP gets
+	// through and it already adapted
+	pathMTUChanged
+	// pathBlackhole stalled: segments were retransmitted with backoff
+	// and nothing was acknowledged, while the peer kept acknowledging
+	// the smaller segments that got through, as when full-sized ones
+	// are dropped without an ICMP message
+	pathBlackhole
+	// pathStalled stalled the same way with nothing heard from the
+	// peer, which went away rather than drop large segments
+	pathStalled
+)
+
+// minPathMSS is the smallest MSS every IPv4 path carries, segments no
+// larger are not lost to an MTU blackhole
+const minPathMSS = 536
+
+func (v pathVerdict) String() string {
+	switch v {
+	case pathCongestion:
+		return "congestion"
+	case pathMTUChanged:
+		return "path MTU change"
+	case pathBlackhole:
+		return "MTU blackhole"
+	case pathStalled:
+		return "stall"
+	}
+	return "ok"
+}
+
+// classifyPath reads the interval ending with cur, prev being the
+// sample it started with, if any
+func classifyPath(prev, cur *sampler.Sample, d *sampler.Delta) pathVerdict {
+	if prev != nil && cur.PathMTU > 0 && cur.PathMTU < prev.PathMTU {
+		return pathMTUChanged
+	}
+	if d == nil || d.RetransSegs == 0 {
+		return pathOK
+	}
+	if cur.Backoffs > 0 && cur.UnackedSegs > 0 && d.BytesAcked == 0 {
+		// Duplicate ACKs mean segments after the lost ones, such as the
+		// short tail of a write, still got through
+		if cur.SenderMSS > minPathMSS && d.Interval > 0 && cur.LastAckReceived < d.Interval {
+			return pathBlackhole
+		}
+		return pathStalled
+	}
+	return pathCongestion
+}
+
+// MTUProber searches for the largest MSS that gets through to each
+// destination in the manner of RFC 4821 packetization layer path MTU
+// discovery. Blackholes lower the upper bound, sessions that delivered
+// data at a size raise the lower bound, and new connections start at
+// the midpoint until the bounds meet.
+type MTUProber struct {
+	// MinMSS is the smallest size tried, 536 by default
+	MinMSS int
+
+	// Precision is the gap between the bounds at which the search
+	// stops, 16 bytes by default
+	Precision int
+
+	// MaxAge is how long a destination's search is kept after it was
+	// last updated before it starts over, 1h by default, since paths
+	// change
+	MaxAge time.Duration
+
+	// MaxPaths bounds the destinations tracked, 4096 by default. The
+	// least recently updated ones make room for new ones.
+	MaxPaths int
+
+	mu    sync.Mutex
+	paths map[string]*mtuSearch
+	now   func() time.Time
+}
+
+// mtuSearch is the search state of one destination. A zero hi means no
+// upper bound was found yet.
+type mtuSearch struct {
+	lo, hi  int
+	updated time.Time
+}
+
+func (p *MTUProber) minMSS() int {
+	if p.MinMSS > 0 {
+		return p.MinMSS
+	}
+	return minPathMSS
+}
+
+func (p *MTUProber) precision() int {
+	if p.Precision > 0 {
+		return p.Precision
+	}
+	return 16
+}
+
+func (p *MTUProber) maxAge() time.Duration {
+	if p.MaxAge > 0 {
+		return p.MaxAge
+	}
+	return time.Hour
+}
+
+func (p *MTUProber) maxPaths() int {
+	if p.MaxPaths > 0 {
+		return p.MaxPaths
+	}
+	return 4096
+}
+
+func (p *MTUProber) clock() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+// lookup returns the live state for ip, dropping it once expired,
+// called with p.mu held
+func (p *MTUProber) lookup(ip net.IP) (*mtuSearch, bool) {
+	key := ip.String()
+	s, ok := p.paths[key]
+	if ok && p.clock().Sub(s.updated) > p.maxAge() {
+		delete(p.paths, key)
+		return nil, false
+	}
+	return s, ok
+}
+
+// search returns the state for ip, creating it if needed, and marks it
+// updated. Called with p.mu held.
+func (p *MTUProber) search(ip net.IP) *mtuSearch {
+	if p.paths == nil {
+		p.paths = make(map[string]*mtuSearch)
+	}
+	s, ok := p.lookup(ip)
+	if !ok {
+		p.makeRoom()
+		s = &mtuSearch{lo: p.minMSS()}
+		p.paths[ip.String()] = s
+	}
+	s.updated = p.clock()
+	return s
+}
+
+// makeRoom drops expired searches when the table is full, then the
+// least recently updated one if that was not enough. Called with p.mu
+// held.
+func (p *MTUProber) makeRoom() {
+	if len(p.paths) < p.maxPaths() {
+		return
+	}
+	now := p.clock()
+	var oldest string
+	for key, s := range p.paths {
+		if now.Sub(s.updated) > p.maxAge() {
+			delete(p.paths, key)
+		} else if oldest == "" || s.updated.Before(p.paths[oldest].updated) {
+			oldest = key
+		}
+	}
+	if len(p.paths) >= p.maxPaths() {
+		delete(p.paths, oldest)
+	}
+}
+
+// next returns the size to try, called with p.mu held
+func (p *MTUProber) next(s *mtuSearch) int {
+	if s.hi == 0 {
+		return 0
+	}
+	if s.hi-s.lo <= p.precision() {
+		return s.lo
+	}
+	return (s.lo + s.hi + 1) / 2
+}
+
+// MSS returns the size to start a connection to ip with, zero when no
+// blackhole was seen on the path
+func (p *MTUProber) MSS(ip net.IP) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.lookup(ip)
+	if !ok {
+		return 0
+	}
+	return p.next(s)
+}
+
+// Blackhole records that segments of mss bytes did not get through to
+// ip and returns the size to try next
+func (p *MTUProber) Blackhole(ip net.IP, mss int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.search(ip)
+	if mss <= s.lo {
+		// The size that worked failed, start over from the floor
+		s.lo = p.minMSS()
+	}
+	s.hi = mss - 1
+	if s.hi < s.lo {
+		s.hi = s.lo
+	}
+	return p.next(s)
+}
+
+// PathMTU records the MSS the kernel derived from an ICMP message
+func (p *MTUProber) PathMTU(ip net.IP, mss int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.search(ip)
+	if s.hi == 0 || mss < s.hi {
+		s.hi = mss
+	}
+	if s.lo > s.hi {
+		s.lo = s.hi
+	}
+}
+
+// Delivered records that a session to ip delivered data in segments of
+// mss bytes
+func (p *MTUProber) Delivered(ip net.IP, mss int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.lookup(ip)
+	if !ok {
+		return
+	}
+	s.updated = p.clock()
+	if mss > s.lo {
+		s.lo = mss
+	}
+	if s.hi != 0 && s.lo > s.hi {
+		s.hi = s.lo
+	}
+}
+
+// control returns a net.Dialer Control function starting connections
+// at the size being probed for the address dialed
+func (p *MTUProber) control() func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil
+		}
+		if mss := p.MSS(ip); mss > 0 {
+			c.Control(func(fd uintptr) { setPathOptions(fd, mss, "") })
+		}
+		return nil
+	}
+}
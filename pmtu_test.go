@@ -0,0 +1,229 @@
+package socks5
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kennnnny/RRDproxy/sampler"
+	"github.com/mikioh/tcp"
+)
+
+func TestClassifyPath(t *testing.T) {
+	prev := &sampler.Sample{PathMTU: 1500}
+	cases := []struct {
+		cur  *sampler.Sample
+		d    *sampler.Delta
+		want pathVerdict
+	}{
+		{&sampler.Sample{PathMTU: 1500}, &sampler.Delta{BytesAcked: 1000}, pathOK},
+		{&sampler.Sample{PathMTU: 1500}, nil, pathOK},
+		{&sampler.Sample{PathMTU: 1500, Backoffs: 0, UnackedSegs: 10}, &sampler.Delta{RetransSegs: 3, BytesAcked: 50000}, pathCongestion},
+		{&sampler.Sample{PathMTU: 1500, Backoffs: 2, UnackedSegs: 10}, &sampler.Delta{RetransSegs: 3, BytesAcked: 50000}, pathCongestion},
+		{&sampler.Sample{PathMTU: 1500, SenderMSS: 1448, Backoffs: 2, UnackedSegs: 10, LastAckReceived: 200 * time.Millisecond}, &sampler.Delta{Interval: time.Second, RetransSegs: 3}, pathBlackhole},
+		// Nothing heard from the peer, it went away
+		{&sampler.Sample{PathMTU: 1500, SenderMSS: 1448, Backoffs: 2, UnackedSegs: 10, LastAckReceived: 5 * time.Second}, &sampler.Delta{Interval: time.Second, RetransSegs: 3}, pathStalled},
+		// Segments this small fit any path
+		{&sampler.Sample{PathMTU: 1500, SenderMSS: 536, Backoffs: 2, UnackedSegs: 10, LastAckReceived: 200 * time.Millisecond}, &sampler.Delta{Interval: time.Second, RetransSegs: 3}, pathStalled},
+		{&sampler.Sample{PathMTU: 1400, Backoffs: 2, UnackedSegs: 10}, &sampler.Delta{RetransSegs: 3}, pathMTUChanged},
+	}
+	for i, c := range cases {
+		if got := classifyPath(prev, c.cur, c.d); got != c.want {
+			t.Fatalf("case %d: got %v, want %v", i, got, c.want)
+		}
+	}
+}
+
+func TestMTUProber_Search(t *testing.T) {
+	p := &MTUProber{}
+	ip := net.ParseIP("192.0.2.1")
+	if mss := p.MSS(ip); mss != 0 {
+		t.Fatalf("probing a path without blackholes: %d", mss)
+	}
+	p.Delivered(ip, 1448)
+	if mss := p.MSS(ip); mss != 0 {
+		t.Fatalf("probing a path without blackholes: %d", mss)
+	}
+
+	// Segments above 1200 bytes vanish on this path
+	const limit = 1200
+	mss := p.Blackhole(ip, 1448)
+	for i := 0; i < 20; i++ {
+		if mss > limit {
+			mss = p.Blackhole(ip, mss)
+		} else {
+			p.Delivered(ip, mss)
+			mss = p.MSS(ip)
+		}
+	}
+	if mss > limit || mss < limit-p.precision() {
+		t.Fatalf("search settled at %d", mss)
+	}
+	if p.MSS(ip) != mss {
+		t.Fatalf("MSS does not return the settled size")
+	}
+
+	// An ICMP message lowers the upper bound directly
+	other := net.ParseIP("192.0.2.2")
+	p.PathMTU(other, 1000)
+	if mss := p.MSS(other); mss < 536 || mss > 1000 {
+		t.Fatalf("bad size after path MTU change: %d", mss)
+	}
+}
+
+func TestMTUProber_Expiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	p := &MTUProber{MaxPaths: 2, now: func() time.Time { return now }}
+	a, b, c := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")
+	p.Blackhole(a, 1448)
+	now = now.Add(time.Minute)
+	p.Blackhole(b, 1448)
+
+	// A full table makes room by dropping the stalest destination
+	p.Blackhole(c, 1448)
+	if len(p.paths) != 2 || p.MSS(a) != 0 || p.MSS(b) == 0 || p.MSS(c) == 0 {
+		t.Fatalf("bad paths after eviction: %v", p.paths)
+	}
+
+	// Searches not updated for MaxAge start over
+	now = now.Add(2 * time.Hour)
+	if mss := p.MSS(b); mss != 0 {
+		t.Fatalf("expired search still probing at %d", mss)
+	}
+}
+
+func TestMTUProber_Dial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	p := &MTUProber{}
+	p.Blackhole(net.ParseIP("127.0.0.1"), 1448)
+	want := p.MSS(net.ParseIP("127.0.0.1"))
+
+	d := net.Dialer{Control: p.control()}
+	conn, err := d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	raw, _ := conn.(*net.TCPConn).SyscallConn()
+	var mss int
+	raw.Control(func(fd uintptr) {
+		mss, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG)
+	})
+	if mss == 0 || mss > want {
+		t.Fatalf("connection not started at the probed size %d: %d", want, mss)
+	}
+}
+
+func TestMonitor_Blackhole(t *testing.T) {
+	var rules []string
+	runIptables = func(args ...string) error {
+		rules = append(rules, strings.Join(args, " "))
+		return nil
+	}
+	defer func() {
+		runIptables = defaultRunIptables
+		clamp = mssClamp{}
+	}()
+	if err := clamp.ensure(1400); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	rules = nil
+
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer s.Close()
+	tc, err := tcp.NewConn(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	prober := &MTUProber{}
+	serv := &Server{config: &Config{
+		MTUProber:     prober,
+		MonitorSample: func(LegSample) {},
+		Logger:        log.New(ioutil.Discard, "", 0),
+		MSS:           1400,
+		RetransmitMSS: 200,
+	}}
+	lm := &legMonitor{s: serv, tc: tc, leg: LegUpstream}
+	stall := func(lm *legMonitor) {
+		lm.sample(&sampler.Sample{SenderMSS: 1448, PathMTU: 1500, UnackedSegs: 5, Backoffs: 3, LastAckReceived: 100 * time.Millisecond}, &sampler.Delta{Interval: time.Second, RetransSegs: 4})
+	}
+	healthy := func(lm *legMonitor) {
+		lm.sample(&sampler.Sample{SenderMSS: 1448, PathMTU: 1500}, &sampler.Delta{BytesAcked: 9000})
+	}
+
+	// Congestion loss leaves the MSS alone
+	healthy(lm)
+	lm.sample(&sampler.Sample{SenderMSS: 1448, PathMTU: 1500, UnackedSegs: 5}, &sampler.Delta{RetransSegs: 2, BytesAcked: 9000})
+	if lm.blackholed || prober.MSS(net.ParseIP("127.0.0.1")) != 0 || len(rules) != 0 {
+		t.Fatalf("congestion taken for a blackhole: %v", rules)
+	}
+
+	// A stall with backoff starts the search for the destination and
+	// leaves the host's clamp alone
+	stall(lm)
+	stall(lm)
+	if !lm.blackholed {
+		t.Fatalf("blackhole not detected")
+	}
+	mss := prober.MSS(net.ParseIP("127.0.0.1"))
+	if mss == 0 || mss >= 1448 {
+		t.Fatalf("bad probe size: %d", mss)
+	}
+	if len(rules) != 0 {
+		t.Fatalf("clamp moved for one destination: %v", rules)
+	}
+	healthy(lm)
+	if lm.blackholed {
+		t.Fatalf("recovery not detected")
+	}
+
+	// Client legs hold the clamp at RetransmitMSS and stay out of the
+	// prober. It goes back up once the last of them recovers.
+	prober = &MTUProber{}
+	serv.config.MTUProber = prober
+	client := &legMonitor{s: serv, tc: tc, leg: LegClient}
+	other := &legMonitor{s: serv, tc: tc, leg: LegClient}
+	stall(client)
+	stall(other)
+	if len(prober.paths) != 0 {
+		t.Fatalf("client address probed: %v", prober.paths)
+	}
+	if len(rules) != 1 || !strings.HasSuffix(rules[0], "--set-mss 200") {
+		t.Fatalf("bad clamp rules: %v", rules)
+	}
+	healthy(client)
+	healthy(client)
+	if len(rules) != 1 {
+		t.Fatalf("clamp restored while a leg still stalls: %v", rules)
+	}
+	healthy(other)
+	if len(rules) != 2 || !strings.HasSuffix(rules[1], "--set-mss 1400") {
+		t.Fatalf("clamp not restored: %v", rules)
+	}
+
+	// DisableMSSClamp leaves the rule alone
+	serv.config.DisableMSSClamp = true
+	stall(client)
+	if len(rules) != 2 {
+		t.Fatalf("clamp moved while disabled: %v", rules)
+	}
+}
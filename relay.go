@@ -0,0 +1,118 @@
+package socks5
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/mikioh/tcp"
+)
+
+// relayBufferSize is the size of the pooled buffers used when the
+// sockets cannot be spliced
+const relayBufferSize = 32 * 1024
+
+var relayBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, relayBufferSize)
+		return &b
+	},
+}
+
+// tcpConnOf looks through the wrappers used by the server and returns
+// the TCP socket underneath c. Wrappers that transform the stream, such
+// as TLS, are not looked through.
+func tcpConnOf(c interface{}) (*net.TCPConn, bool) {
+	for {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			return v, true
+		case *tcp.Conn:
+			c = v.Conn
+		case *poolConn:
+			c = v.Conn
+		default:
+			return nil, false
+		}
+	}
+}
+
+// unbuffered writes the bytes the handshake reader has already read
+// ahead to w, and returns a reader for the rest of the client stream
+// that reads from the connection directly
+func unbuffered(w io.Writer, conn conn, r io.Reader, touch func()) (io.Reader, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		return r, nil
+	}
+	nc, ok := conn.(net.Conn)
+	if !ok {
+		return r, nil
+	}
+	if n := br.Buffered(); n > 0 {
+		b, _ := br.Peek(n)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		br.Discard(n)
+		touch()
+	}
+	return nc, nil
+}
+
+// relay copies from src to dst until EOF or an error, calling touch
+// after every chunk. TCP sockets are spliced where the platform allows
+// it, everything else goes through a pooled buffer.
+func relay(dst io.Writer, src io.Reader, touch func()) (int64, error) {
+	if d, ok := tcpConnOf(dst); ok {
+		if s, ok := tcpConnOf(src); ok {
+			if n, handled, err := spliceRelay(d, s, touch); handled {
+				return n, err
+			}
+		}
+	}
+	return copyRelay(dst, src, touch)
+}
+
+// relayError records whether a relay failed reading its source or
+// writing its destination
+type relayError struct {
+	Op  string
+	Err error
+}
+
+func (e *relayError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *relayError) Unwrap() error {
+	return e.Err
+}
+
+// copyRelay is io.Copy with a pooled buffer that reports activity
+func copyRelay(dst io.Writer, src io.Reader, touch func()) (written int64, err error) {
+	bp := relayBuffers.Get().(*[]byte)
+	defer relayBuffers.Put(bp)
+	buf := *bp
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			touch()
+			nw, werr := dst.Write(buf[:nr])
+			written += int64(nw)
+			if werr != nil {
+				return written, &relayError{"write", werr}
+			}
+			if nw != nr {
+				return written, &relayError{"write", io.ErrShortWrite}
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, &relayError{"read", rerr}
+		}
+	}
+}
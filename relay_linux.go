@@ -0,0 +1,74 @@
+package socks5
+
+import (
+	"net"
+	"syscall"
+)
+
+const (
+	spliceMove     = 0x1
+	spliceNonblock = 0x2
+
+	// maxSpliceSize is the most moved through the pipe in one go
+	maxSpliceSize = 1 << 20
+)
+
+// spliceRelay moves data from src to dst through a pipe with splice(2)
+// so it never enters user space, which takes about half the CPU time of
+// copying, see BenchmarkRelay_Splice. TCPConn.ReadFrom splices as well
+// but blocks until EOF, leaving nothing to report activity to the idle
+// timer, and does not say which side failed. handled is false when
+// nothing was moved and the caller should fall back to copying.
+func spliceRelay(dst, src *net.TCPConn, touch func()) (written int64, handled bool, err error) {
+	rc, err := src.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	wc, err := dst.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return 0, false, nil
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	for {
+		// Fill the pipe from the source, waiting for it to be readable
+		var n int64
+		var serr error
+		err = rc.Read(func(fd uintptr) bool {
+			n, serr = syscall.Splice(int(fd), nil, p[1], nil, maxSpliceSize, spliceMove|spliceNonblock)
+			return serr != syscall.EAGAIN && serr != syscall.EINTR
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			return written, true, &relayError{"read", err}
+		}
+		if n == 0 {
+			return written, true, nil
+		}
+		touch()
+
+		// Drain the pipe into the destination
+		for n > 0 {
+			var m int64
+			err = wc.Write(func(fd uintptr) bool {
+				m, serr = syscall.Splice(p[0], nil, int(fd), nil, int(n), spliceMove|spliceNonblock)
+				return serr != syscall.EAGAIN && serr != syscall.EINTR
+			})
+			if err == nil {
+				err = serr
+			}
+			if err != nil {
+				return written, true, &relayError{"write", err}
+			}
+			n -= m
+			written += m
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package socks5
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// benchmarkRelay reports the CPU time the relaying thread spent per
+// megabyte besides the throughput, the point of splicing being the
+// copies it saves rather than speed over loopback
+func benchmarkRelay(b *testing.B, fn func(dst, src *net.TCPConn) (int64, error)) {
+	payload := relayPayload(16 << 20)
+	b.SetBytes(int64(len(payload)))
+	var cpu time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		relayPipe(b, payload, func(dst, src *net.TCPConn) (int64, error) {
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			start := threadCPUTime(b)
+			defer func() { cpu += threadCPUTime(b) - start }()
+			return fn(dst, src)
+		})
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(cpu)/(float64(b.N)*float64(len(payload))/(1<<20)), "cpu-ns/MB")
+}
+
+// threadCPUTime returns the user and system time the calling thread
+// used so far
+func threadCPUTime(b *testing.B) time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_THREAD, &ru); err != nil {
+		b.Fatalf("err: %v", err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func BenchmarkRelay_Splice(b *testing.B) {
+	benchmarkRelay(b, func(dst, src *net.TCPConn) (int64, error) {
+		return relay(dst, src, func() {})
+	})
+}
+
+// BenchmarkRelay_ReadFrom is the standard library's splice, which
+// cannot report activity to the idle timer
+func BenchmarkRelay_ReadFrom(b *testing.B) {
+	benchmarkRelay(b, func(dst, src *net.TCPConn) (int64, error) {
+		return dst.ReadFrom(src)
+	})
+}
+
+func BenchmarkRelay_Copy(b *testing.B) {
+	benchmarkRelay(b, func(dst, src *net.TCPConn) (int64, error) {
+		return copyRelay(dst, src, func() {})
+	})
+}
+
+func BenchmarkRelay_Bufio(b *testing.B) {
+	benchmarkRelay(b, func(dst, src *net.TCPConn) (int64, error) {
+		return io.Copy(struct{ io.Writer }{dst}, bufio.NewReader(src))
+	})
+}
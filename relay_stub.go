@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import "net"
+
+// spliceRelay is only available on Linux
+func spliceRelay(dst, src *net.TCPConn, touch func()) (int64, bool, error) {
+	return 0, false, nil
+}
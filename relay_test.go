@@ -0,0 +1,137 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatalf("accept failed")
+	}
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+// relayPipe relays src into dst with fn and returns what reached the
+// far end of dst
+func relayPipe(t testing.TB, payload []byte, fn func(dst, src *net.TCPConn) (int64, error)) []byte {
+	srcW, srcR := tcpPair(t)
+	dstW, dstR := tcpPair(t)
+	defer srcR.Close()
+	defer dstW.Close()
+
+	go func() {
+		srcW.Write(payload)
+		srcW.Close()
+	}()
+	done := make(chan []byte)
+	go func() {
+		out, _ := ioutil.ReadAll(dstR)
+		dstR.Close()
+		done <- out
+	}()
+	n, err := fn(dstW, srcR)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != int64(len(payload)) {
+		t.Fatalf("relayed %d of %d bytes", n, len(payload))
+	}
+	dstW.CloseWrite()
+	return <-done
+}
+
+func relayPayload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func TestRelay_Splice(t *testing.T) {
+	payload := relayPayload(4 << 20)
+	touches := 0
+	out := relayPipe(t, payload, func(dst, src *net.TCPConn) (int64, error) {
+		return relay(dst, src, func() { touches++ })
+	})
+	if !bytes.Equal(out, payload) {
+		t.Fatalf("payload mismatch: got %d bytes", len(out))
+	}
+	if touches == 0 {
+		t.Fatalf("activity was not reported")
+	}
+}
+
+func TestRelay_Copy(t *testing.T) {
+	var dst bytes.Buffer
+	touches := 0
+	n, err := relay(&dst, bytes.NewReader([]byte("ping")), func() { touches++ })
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 4 || dst.String() != "ping" {
+		t.Fatalf("bad: %d %q", n, dst.String())
+	}
+	if touches != 1 {
+		t.Fatalf("bad touches: %d", touches)
+	}
+}
+
+func TestRelay_UnwrapsConn(t *testing.T) {
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer s.Close()
+
+	if got, ok := tcpConnOf(&poolConn{Conn: c}); !ok || got != c {
+		t.Fatalf("pool connection not unwrapped")
+	}
+	if _, ok := tcpConnOf(&bufferedConn{Conn: c}); ok {
+		t.Fatalf("buffered connection must not be bypassed")
+	}
+}
+
+func TestUnbuffered_FlushesReadAhead(t *testing.T) {
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer s.Close()
+
+	c.Write([]byte("\x05\x01\x00hello"))
+	br := bufio.NewReader(s)
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(br, head); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var out bytes.Buffer
+	r, err := unbuffered(&out, s, br, func() {})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.String() != "hello" {
+		t.Fatalf("bad flush: %q", out.String())
+	}
+	if r != net.Conn(s) {
+		t.Fatalf("expected the raw connection")
+	}
+}
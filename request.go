@@ -6,7 +6,8 @@ import (
 	"io"
 	"net"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -32,9 +33,16 @@ const (
 
 var (
 	unrecognizedAddrType = fmt.Errorf("Unrecognized address type")
+
+	HandshakeTimeoutExceeded = fmt.Errorf("Handshake timeout exceeded")
+	IdleTimeoutExceeded      = fmt.Errorf("Idle timeout exceeded")
+	SessionLifetimeExceeded  = fmt.Errorf("Maximum session lifetime exceeded")
+	LingerTimeoutExceeded    = fmt.Errorf("Linger timeout exceeded")
 )
 
-// AddressRewriter is used to rewrite a destination transparently
+// AddressRewriter is used to rewrite a destination transparently. It
+// sees a requested name before it is resolved and, when it leaves it
+// alone, once more with the addresses resolved.
 type AddressRewriter interface {
 	Rewrite(ctx context.Context, request *Request) (context.Context, *AddrSpec)
 }
@@ -77,7 +85,11 @@ type Request struct {
 	DestAddr *AddrSpec
 	// AddrSpec of the actual destination (might be affected by rewrite)
 	realDestAddr *AddrSpec
-	bufConn      io.Reader
+	// All resolved addresses of realDestAddr in dialing order
+	destIPs []net.IP
+	// Set for redirected connections, which get no SOCKS replies
+	transparent bool
+	bufConn     io.Reader
 }
 
 type conn interface {
@@ -117,26 +129,15 @@ func NewRequest(bufConn io.Reader) (*Request, error) {
 // handleRequest is used for request processing after authentication
 func (s *Server) handleRequest(req *Request, conn conn) error {
 	ctx := context.Background()
-
-	// Resolve the address if we have a FQDN
-	dest := req.DestAddr
-	if dest.FQDN != "" {
-		cctx, addr, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
-		if err != nil {
-			if err := sendReply(conn, hostUnreachable, nil); err != nil {
-				return fmt.Errorf("Failed to send reply: %v", err)
-			}
-			return fmt.Errorf("Failed to resolve destination '%v': %v", dest.FQDN, err)
-		}
-		ctx = cctx
-		dest.IP = addr
+	if s.listener != "" {
+		ctx = context.WithValue(ctx, listenerKey{}, s.listener)
 	}
 
-	// Apply any address rewrites
+	// Rewrite before resolving, so that a name only a rule knows needs
+	// no DNS. Names are resolved once the rules picked the dialer, see
+	// resolveForDial.
 	req.realDestAddr = req.DestAddr
-	if s.config.Rewriter != nil {
-		ctx, req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
-	}
+	ctx, _ = s.rewrite(ctx, req)
 
 	// Switch on the command
 	switch req.Command {
@@ -147,85 +148,235 @@ func (s *Server) handleRequest(req *Request, conn conn) error {
 	case AssociateCommand:
 		return s.handleAssociate(ctx, conn, req)
 	default:
-		if err := sendReply(conn, commandNotSupported, nil); err != nil {
+		if err := replyTo(conn, req, commandNotSupported, nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
 		return fmt.Errorf("Unsupported command: %v", req.Command)
 	}
 }
 
+// rewrite applies the Rewriter to req, reporting whether it picked
+// another destination
+func (s *Server) rewrite(ctx context.Context, req *Request) (context.Context, bool) {
+	if s.config.Rewriter == nil {
+		return ctx, false
+	}
+	ctx, to := s.config.Rewriter.Rewrite(ctx, req)
+	if to == nil || to == req.DestAddr {
+		return ctx, false
+	}
+	req.realDestAddr = to
+	return ctx, true
+}
+
+// resolveForDial resolves the name of the destination to dial unless d
+// resolves it remotely
+func (s *Server) resolveForDial(ctx context.Context, d Dialer, req *Request) (context.Context, error) {
+	real := req.realDestAddr
+	if real.IP != nil || real.FQDN == "" || resolvesRemotely(ctx, d, real) {
+		return ctx, nil
+	}
+	rewritten := real != req.DestAddr
+	ctx, err := s.resolveRealDest(ctx, req)
+	if err != nil || rewritten {
+		return ctx, err
+	}
+
+	// Rewrite rules matching networks get a second chance once the
+	// address is known. A name they rewrite to goes through the same
+	// resolver, an address replaces those of the name.
+	if ctx, rewritten = s.rewrite(ctx, req); !rewritten {
+		return ctx, nil
+	}
+	switch real := req.realDestAddr; {
+	case real.IP == nil && real.FQDN != "":
+		if resolvesRemotely(ctx, d, real) {
+			req.destIPs = nil
+			return ctx, nil
+		}
+		return s.resolveRealDest(ctx, req)
+	case !real.IP.Equal(req.DestAddr.IP):
+		req.destIPs = nil
+	}
+	return ctx, nil
+}
+
+// resolveDest resolves name through the configured resolver, returning
+// its addresses in dialing order
+func (s *Server) resolveDest(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	cctx, addrs, err := AsMultiResolver(s.config.Resolver).ResolveAll(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	if addrs = orderAddrs(addrs, s.config.IPPreference); len(addrs) == 0 {
+		return ctx, nil, noSuitableAddress
+	}
+	return cctx, addrs, nil
+}
+
+// resolveRealDest resolves the name of the destination to dial, which
+// is copied as it may be a rewrite target shared with other requests
+func (s *Server) resolveRealDest(ctx context.Context, req *Request) (context.Context, error) {
+	real := req.realDestAddr
+	cctx, addrs, err := s.resolveDest(ctx, real.FQDN)
+	if err != nil {
+		return ctx, err
+	}
+	resolved := *real
+	resolved.IP = addrs[0]
+	if real == req.DestAddr {
+		req.DestAddr = &resolved
+	}
+	req.realDestAddr, req.destIPs = &resolved, addrs
+	return cctx, nil
+}
+
+// dialer returns what connects to destinations: Config.Dialer, Dial or
+// a net.Dialer running the Control functions handed over in ctx
+func (s *Server) dialer() Dialer {
+	switch {
+	case s.config.Dialer != nil:
+		return s.config.Dialer
+	case s.config.Dial != nil:
+		return DialerFunc(s.config.Dial)
+	}
+	return DialerFunc(func(ctx context.Context, net_, addr string) (net.Conn, error) {
+		d := net.Dialer{Control: chainControl(ctx, nil)}
+		return d.DialContext(ctx, net_, addr)
+	})
+}
+
+// failResolve replies to a request whose destination did not resolve
+func (s *Server) failResolve(conn conn, req *Request, err error) error {
+	category := s.classify(err)
+	if category == CategoryUnknown {
+		category = CategoryResolve
+	}
+	if req.realDestAddr != req.DestAddr {
+		return s.failRequest(conn, req, category, fmt.Errorf("Failed to resolve destination '%v' (rewritten to '%v'): %v", req.DestAddr.FQDN, req.realDestAddr.FQDN, err))
+	}
+	return s.failRequest(conn, req, category, fmt.Errorf("Failed to resolve destination '%v': %v", req.DestAddr.FQDN, err))
+}
+
 // handleConnect is used to handle a connect command
 func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
 	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
-			return fmt.Errorf("Failed to send reply: %v", err)
-		}
-		return fmt.Errorf("Connect to %v blocked by rules", req.DestAddr)
+		return s.failRequest(conn, req, CategoryRuleDenied, fmt.Errorf("Connect to %v blocked by rules", req.DestAddr))
 	} else {
 		ctx = ctx_
 	}
 
-	// Attempt to connect
-	dial := s.config.Dial
-	if dial == nil {
-		dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
-			return net.Dial(net_, addr)
-		}
+	// Resolve the destination unless the dialer the rules picked hands
+	// the name to an upstream proxy
+	dialer := s.dialer()
+	ctx, err := s.resolveForDial(ctx, dialer, req)
+	if err != nil {
+		return s.failResolve(conn, req, err)
+	}
+
+	// Attempt to connect, dialers may look up the request and start
+	// from what earlier sessions learned about the path
+	ctx = context.WithValue(ctx, requestKey{}, req)
+	if s.config.PathProfiles != nil {
+		ctx = withDialControl(ctx, s.config.PathProfiles.control())
+	}
+	if s.config.MTUProber != nil {
+		ctx = withDialControl(ctx, s.config.MTUProber.control())
 	}
-	target, err := dial(ctx, "tcp", req.realDestAddr.Address())
+	dialCtx := ctx
+	if s.config.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, s.config.DialTimeout)
+		defer cancel()
+	}
+	target, err := s.dialDest(dialCtx, dialer, req)
 	if err != nil {
-		msg := err.Error()
-		resp := hostUnreachable
-		if strings.Contains(msg, "refused") {
-			resp = connectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			resp = networkUnreachable
+		category := s.classify(err)
+		if dialCtx.Err() == context.DeadlineExceeded {
+			category = CategoryTimeout
 		}
-		if err := sendReply(conn, resp, nil); err != nil {
-			return fmt.Errorf("Failed to send reply: %v", err)
+		if req.realDestAddr != req.DestAddr {
+			err = fmt.Errorf("Connect to %v (rewritten to %v) failed: %v", req.DestAddr, req.realDestAddr, err)
+		} else {
+			err = fmt.Errorf("Connect to %v failed: %v", req.DestAddr, err)
 		}
-		return fmt.Errorf("Connect to %v failed: %v", req.DestAddr, err)
+		return s.failRequest(conn, req, category, err)
 	}
 	defer target.Close()
+	if req.realDestAddr != req.DestAddr {
+		s.config.Logger.Printf("[INFO] socks: %v connected to %v, rewritten to %v", conn.RemoteAddr(), req.DestAddr, req.realDestAddr)
+	}
+	s.applyTuning(ctx, req, conn, target)
+	s.applyCongestion(ctx, conn, target)
 
 	// Send success
 	local := target.LocalAddr().(*net.TCPAddr)
 	bind := AddrSpec{IP: local.IP, Port: local.Port}
-	if err := sendReply(conn, successReply, &bind); err != nil {
+	if err := replyTo(conn, req, successReply, &bind); err != nil {
 		return fmt.Errorf("Failed to send reply: %v", err)
 	}
 
-	// Start proxying
-	errCh := make(chan error, 2)
-	go proxy(target, req.bufConn, errCh)
-	go proxy(conn, target, errCh)
+	// Sample both legs until the session ends, before they are closed
+	mon := s.startMonitors(req, conn, target)
+	defer mon.stop()
 
-	// Wait
-	for i := 0; i < 2; i++ {
-		e := <-errCh
-		if e != nil {
-			// return from this function closes target (and conn).
-			return e
+	// Arm the idle and lifetime limits, either one closes both sides
+	timers := newSessionTimers(s.config.IdleTimeout, s.config.MaxSessionLifetime, func() {
+		target.Close()
+		if c, ok := conn.(io.Closer); ok {
+			c.Close()
 		}
+	})
+	defer timers.stop()
+
+	// Flush what the handshake read ahead, then relay straight off the socket
+	client, err := unbuffered(target, conn, req.bufConn, timers.touch)
+	if err != nil {
+		return fmt.Errorf("Failed to forward buffered data: %v", err)
 	}
-	return nil
+
+	// Relay both directions until each one has finished
+	res := s.relaySession(conn, target, client, timers)
+	if s.config.SessionClosed != nil {
+		s.config.SessionClosed(req, res)
+	}
+	if reason := timers.reason(); reason != nil {
+		return reason
+	}
+	return res.err()
+}
+
+// dialDest connects to the real destination. All addresses of a
+// resolved name are raced, a name left unresolved is handed to the
+// upstream proxy to connect to.
+func (s *Server) dialDest(ctx context.Context, d Dialer, req *Request) (net.Conn, error) {
+	dest := req.realDestAddr
+	if dest.IP == nil && dest.FQDN != "" {
+		return d.DialContext(ctx, "tcp", net.JoinHostPort(dest.FQDN, strconv.Itoa(dest.Port)))
+	}
+	if len(req.destIPs) < 2 {
+		return d.DialContext(ctx, "tcp", dest.Address())
+	}
+	h := &HappyEyeballsDialer{
+		Dial:          d.DialContext,
+		Preference:    s.config.IPPreference,
+		FallbackDelay: s.config.FallbackDelay,
+	}
+	return h.DialAddrs(ctx, "tcp", req.destIPs, dest.Port)
 }
 
 // handleBind is used to handle a connect command
 func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
 	if cctx, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
-			return fmt.Errorf("Failed to send reply: %v", err)
-		}
-		return fmt.Errorf("Bind to %v blocked by rules", req.DestAddr)
+		return s.failRequest(conn, req, CategoryRuleDenied, fmt.Errorf("Bind to %v blocked by rules", req.DestAddr))
 	} else {
 		ctx = cctx
 	}
 
 	// TODO: Support bind
-	if err := sendReply(conn, commandNotSupported, nil); err != nil {
+	if err := replyTo(conn, req, commandNotSupported, nil); err != nil {
 		return fmt.Errorf("Failed to send reply: %v", err)
 	}
 	return nil
@@ -235,16 +386,13 @@ func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error
 func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
 	if cctx, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
-			return fmt.Errorf("Failed to send reply: %v", err)
-		}
-		return fmt.Errorf("Associate to %v blocked by rules", req.DestAddr)
+		return s.failRequest(conn, req, CategoryRuleDenied, fmt.Errorf("Associate to %v blocked by rules", req.DestAddr))
 	} else {
 		ctx = cctx
 	}
 
 	// TODO: Support associate
-	if err := sendReply(conn, commandNotSupported, nil); err != nil {
+	if err := replyTo(conn, req, commandNotSupported, nil); err != nil {
 		return fmt.Errorf("Failed to send reply: %v", err)
 	}
 	return nil
@@ -302,6 +450,15 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 	return d, nil
 }
 
+// replyTo sends a reply unless the request was synthesized for a
+// transparently redirected client that does not speak SOCKS
+func replyTo(conn conn, req *Request, resp uint8, addr *AddrSpec) error {
+	if req.transparent {
+		return nil
+	}
+	return sendReply(conn, resp, addr)
+}
+
 // sendReply is used to send a reply message
 func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
 	// Format the address
@@ -352,12 +509,77 @@ type closeWriter interface {
 	CloseWrite() error
 }
 
-// proxy is used to suffle data from src to destination, and sends errors
-// down a dedicated channel
-func proxy(dst io.Writer, src io.Reader, errCh chan error) {
-	_, err := io.Copy(dst, src)
-	if tcpConn, ok := dst.(closeWriter); ok {
-		tcpConn.CloseWrite()
+// sessionTimers enforces the idle timeout and maximum lifetime of a
+// relayed session by invoking closeFn when either one expires
+type sessionTimers struct {
+	idleTimeout time.Duration
+	idle        *time.Timer
+	lifetime    *time.Timer
+	lingerTimer *time.Timer
+	closeFn     func()
+
+	mu    sync.Mutex
+	cause error
+}
+
+func newSessionTimers(idleTimeout, lifetime time.Duration, closeFn func()) *sessionTimers {
+	t := &sessionTimers{idleTimeout: idleTimeout, closeFn: closeFn}
+	if idleTimeout > 0 {
+		t.idle = time.AfterFunc(idleTimeout, func() { t.expire(IdleTimeoutExceeded) })
+	}
+	if lifetime > 0 {
+		t.lifetime = time.AfterFunc(lifetime, func() { t.expire(SessionLifetimeExceeded) })
+	}
+	return t
+}
+
+// expire records the first close reason and tears the session down
+func (t *sessionTimers) expire(cause error) {
+	t.mu.Lock()
+	if t.cause == nil {
+		t.cause = cause
+	}
+	t.mu.Unlock()
+	t.closeFn()
+}
+
+// reason returns why the session was closed, or nil if no limit fired
+func (t *sessionTimers) reason() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cause
+}
+
+// touch postpones the idle timeout after traffic was seen
+func (t *sessionTimers) touch() {
+	if t.idle != nil {
+		t.idle.Reset(t.idleTimeout)
+	}
+}
+
+// linger closes the session after d unless it ends first. A zero d
+// leaves it to the other limits.
+func (t *sessionTimers) linger(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lingerTimer == nil {
+		t.lingerTimer = time.AfterFunc(d, func() { t.expire(LingerTimeoutExceeded) })
+	}
+}
+
+func (t *sessionTimers) stop() {
+	if t.idle != nil {
+		t.idle.Stop()
+	}
+	if t.lifetime != nil {
+		t.lifetime.Stop()
+	}
+	t.mu.Lock()
+	if t.lingerTimer != nil {
+		t.lingerTimer.Stop()
 	}
-	errCh <- err
+	t.mu.Unlock()
 }
@@ -2,13 +2,16 @@ package socks5
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 type MockConn struct {
@@ -167,3 +170,97 @@ func TestRequest_Connect_RuleFail(t *testing.T) {
 		t.Fatalf("bad: %v %v", out, expected)
 	}
 }
+
+func TestRequest_Connect_DialTimeout(t *testing.T) {
+	// Make server with a dialer that never completes
+	s := &Server{config: &Config{
+		Rules:       PermitAll(),
+		Resolver:    DNSResolver{},
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+		DialTimeout: 20 * time.Millisecond,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}}
+
+	// Create the connect request
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80})
+
+	// Handle the request
+	resp := &MockConn{}
+	req, err := NewRequest(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := s.handleRequest(req, resp); err == nil {
+		t.Fatalf("expected dial error")
+	}
+
+	// Verify response
+	out := resp.buf.Bytes()
+	expected := []byte{
+		5,
+		ttlExpired,
+		0,
+		1,
+		0, 0, 0, 0,
+		0, 0,
+	}
+
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("bad: %v %v", out, expected)
+	}
+}
+
+func TestRequest_Connect_IdleTimeout(t *testing.T) {
+	// Create a local listener that never sends anything
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	}()
+	lAddr := l.Addr().(*net.TCPAddr)
+
+	// Make server
+	s := &Server{config: &Config{
+		Rules:       PermitAll(),
+		Resolver:    DNSResolver{},
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+		IdleTimeout: 50 * time.Millisecond,
+	}}
+
+	// Create the connect request on a silent client connection
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.Copy(ioutil.Discard, client)
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte{5, 1, 0, 1, 127, 0, 0, 1})
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(lAddr.Port))
+	buf.Write(port)
+
+	req, err := NewRequest(io.MultiReader(buf, server))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	start := time.Now()
+	if err := s.handleRequest(req, server); err != IdleTimeoutExceeded {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("idle timeout took too long")
+	}
+}
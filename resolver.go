@@ -3,6 +3,7 @@ package socks5
 import (
 	"context"
 	"net"
+	"time"
 )
 
 // NameResolver is used to implement custom name resolution
@@ -10,13 +11,58 @@ type NameResolver interface {
 	Resolve(ctx context.Context, name string) (context.Context, net.IP, error)
 }
 
+// MultiResolver can be implemented by a NameResolver that is able to
+// return every address of a name rather than a single one
+type MultiResolver interface {
+	ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error)
+}
+
+// TTLResolver can be implemented by a NameResolver that knows how long
+// its answers stay valid. CachingResolver uses it to honor record TTLs.
+type TTLResolver interface {
+	ResolveTTL(ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error)
+}
+
+// AsMultiResolver returns r itself when it implements MultiResolver,
+// otherwise it adapts r to return its single answer as a list
+func AsMultiResolver(r NameResolver) MultiResolver {
+	if m, ok := r.(MultiResolver); ok {
+		return m
+	}
+	return singleAddrResolver{r}
+}
+
+type singleAddrResolver struct {
+	NameResolver
+}
+
+func (s singleAddrResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	ctx, ip, err := s.Resolve(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, []net.IP{ip}, nil
+}
+
 // DNSResolver uses the system DNS to resolve host names
 type DNSResolver struct{}
 
 func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
-	addr, err := net.ResolveIPAddr("ip", name)
+	ctx, ips, err := d.ResolveAll(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+func (d DNSResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
 	if err != nil {
 		return ctx, nil, err
 	}
-	return ctx, addr.IP, err
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ctx, ips, nil
 }
@@ -0,0 +1,231 @@
+package socks5
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheTTL         = time.Minute
+	defaultCacheNegativeTTL = 5 * time.Second
+	defaultCacheMaxEntries  = 4096
+)
+
+// CacheStats reports how a CachingResolver has been answering lookups
+type CacheStats struct {
+	Hits         uint64 // answered from a fresh entry
+	StaleHits    uint64 // answered from an expired entry while refreshing
+	NegativeHits uint64 // answered from a cached NXDOMAIN
+	Misses       uint64 // forwarded to the wrapped resolver
+	Evictions    uint64 // entries dropped to honor MaxEntries
+	Entries      int    // entries currently held
+}
+
+// CachingResolver is a NameResolver decorator that caches the answers of
+// another resolver. Record TTLs are honored when the wrapped resolver
+// implements TTLResolver, DefaultTTL is used otherwise. Names differing
+// only in case or a trailing dot share an entry. The route a
+// wrapped RoutingResolver took is cached along with the answer and
+// recorded in the context of every lookup it serves.
+type CachingResolver struct {
+	// Resolver answers cache misses. Defaults to DNSResolver.
+	Resolver NameResolver
+
+	// DefaultTTL is used for the answers of a Resolver that is not a
+	// TTLResolver. Answers of a TTLResolver with a zero TTL are not
+	// cached. Defaults to one minute.
+	DefaultTTL time.Duration
+
+	// NegativeTTL is how long a name that does not exist is remembered.
+	// Defaults to five seconds.
+	NegativeTTL time.Duration
+
+	// StaleTTL is how long past expiry an entry may still be served
+	// while it is refreshed in the background. Zero disables serving
+	// stale entries.
+	StaleTTL time.Duration
+
+	// MaxEntries bounds the cache size, the least recently used entry
+	// is evicted first. Defaults to 4096.
+	MaxEntries int
+
+	once       sync.Once
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	refreshing map[string]bool
+	stats      CacheStats
+	now        func() time.Time
+}
+
+type cacheEntry struct {
+	name    string
+	ips     []net.IP
+	err     error
+	expires time.Time
+
+	// route is the ResolverRoute of the lookup, if any
+	route  string
+	routed bool
+}
+
+// withRoute records the route of e in ctx
+func (e *cacheEntry) withRoute(ctx context.Context) context.Context {
+	if !e.routed {
+		return ctx
+	}
+	return context.WithValue(ctx, resolverRouteKey{}, e.route)
+}
+
+func (c *CachingResolver) init() {
+	c.once.Do(func() {
+		if c.Resolver == nil {
+			c.Resolver = DNSResolver{}
+		}
+		if c.DefaultTTL <= 0 {
+			c.DefaultTTL = defaultCacheTTL
+		}
+		if c.NegativeTTL <= 0 {
+			c.NegativeTTL = defaultCacheNegativeTTL
+		}
+		if c.MaxEntries <= 0 {
+			c.MaxEntries = defaultCacheMaxEntries
+		}
+		if c.now == nil {
+			c.now = time.Now
+		}
+		c.entries = make(map[string]*list.Element)
+		c.lru = list.New()
+		c.refreshing = make(map[string]bool)
+	})
+}
+
+func (c *CachingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ips, err := c.ResolveAll(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+func (c *CachingResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	c.init()
+
+	key := canonicalName(name)
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		now := c.now()
+		switch {
+		case now.Before(e.expires):
+			c.lru.MoveToFront(el)
+			if e.err != nil {
+				c.stats.NegativeHits++
+			} else {
+				c.stats.Hits++
+			}
+			ips, err := e.ips, e.err
+			c.mu.Unlock()
+			return e.withRoute(ctx), ips, err
+
+		case e.err == nil && now.Before(e.expires.Add(c.StaleTTL)):
+			c.lru.MoveToFront(el)
+			c.stats.StaleHits++
+			ips := e.ips
+			if !c.refreshing[key] {
+				c.refreshing[key] = true
+				go c.refresh(key)
+			}
+			c.mu.Unlock()
+			return e.withRoute(ctx), ips, nil
+		}
+	}
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	ctx, ips, ttl, err := c.lookup(ctx, name)
+	c.store(ctx, key, ips, ttl, err)
+	return ctx, ips, err
+}
+
+// Stats returns a snapshot of the cache counters
+func (c *CachingResolver) Stats() CacheStats {
+	c.init()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+// refresh re-resolves a stale entry in the background
+func (c *CachingResolver) refresh(name string) {
+	ctx, ips, ttl, err := c.lookup(context.Background(), name)
+	c.mu.Lock()
+	delete(c.refreshing, name)
+	c.mu.Unlock()
+
+	// Keep serving the stale answer if the refresh failed transiently
+	if err != nil && !isNotFound(err) {
+		return
+	}
+	c.store(ctx, name, ips, ttl, err)
+}
+
+// lookup asks the wrapped resolver, preferring TTL-aware answers. The
+// answers of other resolvers are valid for DefaultTTL.
+func (c *CachingResolver) lookup(ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error) {
+	if r, ok := c.Resolver.(TTLResolver); ok {
+		return r.ResolveTTL(ctx, name)
+	}
+	ctx, ips, err := AsMultiResolver(c.Resolver).ResolveAll(ctx, name)
+	return ctx, ips, c.DefaultTTL, err
+}
+
+// store records an answer and the route in ctx. Only positive answers
+// and NXDOMAIN are cached, other failures are retried on the next
+// lookup. An answer that must not be cached drops the entry it
+// refreshes.
+func (c *CachingResolver) store(ctx context.Context, name string, ips []net.IP, ttl time.Duration, err error) {
+	switch {
+	case err == nil && len(ips) > 0:
+	case isNotFound(err):
+		ttl = c.NegativeTTL
+	default:
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ttl <= 0 {
+		if el, ok := c.entries[name]; ok {
+			c.lru.Remove(el)
+			delete(c.entries, name)
+		}
+		return
+	}
+	e := &cacheEntry{name: name, ips: ips, err: err, expires: c.now().Add(ttl)}
+	e.route, e.routed = ResolverRoute(ctx)
+	if el, ok := c.entries[name]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[name] = c.lru.PushFront(e)
+	for c.lru.Len() > c.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).name)
+		c.stats.Evictions++
+	}
+}
+
+// isNotFound reports whether err says the name does not exist
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,255 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type countingResolver struct {
+	mu    sync.Mutex
+	calls int
+	ttl   time.Duration
+	ip    net.IP
+	err   error
+}
+
+func (r *countingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ips, _, err := r.ResolveTTL(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+func (r *countingResolver) ResolveTTL(ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	if r.err != nil {
+		return ctx, nil, r.ttl, r.err
+	}
+	return ctx, []net.IP{r.ip}, r.ttl, nil
+}
+
+func (r *countingResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls
+}
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestCachingResolver_TTL(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	r := &countingResolver{ip: net.IPv4(10, 0, 0, 1), ttl: 30 * time.Second}
+	c := &CachingResolver{Resolver: r, now: clock.Now}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, ip, err := c.Resolve(ctx, "example.com")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !ip.Equal(r.ip) {
+			t.Fatalf("bad: %v", ip)
+		}
+	}
+	if r.count() != 1 {
+		t.Fatalf("expected 1 lookup, got %d", r.count())
+	}
+
+	clock.Advance(31 * time.Second)
+	c.Resolve(ctx, "example.com")
+	if r.count() != 2 {
+		t.Fatalf("expected expired entry to be refetched, got %d", r.count())
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 2 || stats.Entries != 1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+
+	// Case and a trailing dot do not make another entry
+	c.Resolve(ctx, "Example.COM.")
+	if r.count() != 2 || c.Stats().Entries != 1 {
+		t.Fatalf("expected one shared entry: %d %+v", r.count(), c.Stats())
+	}
+}
+
+func TestCachingResolver_ZeroTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	r := &countingResolver{ip: net.IPv4(10, 0, 0, 1)}
+	c := &CachingResolver{Resolver: r, StaleTTL: time.Minute, now: clock.Now}
+	ctx := context.Background()
+
+	// A zero TTL says not to cache, DefaultTTL does not apply
+	c.Resolve(ctx, "example.com")
+	c.Resolve(ctx, "example.com")
+	if r.count() != 2 || c.Stats().Entries != 0 {
+		t.Fatalf("zero TTL answer cached: %d %+v", r.count(), c.Stats())
+	}
+
+	// A refresh answering with a zero TTL drops the stale entry
+	r.mu.Lock()
+	r.ttl = time.Second
+	r.mu.Unlock()
+	c.Resolve(ctx, "example.com")
+	r.mu.Lock()
+	r.ttl = 0
+	r.mu.Unlock()
+	clock.Advance(2 * time.Second)
+	c.Resolve(ctx, "example.com")
+	deadline := time.Now().Add(time.Second)
+	for c.Stats().Entries != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stale entry kept: %+v", c.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCachingResolver_Negative(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	r := &countingResolver{err: &net.DNSError{Err: "no such host", Name: "nope", IsNotFound: true}}
+	c := &CachingResolver{Resolver: r, NegativeTTL: time.Second, now: clock.Now}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.Resolve(ctx, "nope"); err == nil {
+			t.Fatalf("expected error")
+		}
+	}
+	if r.count() != 1 {
+		t.Fatalf("expected 1 lookup, got %d", r.count())
+	}
+	if c.Stats().NegativeHits != 1 {
+		t.Fatalf("bad stats: %+v", c.Stats())
+	}
+
+	clock.Advance(2 * time.Second)
+	c.Resolve(ctx, "nope")
+	if r.count() != 2 {
+		t.Fatalf("expected negative entry to expire, got %d", r.count())
+	}
+
+	// Wrapped not-found errors are cached too
+	r.err = fmt.Errorf("lookup: %w", &net.DNSError{Err: "no such host", Name: "wrapped", IsNotFound: true})
+	c.Resolve(ctx, "wrapped")
+	c.Resolve(ctx, "wrapped")
+	if r.count() != 3 {
+		t.Fatalf("expected wrapped not-found to be cached, got %d", r.count())
+	}
+
+	// Transient failures are not cached
+	r.err = &net.DNSError{Err: "server misbehaving", Name: "flaky"}
+	c.Resolve(ctx, "flaky")
+	c.Resolve(ctx, "flaky")
+	if r.count() != 5 {
+		t.Fatalf("expected transient failure to be retried, got %d", r.count())
+	}
+}
+
+func TestCachingResolver_Route(t *testing.T) {
+	corp := &countingResolver{ip: net.ParseIP("10.0.0.1")}
+	c := &CachingResolver{Resolver: NewRoutingResolver(nil,
+		map[string]NameResolver{"corp.example": corp},
+		&countingResolver{ip: net.ParseIP("192.0.2.1")},
+	)}
+
+	// Hits carry the route of the lookup that filled the entry
+	for i := 0; i < 2; i++ {
+		ctx, _, err := c.ResolveAll(context.Background(), "git.corp.example")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if route, ok := ResolverRoute(ctx); !ok || route != "corp.example" {
+			t.Fatalf("lookup %d: bad route %q", i, route)
+		}
+	}
+	if corp.count() != 1 || c.Stats().Hits != 1 {
+		t.Fatalf("expected one lookup and one hit: %d %+v", corp.count(), c.Stats())
+	}
+}
+
+func TestCachingResolver_Stale(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	r := &countingResolver{ip: net.IPv4(10, 0, 0, 1), ttl: time.Second}
+	c := &CachingResolver{Resolver: r, StaleTTL: time.Minute, now: clock.Now}
+	ctx := context.Background()
+
+	c.Resolve(ctx, "example.com")
+	r.mu.Lock()
+	r.ip = net.IPv4(10, 0, 0, 2)
+	r.mu.Unlock()
+
+	clock.Advance(2 * time.Second)
+	_, ip, err := c.Resolve(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("expected stale answer, got %v", ip)
+	}
+
+	// Wait for the background refresh
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, ip, _ = c.Resolve(ctx, "example.com")
+		if ip.Equal(net.IPv4(10, 0, 0, 2)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("entry was not refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if c.Stats().StaleHits == 0 {
+		t.Fatalf("bad stats: %+v", c.Stats())
+	}
+}
+
+func TestCachingResolver_LRU(t *testing.T) {
+	r := &countingResolver{ip: net.IPv4(10, 0, 0, 1), ttl: time.Minute}
+	c := &CachingResolver{Resolver: r, MaxEntries: 2}
+	ctx := context.Background()
+
+	c.Resolve(ctx, "a")
+	c.Resolve(ctx, "b")
+	c.Resolve(ctx, "a")
+	c.Resolve(ctx, "c")
+
+	stats := c.Stats()
+	if stats.Entries != 2 || stats.Evictions != 1 {
+		t.Fatalf("bad stats: %+v", stats)
+	}
+
+	// "b" was least recently used and must be gone, "a" must remain
+	calls := r.count()
+	c.Resolve(ctx, "a")
+	if r.count() != calls {
+		t.Fatalf("expected a to be cached")
+	}
+	c.Resolve(ctx, "b")
+	if r.count() != calls+1 {
+		t.Fatalf("expected b to be evicted")
+	}
+}
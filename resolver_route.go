@@ -0,0 +1,142 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+const (
+	// RouteHosts is recorded when a name was answered by the hosts table
+	RouteHosts = "hosts"
+	// RouteDefault is recorded when a name matched no suffix route
+	RouteDefault = "default"
+)
+
+type resolverRouteKey struct{}
+
+// ResolverRoute returns the route a RoutingResolver used to answer the
+// lookup that produced ctx: RouteHosts, RouteDefault or the matching
+// domain suffix
+func ResolverRoute(ctx context.Context) (string, bool) {
+	route, ok := ctx.Value(resolverRouteKey{}).(string)
+	return route, ok
+}
+
+// RoutingResolver is a NameResolver for split-horizon setups. Names are
+// looked up in the hosts table first, then sent to the resolver of the
+// longest matching suffix route, and finally to the default resolver.
+// The route taken is recorded in the returned context, see
+// ResolverRoute.
+type RoutingResolver struct {
+	hosts  map[string][]net.IP
+	routes map[string]NameResolver
+	def    NameResolver
+}
+
+// NewRoutingResolver returns a RoutingResolver. hosts pins names to
+// fixed addresses. routes maps domain suffixes such as "corp.example"
+// to the resolver answering names at or below them. def answers names
+// that match no route, DNSResolver if nil. Names and suffixes are
+// compared without case and surrounding dots.
+func NewRoutingResolver(hosts map[string][]net.IP, routes map[string]NameResolver, def NameResolver) *RoutingResolver {
+	r := &RoutingResolver{
+		hosts:  make(map[string][]net.IP, len(hosts)),
+		routes: make(map[string]NameResolver, len(routes)),
+		def:    def,
+	}
+	for name, ips := range hosts {
+		name = canonicalName(name)
+		r.hosts[name] = append(r.hosts[name], ips...)
+	}
+	for suffix, resolver := range routes {
+		if suffix = canonicalName(suffix); suffix != "" {
+			r.routes[suffix] = resolver
+		}
+	}
+	if r.def == nil {
+		r.def = DNSResolver{}
+	}
+	return r
+}
+
+func (r *RoutingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ips, err := r.ResolveAll(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+func (r *RoutingResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	name = canonicalName(name)
+	if ips := r.hosts[name]; len(ips) > 0 {
+		return context.WithValue(ctx, resolverRouteKey{}, RouteHosts), ips, nil
+	}
+
+	route, resolver := r.route(name)
+	ctx = context.WithValue(ctx, resolverRouteKey{}, route)
+	return AsMultiResolver(resolver).ResolveAll(ctx, name)
+}
+
+// route picks the resolver of the longest suffix matching name, trying
+// name and then each parent domain
+func (r *RoutingResolver) route(name string) (string, NameResolver) {
+	for suffix := name; suffix != ""; {
+		if resolver, ok := r.routes[suffix]; ok {
+			return suffix, resolver
+		}
+		i := strings.IndexByte(suffix, '.')
+		if i < 0 {
+			break
+		}
+		suffix = suffix[i+1:]
+	}
+	return RouteDefault, r.def
+}
+
+// matchesSuffix reports whether name equals suffix or is below it
+func matchesSuffix(name, suffix string) bool {
+	if suffix == "" {
+		return false
+	}
+	return name == suffix || strings.HasSuffix(name, "."+suffix)
+}
+
+// canonicalName lowercases name and strips leading and trailing dots
+func canonicalName(name string) string {
+	return strings.ToLower(strings.Trim(name, "."))
+}
+
+// ParseHosts reads a table in /etc/hosts format, an address followed
+// by one or more names per line with # starting a comment, for use as
+// the hosts of a RoutingResolver
+func ParseHosts(r io.Reader) (map[string][]net.IP, error) {
+	hosts := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("hosts line %d: missing host name", lineNo)
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, fmt.Errorf("hosts line %d: invalid address %q", lineNo, fields[0])
+		}
+		for _, name := range fields[1:] {
+			name = canonicalName(name)
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	return hosts, scanner.Err()
+}
@@ -0,0 +1,67 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRoutingResolver(t *testing.T) {
+	corp := staticResolver{net.IPv4(10, 0, 0, 1)}
+	lab := staticResolver{net.IPv4(10, 9, 0, 1)}
+	public := staticResolver{net.IPv4(203, 0, 113, 1)}
+	r := NewRoutingResolver(
+		map[string][]net.IP{
+			"Pinned.corp.example": {net.IPv4(10, 0, 0, 99)},
+		},
+		map[string]NameResolver{
+			"corp.example":      corp,
+			".lab.corp.example": lab,
+		},
+		public,
+	)
+
+	cases := []struct {
+		name  string
+		ip    net.IP
+		route string
+	}{
+		{"Pinned.Corp.Example.", net.IPv4(10, 0, 0, 99), RouteHosts},
+		{"db.corp.example", net.IPv4(10, 0, 0, 1), "corp.example"},
+		{"corp.example", net.IPv4(10, 0, 0, 1), "corp.example"},
+		{"gpu.lab.corp.example", net.IPv4(10, 9, 0, 1), "lab.corp.example"},
+		{"notcorp.example", net.IPv4(203, 0, 113, 1), RouteDefault},
+		{"example.com", net.IPv4(203, 0, 113, 1), RouteDefault},
+	}
+	for _, c := range cases {
+		ctx, ip, err := r.Resolve(context.Background(), c.name)
+		if err != nil {
+			t.Fatalf("%s: err: %v", c.name, err)
+		}
+		if !ip.Equal(c.ip) {
+			t.Fatalf("%s: bad ip: %v", c.name, ip)
+		}
+		if route, ok := ResolverRoute(ctx); !ok || route != c.route {
+			t.Fatalf("%s: bad route: %v", c.name, route)
+		}
+	}
+}
+
+func TestParseHosts(t *testing.T) {
+	hosts, err := ParseHosts(strings.NewReader(`
+# comment
+10.0.0.1   db.corp.example db
+2001:db8::1 db.corp.example # trailing comment
+`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(hosts["db.corp.example"]) != 2 || len(hosts["db"]) != 1 {
+		t.Fatalf("bad: %v", hosts)
+	}
+
+	if _, err := ParseHosts(strings.NewReader("not-an-ip host\n")); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,401 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dohContentType         = "application/dns-message"
+	dotDefaultPort         = "853"
+	defaultUpstreamTimeout = 5 * time.Second
+	maxDNSMessageLen       = 65535
+
+	// dotIdleTimeout is how long an idle DoT connection is kept for
+	// reuse, below the 10s or more servers usually allow
+	dotIdleTimeout = 8 * time.Second
+	// dotMaxIdle is the idle connections kept per upstream, one for
+	// each of the A and AAAA queries sent at once
+	dotMaxIdle = 2
+)
+
+// dnsExchangeFunc sends a packed query to one upstream and returns the
+// packed reply
+type dnsExchangeFunc func(ctx context.Context, upstream string, query []byte) ([]byte, error)
+
+// DoHResolver resolves names with DNS-over-HTTPS (RFC 8484), posting
+// wire format queries to each upstream in order until one answers.
+type DoHResolver struct {
+	// Upstreams are endpoint URLs such as https://dns.example/dns-query.
+	Upstreams []string
+
+	// Client performs the HTTPS requests.
+	// Defaults to http.DefaultClient.
+	Client *http.Client
+
+	// Timeout bounds a single attempt against one upstream before the
+	// next one is tried. Defaults to five seconds.
+	Timeout time.Duration
+}
+
+func (d *DoHResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ips, _, err := d.ResolveTTL(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+func (d *DoHResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	ctx, ips, _, err := d.ResolveTTL(ctx, name)
+	return ctx, ips, err
+}
+
+func (d *DoHResolver) ResolveTTL(ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error) {
+	ips, ttl, err := resolveUpstreams(ctx, name, d.Upstreams, d.Timeout, d.exchange)
+	return ctx, ips, ttl, err
+}
+
+func (d *DoHResolver) exchange(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+	// RFC 8484 asks for a zero ID so that responses are cache friendly
+	query[0], query[1] = 0, 0
+
+	req, err := http.NewRequest("POST", upstream, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected DoH status: %v", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dohContentType {
+		return nil, fmt.Errorf("Unexpected DoH content type: %q", ct)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxDNSMessageLen))
+}
+
+// DoTResolver resolves names with DNS-over-TLS (RFC 7858), trying each
+// upstream in order until one answers. Connections are kept open for a
+// few seconds and reused by later queries.
+type DoTResolver struct {
+	// Upstreams are server addresses as host or host:port,
+	// the port defaults to 853.
+	Upstreams []string
+
+	// TLSConfig is used for the TLS handshake. When ServerName is empty
+	// it is set to the host of the upstream being dialed.
+	TLSConfig *tls.Config
+
+	// Timeout bounds a single attempt against one upstream before the
+	// next one is tried. Defaults to five seconds.
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	idle map[string][]dotConn
+}
+
+// dotConn is an idle connection to an upstream
+type dotConn struct {
+	conn  *tls.Conn
+	since time.Time
+}
+
+func (d *DoTResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ips, _, err := d.ResolveTTL(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+func (d *DoTResolver) ResolveAll(ctx context.Context, name string) (context.Context, []net.IP, error) {
+	ctx, ips, _, err := d.ResolveTTL(ctx, name)
+	return ctx, ips, err
+}
+
+func (d *DoTResolver) ResolveTTL(ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error) {
+	ips, ttl, err := resolveUpstreams(ctx, name, d.Upstreams, d.Timeout, d.exchange)
+	return ctx, ips, ttl, err
+}
+
+func (d *DoTResolver) exchange(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+	// The server may have closed an idle connection in the meantime,
+	// so a failure on one is retried on a new connection
+	if conn := d.takeIdle(upstream); conn != nil {
+		if reply, err := dotExchange(ctx, conn, query); err == nil {
+			d.putIdle(upstream, conn)
+			return reply, nil
+		}
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil {
+		host, port = upstream, dotDefaultPort
+	}
+
+	conf := &tls.Config{}
+	if d.TLSConfig != nil {
+		conf = d.TLSConfig.Clone()
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = host
+	}
+	dialer := &tls.Dialer{Config: conf}
+	c, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	conn := c.(*tls.Conn)
+	reply, err := dotExchange(ctx, conn, query)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d.putIdle(upstream, conn)
+	return reply, nil
+}
+
+// takeIdle returns an idle connection to upstream, if one is fresh
+func (d *DoTResolver) takeIdle(upstream string) *tls.Conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	conns := d.idle[upstream]
+	for len(conns) > 0 {
+		c := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(c.since) < dotIdleTimeout {
+			d.idle[upstream] = conns
+			return c.conn
+		}
+		c.conn.Close()
+	}
+	delete(d.idle, upstream)
+	return nil
+}
+
+// putIdle keeps conn for reuse, closing it when enough are kept
+func (d *DoTResolver) putIdle(upstream string, conn *tls.Conn) {
+	conn.SetDeadline(time.Time{})
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.idle[upstream]) >= dotMaxIdle {
+		conn.Close()
+		return
+	}
+	if d.idle == nil {
+		d.idle = make(map[string][]dotConn)
+	}
+	d.idle[upstream] = append(d.idle[upstream], dotConn{conn, time.Now()})
+}
+
+// CloseIdleConnections closes the connections kept for reuse
+func (d *DoTResolver) CloseIdleConnections() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, conns := range d.idle {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+	}
+	d.idle = nil
+}
+
+// dotExchange sends query on conn and reads the reply
+func dotExchange(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Messages are framed with a two byte length as in DNS over TCP
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	length := []byte{0, 0}
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+
+	// A reply to another query leaves the stream out of step, the
+	// connection must not be reused
+	if len(reply) < 2 || !bytes.Equal(reply[:2], query[:2]) {
+		return nil, fmt.Errorf("Mismatched DNS reply ID")
+	}
+	return reply, nil
+}
+
+// resolveUpstreams looks up the IPv4 and IPv6 addresses of name at
+// once. The addresses of one family are returned even if the query
+// for the other failed. The returned TTL is the lowest of all records
+// used.
+func resolveUpstreams(ctx context.Context, name string, upstreams []string, timeout time.Duration, exchange dnsExchangeFunc) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	qtypes := []uint16{dnsTypeA, dnsTypeAAAA}
+	results := make([]result, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			r := &results[i]
+			r.ips, r.ttl, r.err = queryUpstreams(ctx, name, qtype, upstreams, timeout, exchange)
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var all []net.IP
+	var minTTL time.Duration
+	var firstErr error
+	for _, r := range results {
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		if len(r.ips) == 0 {
+			continue
+		}
+		if len(all) == 0 || r.ttl < minTTL {
+			minTTL = r.ttl
+		}
+		all = append(all, r.ips...)
+	}
+	if len(all) > 0 {
+		return all, minTTL, nil
+	}
+	if firstErr != nil {
+		return nil, 0, firstErr
+	}
+	return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// queryUpstreams sends one query to the upstreams in order and returns
+// the addresses of the first usable answer along with the lowest TTL
+// among them. Transport failures and server errors move on to the next
+// upstream, a name error ends the search.
+func queryUpstreams(ctx context.Context, name string, qtype uint16, upstreams []string, timeout time.Duration, exchange dnsExchangeFunc) ([]net.IP, time.Duration, error) {
+	if len(upstreams) == 0 {
+		return nil, 0, &net.DNSError{Err: "no upstream servers configured", Name: name}
+	}
+	if timeout <= 0 {
+		timeout = defaultUpstreamTimeout
+	}
+
+	lastErr := fmt.Errorf("no upstream answered")
+	var server string
+	for _, upstream := range upstreams {
+		server = upstream
+		query, err := newDNSQuery(dnsQueryID(), name, qtype).pack()
+		if err != nil {
+			return nil, 0, &net.DNSError{Err: err.Error(), Name: name}
+		}
+
+		actx, cancel := context.WithTimeout(ctx, timeout)
+		reply, err := exchange(actx, upstream, query)
+		cancel()
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		var msg dnsMessage
+		if err := msg.unpack(reply); err != nil {
+			lastErr = err
+			continue
+		}
+		// The exchange may have set the ID it sent, as DoH zeroes it
+		if sent := binary.BigEndian.Uint16(query); !msg.Response || msg.ID != sent || !answers(&msg, name, qtype) {
+			lastErr = fmt.Errorf("Mismatched DNS reply")
+			continue
+		}
+		switch msg.Rcode {
+		case dnsRcodeSuccess:
+		case dnsRcodeNameError:
+			return nil, 0, &net.DNSError{Err: "no such host", Name: name, Server: upstream, IsNotFound: true}
+		default:
+			lastErr = fmt.Errorf("DNS server returned rcode %d", msg.Rcode)
+			continue
+		}
+
+		var ips []net.IP
+		var ttl uint32
+		for _, rr := range msg.Answers {
+			if rr.Type != qtype {
+				continue
+			}
+			if (qtype == dnsTypeA && len(rr.Data) != net.IPv4len) ||
+				(qtype == dnsTypeAAAA && len(rr.Data) != net.IPv6len) {
+				continue
+			}
+			ips = append(ips, net.IP(append([]byte(nil), rr.Data...)))
+			if len(ips) == 1 || rr.TTL < ttl {
+				ttl = rr.TTL
+			}
+		}
+		return ips, time.Duration(ttl) * time.Second, nil
+	}
+	return nil, 0, &net.DNSError{Err: lastErr.Error(), Name: name, Server: server, IsTemporary: true}
+}
+
+// answers reports whether msg carries the question asked for name and
+// qtype, names compared without case and a trailing dot
+func answers(msg *dnsMessage, name string, qtype uint16) bool {
+	if len(msg.Questions) != 1 {
+		return false
+	}
+	q := msg.Questions[0]
+	return q.Type == qtype && strings.EqualFold(strings.TrimSuffix(q.Name, "."), strings.TrimSuffix(name, "."))
+}
+
+// dnsQueryID returns a random message ID
+func dnsQueryID() uint16 {
+	b := []byte{0, 0}
+	rand.Read(b)
+	return binary.BigEndian.Uint16(b)
+}
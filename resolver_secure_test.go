@@ -0,0 +1,267 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dnsStandIn answers queries from a static table, unknown names get
+// NXDOMAIN
+func dnsStandIn(records map[string][]net.IP) func([]byte) []byte {
+	return func(query []byte) []byte {
+		var m dnsMessage
+		if err := m.unpack(query); err != nil || len(m.Questions) != 1 {
+			return nil
+		}
+		q := m.Questions[0]
+		m.Response = true
+		ips, ok := records[q.Name]
+		if !ok {
+			m.Rcode = dnsRcodeNameError
+		}
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil && q.Type == dnsTypeA {
+				m.Answers = append(m.Answers, dnsRecord{Name: q.Name, Type: dnsTypeA, TTL: 120, Data: ip4})
+			} else if ip4 == nil && q.Type == dnsTypeAAAA {
+				m.Answers = append(m.Answers, dnsRecord{Name: q.Name, Type: dnsTypeAAAA, TTL: 60, Data: ip.To16()})
+			}
+		}
+		b, _ := m.pack()
+		return b
+	}
+}
+
+var standInRecords = map[string][]net.IP{
+	"v4.example": {net.ParseIP("192.0.2.1")},
+	"v6.example": {net.ParseIP("2001:db8::1")},
+	"dual.example": {
+		net.ParseIP("192.0.2.2"),
+		net.ParseIP("2001:db8::2"),
+	},
+}
+
+func newDoHStandIn(t *testing.T) *httptest.Server {
+	answer := dnsStandIn(standInRecords)
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := ioutil.ReadAll(r.Body)
+		if query[0] != 0 || query[1] != 0 {
+			t.Errorf("expected zero query ID")
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(answer(query))
+	}))
+}
+
+func TestDoHResolver(t *testing.T) {
+	srv := newDoHStandIn(t)
+	defer srv.Close()
+
+	d := &DoHResolver{Upstreams: []string{srv.URL}, Client: srv.Client()}
+	ctx := context.Background()
+
+	_, ips, ttl, err := d.ResolveTTL(ctx, "v4.example")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) || ttl != 120*time.Second {
+		t.Fatalf("bad: %v %v", ips, ttl)
+	}
+
+	_, ips, ttl, err = d.ResolveTTL(ctx, "dual.example")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ips) != 2 || ttl != 60*time.Second {
+		t.Fatalf("bad: %v %v", ips, ttl)
+	}
+
+	_, ip, err := d.Resolve(ctx, "v6.example")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("bad: %v", ip)
+	}
+
+	_, _, err = d.Resolve(ctx, "missing.example")
+	if !isNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestDoHResolver_Fallback(t *testing.T) {
+	srv := newDoHStandIn(t)
+	defer srv.Close()
+	broken := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	// Both stand-ins share the httptest certificate
+	d := &DoHResolver{Upstreams: []string{broken.URL, srv.URL}, Client: srv.Client()}
+	_, ip, err := d.Resolve(context.Background(), "v4.example")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("bad: %v", ip)
+	}
+
+	d.Upstreams = []string{broken.URL}
+	if _, _, err := d.Resolve(context.Background(), "v4.example"); err == nil || isNotFound(err) {
+		t.Fatalf("expected temporary error, got %v", err)
+	}
+}
+
+func TestDoTResolver(t *testing.T) {
+	// Borrow the httptest certificate for the DoT stand-in
+	cert := httptest.NewTLSServer(http.NotFoundHandler())
+	defer cert.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cert.TLS)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	answer := dnsStandIn(standInRecords)
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					length := []byte{0, 0}
+					if _, err := io.ReadFull(conn, length); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					reply := answer(query)
+					binary.BigEndian.PutUint16(length, uint16(len(reply)))
+					conn.Write(append(length, reply...))
+				}
+			}(conn)
+		}
+	}()
+
+	// An unreachable first upstream exercises the fallback order
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	rootCAs := cert.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	d := &DoTResolver{
+		Upstreams: []string{deadAddr, l.Addr().String()},
+		TLSConfig: &tls.Config{RootCAs: rootCAs, ServerName: "example.com"},
+	}
+
+	_, ips, ttl, err := d.ResolveTTL(context.Background(), "v4.example")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) || ttl != 120*time.Second {
+		t.Fatalf("bad: %v %v", ips, ttl)
+	}
+
+	_, _, err = d.Resolve(context.Background(), "missing.example")
+	if !isNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	// The A and AAAA queries of each lookup reuse the connections
+	// opened by the first
+	if _, _, err := d.ResolveAll(context.Background(), "dual.example"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := atomic.LoadInt32(&accepted); n > dotMaxIdle {
+		t.Fatalf("expected reused connections, %d accepted", n)
+	}
+	d.CloseIdleConnections()
+}
+
+func TestResolveUpstreams_Partial(t *testing.T) {
+	answer := dnsStandIn(standInRecords)
+	var wrongName, zeroID bool
+	exchange := func(ctx context.Context, upstream string, query []byte) ([]byte, error) {
+		var m dnsMessage
+		m.unpack(query)
+		if zeroID {
+			reply := answer(query)
+			reply[0], reply[1] = 0, 0
+			return reply, nil
+		}
+		if wrongName {
+			m.Questions[0].Name = "other.example"
+			b, _ := m.pack()
+			return answer(b), nil
+		}
+		if m.Questions[0].Type == dnsTypeAAAA {
+			return nil, fmt.Errorf("timeout")
+		}
+		return answer(query), nil
+	}
+
+	// A failed AAAA query keeps the A answer
+	ips, ttl, err := resolveUpstreams(context.Background(), "dual.example", []string{"stand-in"}, time.Second, exchange)
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.2")) || ttl != 120*time.Second {
+		t.Fatalf("bad: %v %v %v", ips, ttl, err)
+	}
+	if _, _, err := resolveUpstreams(context.Background(), "v6.example", []string{"stand-in"}, time.Second, exchange); err == nil || isNotFound(err) {
+		t.Fatalf("expected temporary error, got %v", err)
+	}
+
+	// Replies to another question are not used
+	wrongName = true
+	if _, _, err := resolveUpstreams(context.Background(), "v4.example", []string{"stand-in"}, time.Second, exchange); err == nil || !strings.Contains(err.Error(), "Mismatched") {
+		t.Fatalf("expected a mismatch, got %v", err)
+	}
+
+	// Nor replies with another ID, zero included
+	wrongName, zeroID = false, true
+	if _, _, err := resolveUpstreams(context.Background(), "v4.example", []string{"stand-in"}, time.Second, exchange); err == nil || !strings.Contains(err.Error(), "Mismatched") {
+		t.Fatalf("expected a mismatch, got %v", err)
+	}
+}
+
+func TestDotExchange_ID(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	go func() {
+		defer s.Close()
+		length := []byte{0, 0}
+		io.ReadFull(s, length)
+		query := make([]byte, binary.BigEndian.Uint16(length))
+		io.ReadFull(s, query)
+		reply := dnsStandIn(standInRecords)(query)
+		reply[0]++
+		binary.BigEndian.PutUint16(length, uint16(len(reply)))
+		s.Write(append(length, reply...))
+	}()
+	query, _ := newDNSQuery(0x1234, "v4.example", dnsTypeA).pack()
+	if _, err := dotExchange(context.Background(), c, query); err == nil || !strings.Contains(err.Error(), "Mismatched") {
+		t.Fatalf("expected a mismatch, got %v", err)
+	}
+}
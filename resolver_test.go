@@ -2,6 +2,7 @@ package socks5
 
 import (
 	"context"
+	"net"
 	"testing"
 )
 
@@ -18,3 +19,39 @@ func TestDNSResolver(t *testing.T) {
 		t.Fatalf("expected loopback")
 	}
 }
+
+func TestDNSResolver_ResolveAll(t *testing.T) {
+	d := DNSResolver{}
+	ctx := context.Background()
+
+	_, addrs, err := d.ResolveAll(ctx, "localhost")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(addrs) == 0 || !addrs[0].IsLoopback() {
+		t.Fatalf("expected loopback: %v", addrs)
+	}
+}
+
+type staticResolver struct {
+	ip net.IP
+}
+
+func (s staticResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, s.ip, nil
+}
+
+func TestAsMultiResolver(t *testing.T) {
+	r := AsMultiResolver(staticResolver{net.IPv4(10, 0, 0, 1)})
+	_, addrs, err := r.ResolveAll(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(addrs) != 1 || !addrs[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("bad: %v", addrs)
+	}
+
+	if _, ok := AsMultiResolver(DNSResolver{}).(DNSResolver); !ok {
+		t.Fatalf("expected DNSResolver to be used directly")
+	}
+}
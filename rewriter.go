@@ -0,0 +1,148 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// RewriteRule maps destinations matching Match to Target.
+//
+// Match is a destination pattern, see compileAddrMatcher.
+//
+// Target is host:port, host or :port. An omitted host or port keeps
+// the one of the original destination.
+type RewriteRule struct {
+	Match  string
+	Target string
+}
+
+// AddressRewrite records a rewrite applied by a TableRewriter
+type AddressRewrite struct {
+	// Rule is the Match of the rule that applied
+	Rule string
+	// From is the destination requested by the client
+	From *AddrSpec
+	// To is the destination that is dialed instead
+	To *AddrSpec
+}
+
+type addressRewriteKey struct{}
+
+// AppliedRewrite returns the rewrite recorded in ctx by a TableRewriter
+func AppliedRewrite(ctx context.Context) (*AddressRewrite, bool) {
+	rw, ok := ctx.Value(addressRewriteKey{}).(*AddressRewrite)
+	return rw, ok
+}
+
+// TableRewriter is an AddressRewriter driven by a list of rules.
+// The first matching rule wins, destinations matching no rule are
+// left untouched.
+type TableRewriter struct {
+	rules []compiledRewrite
+}
+
+type compiledRewrite struct {
+	rule RewriteRule
+	addrMatcher
+
+	targetFQDN string
+	targetIP   net.IP
+	targetPort int
+}
+
+// NewTableRewriter validates rules and builds a TableRewriter
+func NewTableRewriter(rules []RewriteRule) (*TableRewriter, error) {
+	t := &TableRewriter{}
+	for i, rule := range rules {
+		c, err := compileRewrite(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite rule %d: %v", i+1, err)
+		}
+		t.rules = append(t.rules, c)
+	}
+	return t, nil
+}
+
+// ParseRewriteRules reads one rule per line as "match target",
+// # starts a comment
+func ParseRewriteRules(r io.Reader) ([]RewriteRule, error) {
+	var rules []RewriteRule
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("rewrite line %d: expected \"match target\"", lineNo)
+		}
+		rules = append(rules, RewriteRule{Match: fields[0], Target: fields[1]})
+	}
+	return rules, scanner.Err()
+}
+
+func (t *TableRewriter) Rewrite(ctx context.Context, request *Request) (context.Context, *AddrSpec) {
+	dest := request.DestAddr
+	for i := range t.rules {
+		r := &t.rules[i]
+		if !r.matches(dest) {
+			continue
+		}
+		to := r.apply(dest)
+		ctx = context.WithValue(ctx, addressRewriteKey{}, &AddressRewrite{
+			Rule: r.rule.Match,
+			From: dest,
+			To:   to,
+		})
+		return ctx, to
+	}
+	return ctx, dest
+}
+
+func (r *compiledRewrite) apply(dest *AddrSpec) *AddrSpec {
+	to := &AddrSpec{FQDN: dest.FQDN, IP: dest.IP, Port: dest.Port}
+	if r.targetFQDN != "" || r.targetIP != nil {
+		to.FQDN = r.targetFQDN
+		to.IP = r.targetIP
+	}
+	if r.targetPort != 0 {
+		to.Port = r.targetPort
+	}
+	return to
+}
+
+func compileRewrite(rule RewriteRule) (compiledRewrite, error) {
+	c := compiledRewrite{rule: rule}
+
+	m, err := compileAddrMatcher(rule.Match)
+	if err != nil {
+		return c, fmt.Errorf("match %v", err)
+	}
+	c.addrMatcher = m
+
+	host, port, err := splitAddrPattern(rule.Target)
+	if err != nil {
+		return c, fmt.Errorf("target %q: %v", rule.Target, err)
+	}
+	if host == "" && port == 0 {
+		return c, fmt.Errorf("target %q: no host or port", rule.Target)
+	}
+	if strings.ContainsAny(host, "*/") {
+		return c, fmt.Errorf("target %q: must be a host or IP", rule.Target)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		c.targetIP = ip
+	} else {
+		c.targetFQDN = host
+	}
+	c.targetPort = port
+	return c, nil
+}
@@ -0,0 +1,161 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTableRewriter(t *testing.T) {
+	rules, err := ParseRewriteRules(strings.NewReader(`
+# database moved behind a pooler
+db.prod:5432        10.1.2.3:6432
+*.cache.prod:*      cache-lb.prod
+10.20.0.0/16:8080   :80
+[2001:db8::/32]:443 [2001:db8::1]:8443
+`))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	rw, err := NewTableRewriter(rules)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []struct {
+		dest     *AddrSpec
+		expected string
+		rule     string
+	}{
+		{&AddrSpec{FQDN: "db.prod", IP: net.IPv4(10, 0, 0, 5), Port: 5432}, "10.1.2.3:6432", "db.prod:5432"},
+		{&AddrSpec{FQDN: "DB.prod.", Port: 5432}, "10.1.2.3:6432", "db.prod:5432"},
+		{&AddrSpec{FQDN: "db.prod", Port: 5433}, "", ""},
+		{&AddrSpec{FQDN: "a.cache.prod", Port: 11211}, "cache-lb.prod:11211", "*.cache.prod:*"},
+		{&AddrSpec{FQDN: "cache.prod", Port: 11211}, "", ""},
+		{&AddrSpec{IP: net.IPv4(10, 20, 3, 4), Port: 8080}, "10.20.3.4:80", "10.20.0.0/16:8080"},
+		{&AddrSpec{FQDN: "app.prod", IP: net.IPv4(10, 20, 3, 4), Port: 8080}, "10.20.3.4:80", "10.20.0.0/16:8080"},
+		{&AddrSpec{IP: net.ParseIP("2001:db8::5"), Port: 443}, "[2001:db8::1]:8443", "[2001:db8::/32]:443"},
+	}
+	for _, c := range cases {
+		ctx, to := rw.Rewrite(context.Background(), &Request{DestAddr: c.dest})
+		rec, ok := AppliedRewrite(ctx)
+		if c.expected == "" {
+			if to != c.dest || ok {
+				t.Fatalf("%v: expected no rewrite, got %v", c.dest, to)
+			}
+			continue
+		}
+		if to.Address() != c.expected {
+			t.Fatalf("%v: bad: %v", c.dest, to.Address())
+		}
+		if !ok || rec.Rule != c.rule || rec.From != c.dest || rec.To != to {
+			t.Fatalf("%v: bad record: %+v", c.dest, rec)
+		}
+	}
+}
+
+func TestTableRewriter_Invalid(t *testing.T) {
+	invalid := []RewriteRule{
+		{Match: "db.prod:http", Target: "10.0.0.1:80"},
+		{Match: "10.0.0.0/33", Target: "10.0.0.1:80"},
+		{Match: "db.prod", Target: ""},
+		{Match: "db.prod", Target: "*.prod:80"},
+		{Match: "", Target: "10.0.0.1"},
+	}
+	for _, rule := range invalid {
+		if _, err := NewTableRewriter([]RewriteRule{rule}); err == nil {
+			t.Fatalf("%+v: expected error", rule)
+		}
+	}
+}
+
+// mapResolver resolves the names it knows and records every lookup
+type mapResolver struct {
+	addrs  map[string]net.IP
+	lookup []string
+}
+
+func (r *mapResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	r.lookup = append(r.lookup, name)
+	if ip, ok := r.addrs[name]; ok {
+		return ctx, ip, nil
+	}
+	return ctx, nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestRequest_Rewrite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("pong"))
+			conn.Close()
+		}
+	}()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	rw, err := NewTableRewriter([]RewriteRule{
+		{Match: "db.prod:5432", Target: "127.0.0.1:" + port},
+		{Match: "legacy.internal:80", Target: "backend.internal:" + port},
+		{Match: "192.0.2.0/24:80", Target: "127.0.0.1:" + port},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []struct {
+		fqdn   string
+		port   int
+		lookup []string
+	}{
+		// The name is never resolved, only the rule knows it
+		{"db.prod", 5432, nil},
+		// The target name goes through the configured resolver
+		{"legacy.internal", 80, []string{"backend.internal"}},
+		// Rules matching networks apply to resolved names
+		{"app.example", 80, []string{"app.example"}},
+	}
+	for _, c := range cases {
+		resolver := &mapResolver{addrs: map[string]net.IP{
+			"backend.internal": net.IPv4(127, 0, 0, 1),
+			"app.example":      net.IPv4(192, 0, 2, 10),
+		}}
+		var logs bytes.Buffer
+		s := &Server{config: &Config{
+			Rules:    PermitAll(),
+			Resolver: resolver,
+			Rewriter: rw,
+			Logger:   log.New(&logs, "", 0),
+		}}
+		req := &Request{
+			Version:  socks5Version,
+			Command:  ConnectCommand,
+			DestAddr: &AddrSpec{FQDN: c.fqdn, Port: c.port},
+			bufConn:  bytes.NewReader(nil),
+		}
+		resp := &MockConn{}
+		if err := s.handleRequest(req, resp); err != nil {
+			t.Fatalf("%s: err: %v", c.fqdn, err)
+		}
+		if out := resp.buf.Bytes(); out[1] != successReply || !bytes.HasSuffix(out, []byte("pong")) {
+			t.Fatalf("%s: bad reply: %v", c.fqdn, out)
+		}
+		if strings.Join(resolver.lookup, ",") != strings.Join(c.lookup, ",") {
+			t.Fatalf("%s: looked up %v, want %v", c.fqdn, resolver.lookup, c.lookup)
+		}
+		if !strings.Contains(logs.String(), c.fqdn) || !strings.Contains(logs.String(), "rewritten to") || !strings.HasSuffix(logs.String(), ":"+port+"\n") {
+			t.Fatalf("%s: rewrite not logged: %q", c.fqdn, logs.String())
+		}
+	}
+}
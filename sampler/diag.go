@@ -0,0 +1,247 @@
+package sampler
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mikioh/tcpinfo"
+	"github.com/mikioh/tcpopt"
+)
+
+const (
+	// Message type of sock_diag requests and replies
+	sockDiagByFamily = 20
+
+	// inet_diag request and message layout
+	sizeofInetDiagReqV2 = 56
+	sizeofInetDiagMsg   = 72
+	inetDiagInfo        = 2
+	inetDiagVegasInfo   = 3
+	inetDiagCong        = 4
+	inetDiagDCTCPInfo   = 9
+	inetDiagBBRInfo     = 16
+	allStates           = 0xfff
+
+	// Room for a struct tcp_info of any kernel version
+	sizeofTCPInfoMax = 256
+
+	protocolTCP = 6
+)
+
+// Netlink carries sock_diag dumps. Dump sends a request with the given
+// payload and returns the payloads of the messages answering it.
+type Netlink interface {
+	Dump(req []byte) ([][]byte, error)
+	Close() error
+}
+
+// Filter selects the sockets a Collector reports. A socket matches
+// when it matches every non-empty list, and a list matches when any of
+// its entries does.
+type Filter struct {
+	LocalPorts  []int
+	RemotePorts []int
+	LocalNets   []*net.IPNet
+	RemoteNets  []*net.IPNet
+	States      []tcpinfo.State
+}
+
+func (f *Filter) match(s *Socket) bool {
+	return matchPort(f.LocalPorts, s.Local.Port) &&
+		matchPort(f.RemotePorts, s.Remote.Port) &&
+		matchNet(f.LocalNets, s.Local.IP) &&
+		matchNet(f.RemoteNets, s.Remote.IP) &&
+		matchState(f.States, s.Sample.State)
+}
+
+func matchPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return len(ports) == 0
+}
+
+func matchNet(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return len(nets) == 0
+}
+
+func matchState(states []tcpinfo.State, state tcpinfo.State) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return len(states) == 0
+}
+
+// Socket is one socket reported by a Collector
+type Socket struct {
+	Local  *net.TCPAddr
+	Remote *net.TCPAddr
+	UID    uint32
+	Inode  uint32
+	Sample *Sample
+	// Delta is the change since the previous collection, nil when the
+	// socket was not seen then
+	Delta *Delta
+}
+
+// socketKey identifies a socket across collections
+type socketKey struct {
+	local, remote string
+	inode         uint32
+}
+
+// Collector dumps TCP_INFO of every TCP socket on the host matching
+// its filter over sock_diag, one request per address family
+type Collector struct {
+	nl     Netlink
+	filter Filter
+	last   map[socketKey]*Sample
+}
+
+// NewCollector returns a Collector reading from the host's sock_diag
+func NewCollector(f Filter) (*Collector, error) {
+	nl, err := newNetlink()
+	if err != nil {
+		return nil, err
+	}
+	return NewCollectorWith(nl, f), nil
+}
+
+// NewCollectorWith returns a Collector reading from nl
+func NewCollectorWith(nl Netlink, f Filter) *Collector {
+	return &Collector{nl: nl, filter: f, last: make(map[socketKey]*Sample)}
+}
+
+// Close releases the netlink socket
+func (c *Collector) Close() error {
+	return c.nl.Close()
+}
+
+// Collect dumps the matching sockets. Their samples share one
+// timestamp and carry the change since the previous collection.
+func (c *Collector) Collect() ([]*Socket, error) {
+	now := time.Now()
+	seen := make(map[socketKey]*Sample)
+	var socks []*Socket
+	for _, family := range []uint8{familyInet, familyInet6} {
+		msgs, err := c.nl.Dump(diagRequest(family))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			s, err := parseDiagMsg(m, now)
+			if err != nil {
+				return nil, err
+			}
+			if s == nil || !c.filter.match(s) {
+				continue
+			}
+			key := socketKey{s.Local.String(), s.Remote.String(), s.Inode}
+			if prev, ok := c.last[key]; ok {
+				s.Delta = s.Sample.Sub(prev)
+			}
+			seen[key] = s.Sample
+			socks = append(socks, s)
+		}
+	}
+	c.last = seen
+	return socks, nil
+}
+
+const (
+	familyInet  = 2
+	familyInet6 = 10
+)
+
+// diagRequest builds the inet_diag_req_v2 dumping every TCP socket of
+// family with its TCP_INFO and congestion control state
+func diagRequest(family uint8) []byte {
+	b := make([]byte, sizeofInetDiagReqV2)
+	b[0] = family
+	b[1] = protocolTCP
+	b[2] = 1<<(inetDiagInfo-1) | 1<<(inetDiagVegasInfo-1) | 1<<(inetDiagCong-1)
+	binary.NativeEndian.PutUint32(b[4:], allStates)
+	return b
+}
+
+// parseDiagMsg parses one inet_diag_msg read at t, returning nil for a
+// socket that reported no TCP_INFO
+func parseDiagMsg(b []byte, t time.Time) (*Socket, error) {
+	if len(b) < sizeofInetDiagMsg {
+		return nil, errors.New("short inet_diag message")
+	}
+	s := &Socket{
+		Local:  &net.TCPAddr{Port: int(binary.BigEndian.Uint16(b[4:]))},
+		Remote: &net.TCPAddr{Port: int(binary.BigEndian.Uint16(b[6:]))},
+		UID:    binary.NativeEndian.Uint32(b[64:]),
+		Inode:  binary.NativeEndian.Uint32(b[68:]),
+	}
+	switch b[0] {
+	case familyInet:
+		s.Local.IP = net.IP(append([]byte(nil), b[8:12]...))
+		s.Remote.IP = net.IP(append([]byte(nil), b[24:28]...))
+	case familyInet6:
+		s.Local.IP = net.IP(append([]byte(nil), b[8:24]...))
+		s.Remote.IP = net.IP(append([]byte(nil), b[24:40]...))
+	default:
+		return nil, fmt.Errorf("unexpected address family %d", b[0])
+	}
+
+	var info, cong, ccRaw []byte
+	for attrs := b[sizeofInetDiagMsg:]; len(attrs) >= 4; {
+		l := int(binary.NativeEndian.Uint16(attrs))
+		typ := binary.NativeEndian.Uint16(attrs[2:])
+		if l < 4 || l > len(attrs) {
+			return nil, errors.New("bad inet_diag attribute")
+		}
+		switch typ {
+		case inetDiagInfo:
+			info = attrs[4:l]
+		case inetDiagCong:
+			cong = attrs[4:l]
+		case inetDiagVegasInfo, inetDiagDCTCPInfo, inetDiagBBRInfo:
+			ccRaw = attrs[4:l]
+		}
+		attrs = attrs[min((l+3)&^3, len(attrs)):]
+	}
+	if info == nil {
+		return nil, nil
+	}
+	ti, err := parseInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	s.Sample = FromInfo(ti, t)
+	if cong != nil {
+		s.Sample.setCC(cong, ccRaw)
+	}
+	return s, nil
+}
+
+// parseInfo parses a struct tcp_info, which older kernels send shorter
+func parseInfo(b []byte) (*tcpinfo.Info, error) {
+	var o tcpinfo.Info
+	buf := make([]byte, max(len(b), sizeofTCPInfoMax))
+	copy(buf, b)
+	opt, err := tcpopt.Parse(o.Level(), o.Name(), buf)
+	if err != nil {
+		return nil, err
+	}
+	info, ok := opt.(*tcpinfo.Info)
+	if !ok {
+		return nil, fmt.Errorf("unexpected TCP_INFO option %T", opt)
+	}
+	return info, nil
+}
@@ -0,0 +1,79 @@
+package sampler
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+)
+
+const netlinkSockDiag = 4
+
+// sockDiag is a NETLINK_SOCK_DIAG socket
+type sockDiag struct {
+	mu  sync.Mutex
+	fd  int
+	seq uint32
+}
+
+func newNetlink() (Netlink, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, netlinkSockDiag)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	return &sockDiag{fd: fd}, nil
+}
+
+func (d *sockDiag) Dump(req []byte) ([][]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seq++
+	msg := make([]byte, syscall.NLMSG_HDRLEN+len(req))
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], sockDiagByFamily)
+	binary.NativeEndian.PutUint16(msg[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	binary.NativeEndian.PutUint32(msg[8:], d.seq)
+	copy(msg[syscall.NLMSG_HDRLEN:], req)
+	if err := syscall.Sendto(d.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("sendto", err)
+	}
+
+	var out [][]byte
+	buf := make([]byte, 64<<10)
+	for {
+		n, _, err := syscall.Recvfrom(d.fd, buf, 0)
+		if err != nil {
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != d.seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return out, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, errors.New("short netlink error")
+				}
+				errno := -int32(binary.NativeEndian.Uint32(m.Data))
+				return nil, os.NewSyscallError("sock_diag", syscall.Errno(errno))
+			case sockDiagByFamily:
+				out = append(out, append([]byte(nil), m.Data...))
+			}
+		}
+	}
+}
+
+func (d *sockDiag) Close() error {
+	return syscall.Close(d.fd)
+}
@@ -0,0 +1,175 @@
+package sampler
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mikioh/tcpinfo"
+)
+
+// fakeNetlink answers dumps with canned messages per address family
+type fakeNetlink struct {
+	msgs map[uint8][][]byte
+	reqs [][]byte
+}
+
+func (f *fakeNetlink) Dump(req []byte) ([][]byte, error) {
+	f.reqs = append(f.reqs, req)
+	return f.msgs[req[0]], nil
+}
+
+func (f *fakeNetlink) Close() error { return nil }
+
+// diagMsg builds the inet_diag_msg of an established socket with the
+// given retransmission and acknowledged byte counters
+func diagMsg(local, remote *net.TCPAddr, inode uint32, retrans uint32, acked uint64) []byte {
+	b := make([]byte, sizeofInetDiagMsg)
+	family, ip := uint8(familyInet), local.IP.To4()
+	if ip == nil {
+		family = familyInet6
+	}
+	b[0] = family
+	b[1] = 1 // TCP_ESTABLISHED
+	binary.BigEndian.PutUint16(b[4:], uint16(local.Port))
+	binary.BigEndian.PutUint16(b[6:], uint16(remote.Port))
+	if family == familyInet {
+		copy(b[8:], local.IP.To4())
+		copy(b[24:], remote.IP.To4())
+	} else {
+		copy(b[8:], local.IP.To16())
+		copy(b[24:], remote.IP.To16())
+	}
+	binary.NativeEndian.PutUint32(b[68:], inode)
+
+	info := make([]byte, 232)
+	info[0] = 1                                    // tcpi_state
+	binary.NativeEndian.PutUint32(info[16:], 1448) // tcpi_snd_mss
+	binary.NativeEndian.PutUint32(info[68:], 2000) // tcpi_rtt
+	binary.NativeEndian.PutUint32(info[100:], retrans)
+	binary.NativeEndian.PutUint64(info[120:], acked) // tcpi_bytes_acked
+	b = appendAttr(b, inetDiagInfo, info)
+
+	// BBR at 1 Mbit/s with a 20ms min RTT
+	b = appendAttr(b, inetDiagCong, []byte("bbr\x00"))
+	bbr := make([]byte, 20)
+	binary.NativeEndian.PutUint32(bbr[0:], 125000) // bbr_bw_lo
+	binary.NativeEndian.PutUint32(bbr[8:], 20000)  // bbr_min_rtt
+	return appendAttr(b, inetDiagBBRInfo, bbr)
+}
+
+// appendAttr appends a netlink attribute padded to 4 bytes
+func appendAttr(b []byte, typ uint16, data []byte) []byte {
+	attr := make([]byte, (4+len(data)+3)&^3)
+	binary.NativeEndian.PutUint16(attr, uint16(4+len(data)))
+	binary.NativeEndian.PutUint16(attr[2:], typ)
+	copy(attr[4:], data)
+	return append(b, attr...)
+}
+
+func TestCollector_Fake(t *testing.T) {
+	a := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1080}
+	b := &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 40000}
+	c := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1080}
+	v6r := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 40001}
+	nl := &fakeNetlink{msgs: map[uint8][][]byte{
+		familyInet:  {diagMsg(a, b, 1, 0, 1000), diagMsg(c, b, 2, 0, 0)},
+		familyInet6: {diagMsg(v6, v6r, 3, 0, 0)},
+	}}
+	col := NewCollectorWith(nl, Filter{LocalPorts: []int{1080}, States: []tcpinfo.State{tcpinfo.Established}})
+
+	socks, err := col.Collect()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(nl.reqs) != 2 || nl.reqs[0][0] != familyInet || nl.reqs[1][0] != familyInet6 || nl.reqs[0][1] != protocolTCP || nl.reqs[0][2]&(1<<(inetDiagCong-1)) == 0 {
+		t.Fatalf("bad requests: %v", nl.reqs)
+	}
+	if len(socks) != 2 {
+		t.Fatalf("expected the two port 1080 sockets, got %d", len(socks))
+	}
+	s := socks[0]
+	if s.Local.String() != a.String() || s.Remote.String() != b.String() || s.Inode != 1 {
+		t.Fatalf("bad socket: %+v", s)
+	}
+	if s.Sample.SenderMSS != 1448 || s.Sample.RTT != 2*time.Millisecond || s.Delta != nil {
+		t.Fatalf("bad sample: %+v", s.Sample)
+	}
+	bbr, ok := s.Sample.CCInfo.(*tcpinfo.BBRInfo)
+	if s.Sample.CCAlgorithm != "bbr" || !ok || bbr.MaxBW != 125000 || bbr.MinRTT != 20*time.Millisecond {
+		t.Fatalf("bad congestion control: %q %+v", s.Sample.CCAlgorithm, s.Sample.CCInfo)
+	}
+	if socks[1].Local.String() != v6.String() || socks[0].Sample.Time != socks[1].Sample.Time {
+		t.Fatalf("bad v6 socket: %+v", socks[1])
+	}
+
+	// The next collection reports the change since this one
+	time.Sleep(time.Millisecond)
+	nl.msgs[familyInet][0] = diagMsg(a, b, 1, 3, 5000)
+	socks, err = col.Collect()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d := socks[0].Delta
+	if d == nil || d.RetransSegs != 3 || d.BytesAcked != 4000 || d.Interval <= 0 {
+		t.Fatalf("bad delta: %+v", d)
+	}
+
+	col.filter = Filter{RemoteNets: []*net.IPNet{{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(64, 128)}}}
+	if socks, _ := col.Collect(); len(socks) != 1 || socks[0].Inode != 3 {
+		t.Fatalf("bad network filter result: %v", socks)
+	}
+}
+
+func TestParseDiagMsg_Bad(t *testing.T) {
+	if _, err := parseDiagMsg(make([]byte, 10), time.Now()); err == nil {
+		t.Fatalf("expected short message error")
+	}
+	m := diagMsg(&net.TCPAddr{IP: net.IPv4(1, 2, 3, 4)}, &net.TCPAddr{IP: net.IPv4(5, 6, 7, 8)}, 1, 0, 0)
+	binary.NativeEndian.PutUint16(m[sizeofInetDiagMsg:], 0xffff)
+	if _, err := parseDiagMsg(m, time.Now()); err == nil {
+		t.Fatalf("expected bad attribute error")
+	}
+	if s, err := parseDiagMsg(m[:sizeofInetDiagMsg], time.Now()); s != nil || err != nil {
+		t.Fatalf("socket without TCP_INFO: %v %v", s, err)
+	}
+}
+
+func TestCollector_Host(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.TCPAddr)
+	col, err := NewCollector(Filter{LocalPorts: []int{local.Port}})
+	if err != nil {
+		t.Skipf("sock_diag unavailable: %v", err)
+	}
+	defer col.Close()
+	socks, err := col.Collect()
+	if err != nil {
+		t.Skipf("sock_diag unavailable: %v", err)
+	}
+	if len(socks) != 1 || socks[0].Remote.String() != l.Addr().String() || socks[0].Sample.SenderMSS == 0 {
+		t.Fatalf("bad sockets: %+v", socks)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package sampler
+
+import "errors"
+
+func newNetlink() (Netlink, error) {
+	return nil, errors.New("sock_diag requires Linux")
+}
@@ -0,0 +1,182 @@
+// Package sampler reads TCP_INFO from connections into typed,
+// timestamped samples and derives per-interval deltas and rates from
+// successive samples.
+package sampler
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mikioh/tcpinfo"
+)
+
+// Sample is one reading of a connection's TCP_INFO. Fields marked
+// Linux only are zero elsewhere.
+type Sample struct {
+	Time  time.Time     `json:"time"`
+	State tcpinfo.State `json:"state"`
+
+	RTT    time.Duration `json:"rtt"`
+	RTTVar time.Duration `json:"rttvar"`
+	RTO    time.Duration `json:"rto"`
+	ATO    time.Duration `json:"ato"`
+
+	SenderMSS   uint `json:"snd_mss"`
+	ReceiverMSS uint `json:"rcv_mss"`
+
+	// Options negotiated for the connection
+	SACK            bool `json:"sack"`
+	Timestamps      bool `json:"tmstamps"`
+	WindowScale     int  `json:"wscale"`
+	PeerWindowScale int  `json:"peer_wscale"`
+
+	SenderWindowSegs    uint `json:"snd_cwnd_segs"`
+	SenderWindowBytes   uint `json:"snd_cwnd_bytes"`
+	SenderSSThreshold   uint `json:"snd_ssthresh"`
+	ReceiverSSThreshold uint `json:"rcv_ssthresh"`
+	ReceiverWindow      uint `json:"rcv_wnd"`
+
+	LastDataSent     time.Duration `json:"last_data_sent"`
+	LastDataReceived time.Duration `json:"last_data_rcvd"`
+	LastAckReceived  time.Duration `json:"last_ack_rcvd"`
+
+	// Linux only
+	PathMTU          uint          `json:"path_mtu"`
+	AdvertisedMSS    uint          `json:"adv_mss"`
+	CAState          int           `json:"ca_state"`
+	Retransmissions  uint          `json:"rexmits"`
+	Backoffs         uint          `json:"backoffs"`
+	UnackedSegs      uint          `json:"unacked_segs"`
+	SackedSegs       uint          `json:"sacked_segs"`
+	LostSegs         uint          `json:"lost_segs"`
+	RetransSegs      uint          `json:"retrans_segs"`
+	ReorderedSegs    uint          `json:"reord_segs"`
+	ReceiverRTT      time.Duration `json:"rcv_rtt"`
+	MinRTT           time.Duration `json:"min_rtt"`
+	TotalRetransSegs uint          `json:"total_retrans_segs"`
+	PacingRate       uint64        `json:"pacing_rate"`
+	BytesAcked       uint64        `json:"thru_bytes_acked"`
+	BytesReceived    uint64        `json:"thru_bytes_rcvd"`
+	SegsOut          uint          `json:"segs_out"`
+	SegsIn           uint          `json:"segs_in"`
+	DataSegsOut      uint          `json:"data_segs_out"`
+	DataSegsIn       uint          `json:"data_segs_in"`
+	NotSentBytes     uint          `json:"not_sent_bytes"`
+	// WindowProbes counts unanswered zero-window or keepalive probes
+	WindowProbes uint `json:"wnd_ka_probes"`
+
+	// Congestion control algorithm and its state, such as the BBR
+	// bandwidth and min-RTT estimates. Linux only.
+	CCAlgorithm string                  `json:"cc_algo,omitempty"`
+	CCInfo      tcpinfo.CCAlgorithmInfo `json:"cc_info,omitempty"`
+}
+
+// FromInfo builds the sample for info read at t
+func FromInfo(info *tcpinfo.Info, t time.Time) *Sample {
+	s := &Sample{
+		Time:             t,
+		State:            info.State,
+		RTT:              info.RTT,
+		RTTVar:           info.RTTVar,
+		RTO:              info.RTO,
+		ATO:              info.ATO,
+		SenderMSS:        uint(info.SenderMSS),
+		ReceiverMSS:      uint(info.ReceiverMSS),
+		LastDataSent:     info.LastDataSent,
+		LastDataReceived: info.LastDataReceived,
+		LastAckReceived:  info.LastAckReceived,
+	}
+	for _, o := range info.Options {
+		switch o := o.(type) {
+		case tcpinfo.SACKPermitted:
+			s.SACK = bool(o)
+		case tcpinfo.Timestamps:
+			s.Timestamps = bool(o)
+		case tcpinfo.WindowScale:
+			s.WindowScale = int(o)
+		}
+	}
+	for _, o := range info.PeerOptions {
+		if ws, ok := o.(tcpinfo.WindowScale); ok {
+			s.PeerWindowScale = int(ws)
+		}
+	}
+	if cc := info.CongestionControl; cc != nil {
+		s.SenderWindowSegs = cc.SenderWindowSegs
+		s.SenderWindowBytes = cc.SenderWindowBytes
+		s.SenderSSThreshold = cc.SenderSSThreshold
+		s.ReceiverSSThreshold = cc.ReceiverSSThreshold
+	}
+	if fc := info.FlowControl; fc != nil {
+		s.ReceiverWindow = fc.ReceiverWindow
+	}
+	s.fillSys(info)
+	return s
+}
+
+// setCC records the congestion control algorithm name, as the kernel
+// reports it padded with NULs, and its raw information
+func (s *Sample) setCC(name []byte, raw []byte) {
+	s.CCAlgorithm = strings.TrimRight(string(name), "\x00")
+	if len(raw) == 0 {
+		return
+	}
+	for _, prefix := range []string{"bbr", "dctcp", "vegas"} {
+		if strings.HasPrefix(s.CCAlgorithm, prefix) {
+			if info, err := tcpinfo.ParseCCAlgorithmInfo(s.CCAlgorithm, raw); err == nil {
+				s.CCInfo = info
+			}
+			return
+		}
+	}
+}
+
+// Delta is the change between two samples of one connection
+type Delta struct {
+	Interval time.Duration `json:"interval"`
+
+	RetransSegs   uint64 `json:"retrans_segs"`
+	BytesAcked    uint64 `json:"bytes_acked"`
+	BytesReceived uint64 `json:"bytes_rcvd"`
+	DataSegsOut   uint64 `json:"data_segs_out"`
+	DataSegsIn    uint64 `json:"data_segs_in"`
+
+	// RetransRate is retransmitted segments per second
+	RetransRate float64 `json:"retrans_rate"`
+	// RetransRatio is the share of data segments sent that were
+	// retransmissions
+	RetransRatio float64 `json:"retrans_ratio"`
+	// DeliveryRate is bytes acknowledged by the peer per second
+	DeliveryRate float64 `json:"delivery_rate"`
+	// ReceiveRate is bytes received from the peer per second
+	ReceiveRate float64 `json:"receive_rate"`
+}
+
+// Sub returns the change from prev to s. Counters that went backwards
+// are taken as reset and count from zero.
+func (s *Sample) Sub(prev *Sample) *Delta {
+	d := &Delta{
+		Interval:      s.Time.Sub(prev.Time),
+		RetransSegs:   counterDelta(uint64(s.TotalRetransSegs), uint64(prev.TotalRetransSegs)),
+		BytesAcked:    counterDelta(s.BytesAcked, prev.BytesAcked),
+		BytesReceived: counterDelta(s.BytesReceived, prev.BytesReceived),
+		DataSegsOut:   counterDelta(uint64(s.DataSegsOut), uint64(prev.DataSegsOut)),
+		DataSegsIn:    counterDelta(uint64(s.DataSegsIn), uint64(prev.DataSegsIn)),
+	}
+	if d.DataSegsOut > 0 {
+		d.RetransRatio = float64(d.RetransSegs) / float64(d.DataSegsOut)
+	}
+	if secs := d.Interval.Seconds(); secs > 0 {
+		d.RetransRate = float64(d.RetransSegs) / secs
+		d.DeliveryRate = float64(d.BytesAcked) / secs
+		d.ReceiveRate = float64(d.BytesReceived) / secs
+	}
+	return d
+}
+
+func counterDelta(cur, prev uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
@@ -0,0 +1,57 @@
+package sampler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mikioh/tcpinfo"
+)
+
+func TestFromInfo(t *testing.T) {
+	now := time.Now()
+	info := &tcpinfo.Info{
+		State:             tcpinfo.Established,
+		Options:           []tcpinfo.Option{tcpinfo.SACKPermitted(true), tcpinfo.WindowScale(7)},
+		PeerOptions:       []tcpinfo.Option{tcpinfo.WindowScale(9)},
+		SenderMSS:         1448,
+		RTT:               20 * time.Millisecond,
+		CongestionControl: &tcpinfo.CongestionControl{SenderWindowSegs: 10, SenderSSThreshold: 64},
+		FlowControl:       &tcpinfo.FlowControl{ReceiverWindow: 65535},
+	}
+	s := FromInfo(info, now)
+	if !s.Time.Equal(now) || s.State != tcpinfo.Established || s.RTT != 20*time.Millisecond {
+		t.Fatalf("bad sample: %+v", s)
+	}
+	if !s.SACK || s.Timestamps || s.WindowScale != 7 || s.PeerWindowScale != 9 {
+		t.Fatalf("bad options: %+v", s)
+	}
+	if s.SenderMSS != 1448 || s.SenderWindowSegs != 10 || s.SenderSSThreshold != 64 || s.ReceiverWindow != 65535 {
+		t.Fatalf("bad windows: %+v", s)
+	}
+}
+
+func TestSample_Sub(t *testing.T) {
+	start := time.Now()
+	prev := &Sample{Time: start, TotalRetransSegs: 2, BytesAcked: 1000, BytesReceived: 500, DataSegsOut: 10}
+	cur := &Sample{Time: start.Add(2 * time.Second), TotalRetransSegs: 6, BytesAcked: 9000, BytesReceived: 700, DataSegsOut: 50}
+
+	d := cur.Sub(prev)
+	if d.Interval != 2*time.Second || d.RetransSegs != 4 || d.BytesAcked != 8000 || d.BytesReceived != 200 {
+		t.Fatalf("bad delta: %+v", d)
+	}
+	if d.RetransRate != 2 || d.DeliveryRate != 4000 || d.ReceiveRate != 100 {
+		t.Fatalf("bad rates: %+v", d)
+	}
+	if d.RetransRatio != 0.1 {
+		t.Fatalf("bad retransmission ratio: %v", d.RetransRatio)
+	}
+}
+
+func TestSample_SubCounterReset(t *testing.T) {
+	start := time.Now()
+	prev := &Sample{Time: start, BytesAcked: 5000}
+	cur := &Sample{Time: start.Add(time.Second), BytesAcked: 300}
+	if d := cur.Sub(prev); d.BytesAcked != 300 {
+		t.Fatalf("bad delta after reset: %+v", d)
+	}
+}
@@ -0,0 +1,85 @@
+package sampler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mikioh/tcp"
+	"github.com/mikioh/tcpinfo"
+)
+
+// Read takes one sample from c
+func Read(c *tcp.Conn) (*Sample, error) {
+	return readAt(c, time.Now())
+}
+
+// readAt takes one sample from c stamped with t
+func readAt(c *tcp.Conn, t time.Time) (*Sample, error) {
+	var o tcpinfo.Info
+	var b [256]byte
+	opt, err := c.Option(o.Level(), o.Name(), b[:])
+	if err != nil {
+		return nil, err
+	}
+	info, ok := opt.(*tcpinfo.Info)
+	if !ok {
+		return nil, fmt.Errorf("unexpected TCP_INFO option %T", opt)
+	}
+	s := FromInfo(info, t)
+	readCC(c, s)
+	return s, nil
+}
+
+// readCC adds the congestion control algorithm of c to s where the
+// platform reports it
+func readCC(c *tcp.Conn, s *Sample) {
+	var algo tcpinfo.CCAlgorithm
+	var b [256]byte
+	opt, err := c.Option(algo.Level(), algo.Name(), b[:16])
+	if err != nil {
+		return
+	}
+	name, ok := opt.(tcpinfo.CCAlgorithm)
+	if !ok {
+		return
+	}
+	var cci tcpinfo.CCInfo
+	var raw []byte
+	if opt, err := c.Option(cci.Level(), cci.Name(), b[:]); err == nil {
+		if info, ok := opt.(*tcpinfo.CCInfo); ok {
+			raw = info.Raw
+		}
+	}
+	s.setCC([]byte(name), raw)
+}
+
+// Sampler takes successive samples from one connection
+type Sampler struct {
+	conn *tcp.Conn
+	last *Sample
+}
+
+// New returns a Sampler for c
+func New(c *tcp.Conn) *Sampler {
+	return &Sampler{conn: c}
+}
+
+// Next takes a sample and returns it with the change since the
+// previous one. The delta of the first sample is nil.
+func (s *Sampler) Next() (*Sample, *Delta, error) {
+	sample, err := Read(s.conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	var d *Delta
+	if s.last != nil {
+		d = sample.Sub(s.last)
+	}
+	s.last = sample
+	return sample, d, nil
+}
+
+// Last returns the most recent sample, or nil before the first one
+func (s *Sampler) Last() *Sample {
+	return s.last
+}
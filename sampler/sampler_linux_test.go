@@ -0,0 +1,67 @@
+package sampler
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/mikioh/tcp"
+	"github.com/mikioh/tcpinfo"
+)
+
+func TestSampler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	tc, err := tcp.NewConn(conn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	smp := New(tc)
+	first, d, err := smp.Next()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d != nil {
+		t.Fatalf("the first sample has no delta")
+	}
+	if first.State != tcpinfo.Established || first.SenderMSS == 0 || first.CCAlgorithm == "" {
+		t.Fatalf("bad sample: %+v", first)
+	}
+
+	payload := make([]byte, 256<<10)
+	if _, err := tc.Write(payload); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	second, d, err := smp.Next()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if d == nil || d.Interval <= 0 {
+		t.Fatalf("bad delta: %+v", d)
+	}
+	if second.BytesAcked+uint64(second.NotSentBytes)+uint64(second.UnackedSegs)*uint64(second.SenderMSS) == 0 {
+		t.Fatalf("no progress recorded: %+v", second)
+	}
+	if smp.Last() != second {
+		t.Fatalf("Last does not return the latest sample")
+	}
+}
@@ -0,0 +1,246 @@
+package sampler
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/mikioh/tcp"
+)
+
+// Func receives each sample taken by a Service with the change since
+// the previous one, nil for the first
+type Func func(*Sample, *Delta)
+
+// Service samples many connections in batches on one shared ticker.
+// Connections are spread over a fixed number of shards, each sampled
+// by its own worker, and every sample of a tick carries the same
+// timestamp. A random delay added to each interval keeps the ticks
+// from falling in step with periodic traffic. The ticker and workers
+// only run while connections are registered.
+type Service struct {
+	interval time.Duration
+	jitter   time.Duration
+	shards   []*shard
+
+	mu      sync.Mutex
+	nextID  uint64
+	count   int
+	stop    chan struct{}
+	stopped chan struct{}
+	overrun uint64
+}
+
+// shard is the part of the registry sampled by one worker
+type shard struct {
+	mu      sync.Mutex
+	entries map[uint64]*Handle
+}
+
+// Handle is a connection registered with a Service
+type Handle struct {
+	svc   *Service
+	id    uint64
+	conn  *tcp.Conn
+	fn    Func
+	mu    sync.Mutex
+	first *Sample
+	last  *Sample
+	done  bool
+	gone  chan struct{}
+}
+
+// NewService returns a Service sampling every interval plus a random
+// delay of up to jitter with the given number of workers, one per CPU
+// when workers is not positive
+func NewService(interval, jitter time.Duration, workers int) *Service {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	s := &Service{interval: interval, jitter: jitter, shards: make([]*shard, workers)}
+	for i := range s.shards {
+		s.shards[i] = &shard{entries: make(map[uint64]*Handle)}
+	}
+	return s
+}
+
+// Register adds c to the service. fn is called from a worker with
+// every sample until the handle is closed or reading c fails, and must
+// not close the handle itself.
+func (s *Service) Register(c *tcp.Conn, fn Func) *Handle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := &Handle{svc: s, id: s.nextID, conn: c, fn: fn, gone: make(chan struct{})}
+	s.nextID++
+	sh := s.shards[h.id%uint64(len(s.shards))]
+	sh.mu.Lock()
+	sh.entries[h.id] = h
+	sh.mu.Unlock()
+	s.count++
+	if s.count == 1 {
+		s.start()
+	}
+	return h
+}
+
+// Len returns the number of registered connections
+func (s *Service) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Overruns returns how many times a worker was still busy with the
+// previous tick and skipped one
+func (s *Service) Overruns() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.overrun
+}
+
+// remove unregisters h, stopping the ticker with the last connection
+func (s *Service) remove(h *Handle) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh := s.shards[h.id%uint64(len(s.shards))]
+	sh.mu.Lock()
+	_, ok := sh.entries[h.id]
+	delete(sh.entries, h.id)
+	sh.mu.Unlock()
+	if !ok {
+		return
+	}
+	close(h.gone)
+	s.count--
+	if s.count == 0 {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// start runs the ticker and the workers, called with s.mu held
+func (s *Service) start() {
+	stop := make(chan struct{})
+	s.stop = stop
+	ticks := make([]chan time.Time, len(s.shards))
+	for i, sh := range s.shards {
+		ticks[i] = make(chan time.Time, 1)
+		go sh.work(ticks[i], stop)
+	}
+	go func() {
+		timer := time.NewTimer(s.wait())
+		defer timer.Stop()
+		s.tick(ticks, time.Now())
+		for {
+			select {
+			case <-stop:
+				return
+			case t := <-timer.C:
+				s.tick(ticks, t)
+				timer.Reset(s.wait())
+			}
+		}
+	}()
+}
+
+// wait returns the time until the next tick
+func (s *Service) wait() time.Duration {
+	wait := s.interval
+	if s.jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(s.jitter)))
+	}
+	return wait
+}
+
+// tick hands t to every worker that is ready for it
+func (s *Service) tick(ticks []chan time.Time, t time.Time) {
+	for _, c := range ticks {
+		select {
+		case c <- t:
+		default:
+			s.mu.Lock()
+			s.overrun++
+			s.mu.Unlock()
+		}
+	}
+}
+
+// work samples the shard on every tick until stop is closed
+func (sh *shard) work(ticks <-chan time.Time, stop <-chan struct{}) {
+	var batch []*Handle
+	for {
+		select {
+		case <-stop:
+			return
+		case t := <-ticks:
+			sh.mu.Lock()
+			batch = batch[:0]
+			for _, h := range sh.entries {
+				batch = append(batch, h)
+			}
+			sh.mu.Unlock()
+			for _, h := range batch {
+				h.sample(t)
+			}
+		}
+	}
+}
+
+// sample takes one reading stamped t and passes it on, unregistering
+// the handle when the connection can no longer be read
+func (h *Handle) sample(t time.Time) {
+	h.mu.Lock()
+	if h.done {
+		h.mu.Unlock()
+		return
+	}
+	sample, err := readAt(h.conn, t)
+	if err != nil {
+		h.done = true
+		h.mu.Unlock()
+		h.svc.remove(h)
+		return
+	}
+	var d *Delta
+	if h.last != nil {
+		d = sample.Sub(h.last)
+	}
+	if h.first == nil {
+		h.first = sample
+	}
+	h.last = sample
+	if h.fn != nil {
+		h.fn(sample, d)
+	}
+	h.mu.Unlock()
+}
+
+// Done returns a channel closed once the connection is unregistered,
+// by Close or because it could no longer be read
+func (h *Handle) Done() <-chan struct{} {
+	return h.gone
+}
+
+// Close unregisters the connection and returns a final sample with the
+// change over the whole registration. The last sample taken stands in
+// when the connection can no longer be read; both are nil if none was.
+func (h *Handle) Close() (*Sample, *Delta) {
+	h.svc.remove(h)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	final := h.last
+	if !h.done {
+		h.done = true
+		if sample, err := Read(h.conn); err == nil {
+			final = sample
+		}
+	}
+	if final == nil {
+		return nil, nil
+	}
+	if h.first == nil {
+		return final, nil
+	}
+	return final, final.Sub(h.first)
+}
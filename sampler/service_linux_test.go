@@ -0,0 +1,146 @@
+package sampler
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mikioh/tcp"
+)
+
+// dialSink returns n connections to a server discarding what they send
+func dialSink(t *testing.T, n int) []*tcp.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	var conns []*tcp.Conn
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		tc, err := tcp.NewConn(conn)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conns = append(conns, tc)
+	}
+	return conns
+}
+
+func TestService(t *testing.T) {
+	conns := dialSink(t, 8)
+	svc := NewService(10*time.Millisecond, 5*time.Millisecond, 3)
+
+	var mu sync.Mutex
+	times := make(map[int][]time.Time)
+	var handles []*Handle
+	for i, tc := range conns {
+		i := i
+		handles = append(handles, svc.Register(tc, func(s *Sample, d *Delta) {
+			mu.Lock()
+			times[i] = append(times[i], s.Time)
+			mu.Unlock()
+		}))
+	}
+	if svc.Len() != len(conns) {
+		t.Fatalf("bad registry size: %d", svc.Len())
+	}
+
+	// Wait until every connection has been sampled a few times
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		ready := len(times) == len(conns)
+		for _, ts := range times {
+			ready = ready && len(ts) >= 3
+		}
+		mu.Unlock()
+		if ready {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connections not sampled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Samples of one tick share their timestamp
+	mu.Lock()
+	ticks := make(map[time.Time]int)
+	for _, ts := range times {
+		for _, tm := range ts {
+			ticks[tm]++
+		}
+	}
+	mu.Unlock()
+	shared := false
+	for _, n := range ticks {
+		shared = shared || n > 1
+	}
+	if !shared {
+		t.Fatalf("no timestamp shared across connections")
+	}
+
+	final, d := handles[0].Close()
+	if final == nil || d == nil || d.Interval <= 0 {
+		t.Fatalf("bad summary: %+v %+v", final, d)
+	}
+	select {
+	case <-handles[0].Done():
+	default:
+		t.Fatalf("closed handle not done")
+	}
+
+	// A connection that can no longer be read drops out on its own
+	conns[1].Close()
+	select {
+	case <-handles[1].Done():
+	case <-time.After(time.Second):
+		t.Fatalf("closed connection still registered")
+	}
+	if final, _ := handles[1].Close(); final == nil {
+		t.Fatalf("missing last sample of a closed connection")
+	}
+
+	for _, h := range handles[2:] {
+		h.Close()
+	}
+	if svc.Len() != 0 {
+		t.Fatalf("registry not empty: %d", svc.Len())
+	}
+
+	// The service starts again with the next registration
+	got := make(chan struct{}, 1)
+	h := svc.Register(conns[2], func(*Sample, *Delta) {
+		select {
+		case got <- struct{}{}:
+		default:
+		}
+	})
+	defer h.Close()
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Fatalf("service not restarted")
+	}
+}
@@ -0,0 +1,18 @@
+package sampler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServiceWait(t *testing.T) {
+	s := NewService(time.Second, 100*time.Millisecond, 1)
+	for i := 0; i < 100; i++ {
+		if w := s.wait(); w < time.Second || w >= 1100*time.Millisecond {
+			t.Fatalf("wait out of range: %v", w)
+		}
+	}
+	if w := NewService(time.Second, 0, 1).wait(); w != time.Second {
+		t.Fatalf("bad wait without jitter: %v", w)
+	}
+}
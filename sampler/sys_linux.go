@@ -0,0 +1,32 @@
+package sampler
+
+import "github.com/mikioh/tcpinfo"
+
+func (s *Sample) fillSys(info *tcpinfo.Info) {
+	sys := info.Sys
+	if sys == nil {
+		return
+	}
+	s.PathMTU = sys.PathMTU
+	s.AdvertisedMSS = uint(sys.AdvertisedMSS)
+	s.CAState = int(sys.CAState)
+	s.Retransmissions = sys.Retransmissions
+	s.Backoffs = sys.Backoffs
+	s.UnackedSegs = sys.UnackedSegs
+	s.SackedSegs = sys.SackedSegs
+	s.LostSegs = sys.LostSegs
+	s.RetransSegs = sys.RetransSegs
+	s.ReorderedSegs = sys.ReorderedSegs
+	s.ReceiverRTT = sys.ReceiverRTT
+	s.MinRTT = sys.MinRTT
+	s.TotalRetransSegs = sys.TotalRetransSegs
+	s.PacingRate = sys.PacingRate
+	s.BytesAcked = sys.ThruBytesAcked
+	s.BytesReceived = sys.ThruBytesReceived
+	s.SegsOut = sys.SegsOut
+	s.SegsIn = sys.SegsIn
+	s.DataSegsOut = sys.DataSegsOut
+	s.DataSegsIn = sys.DataSegsIn
+	s.NotSentBytes = sys.NotSentBytes
+	s.WindowProbes = sys.WindowOrKeepAliveProbes
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package sampler
+
+import "github.com/mikioh/tcpinfo"
+
+// fillSys leaves the Linux only fields zero
+func (s *Sample) fillSys(info *tcpinfo.Info) {}
@@ -0,0 +1,160 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// CloseReason says how one direction of a relayed session ended
+type CloseReason string
+
+const (
+	// CloseEOF means the source half-closed, which was passed on as FIN
+	CloseEOF CloseReason = "eof"
+	// CloseReset means one end reset the connection, which was passed
+	// on to the other end as RST
+	CloseReset CloseReason = "reset"
+	// CloseError means reading or writing failed for another reason
+	CloseError CloseReason = "error"
+	// ClosePeer means the opposite direction tore the session down
+	ClosePeer CloseReason = "peer"
+	// CloseIdleTimeout, CloseLifetime and CloseLinger mean the session
+	// was closed by IdleTimeout, MaxSessionLifetime or LingerTimeout
+	CloseIdleTimeout CloseReason = "idle-timeout"
+	CloseLifetime    CloseReason = "lifetime"
+	CloseLinger      CloseReason = "linger-timeout"
+)
+
+// DirectionResult is the outcome of one direction of a session
+type DirectionResult struct {
+	// Bytes relayed in this direction
+	Bytes  int64
+	Reason CloseReason
+	// Err is what ended the direction, nil for a clean EOF
+	Err error
+}
+
+// SessionResult reports how a CONNECT session ended. Upload carries
+// the client's traffic to the destination, Download the reverse.
+type SessionResult struct {
+	Upload   DirectionResult
+	Download DirectionResult
+
+	first error
+}
+
+// err returns the failure that ended the session, if any
+func (r SessionResult) err() error {
+	return r.first
+}
+
+// relaySession relays both directions between client and target. A
+// direction that reaches EOF is passed on as FIN and the other one may
+// continue for up to LingerTimeout. A reset is passed on as RST, any
+// other failure closes both sides.
+func (s *Server) relaySession(client conn, target net.Conn, clientReader io.Reader, timers *sessionTimers) SessionResult {
+	type outcome struct {
+		upload bool
+		n      int64
+		err    error
+	}
+	done := make(chan outcome, 2)
+	go func() {
+		n, err := relay(target, clientReader, timers.touch)
+		done <- outcome{true, n, err}
+	}()
+	go func() {
+		n, err := relay(client, target, timers.touch)
+		done <- outcome{false, n, err}
+	}()
+
+	var res SessionResult
+	torn := false
+	for i := 0; i < 2; i++ {
+		o := <-done
+		var dst, src interface{} = client, target
+		d := &res.Download
+		if o.upload {
+			dst, src = target, client
+			d = &res.Upload
+		}
+		d.Bytes, d.Err = o.n, o.err
+
+		switch {
+		case timers.reason() != nil:
+			d.Reason = timerCloseReason(timers.reason())
+		case torn:
+			d.Reason = ClosePeer
+		case o.err == nil:
+			d.Reason = CloseEOF
+			closeWrite(dst)
+			timers.linger(s.config.LingerTimeout)
+		case isReset(o.err):
+			d.Reason = CloseReset
+			// Reset whichever end did not send the reset
+			if readFailed(o.err) {
+				abort(dst)
+			} else {
+				abort(src)
+			}
+			torn = true
+			timers.closeFn()
+		default:
+			d.Reason = CloseError
+			torn = true
+			timers.closeFn()
+		}
+		if res.first == nil && (d.Reason == CloseReset || d.Reason == CloseError) {
+			res.first = d.Err
+		}
+	}
+	return res
+}
+
+// timerCloseReason maps a session timer cause to a CloseReason
+func timerCloseReason(cause error) CloseReason {
+	switch cause {
+	case IdleTimeoutExceeded:
+		return CloseIdleTimeout
+	case SessionLifetimeExceeded:
+		return CloseLifetime
+	case LingerTimeoutExceeded:
+		return CloseLinger
+	}
+	return CloseError
+}
+
+// closeWrite sends FIN on c, looking through wrappers that hide
+// CloseWrite
+func closeWrite(c interface{}) error {
+	if cw, ok := c.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	if tc, ok := tcpConnOf(c); ok {
+		return tc.CloseWrite()
+	}
+	return nil
+}
+
+// abort closes c with SO_LINGER set to zero so the peer sees RST
+func abort(c interface{}) {
+	if tc, ok := tcpConnOf(c); ok {
+		tc.SetLinger(0)
+	}
+	if cl, ok := c.(io.Closer); ok {
+		cl.Close()
+	}
+}
+
+// isReset reports whether err was caused by a connection reset
+func isReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// readFailed reports whether a relay error came from its source
+func readFailed(err error) bool {
+	var re *relayError
+	return errors.As(err, &re) && re.Op == "read"
+}
@@ -0,0 +1,135 @@
+package socks5
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sessionFixture relays between two loopback pairs and returns the
+// peers standing in for the client and the destination
+type sessionFixture struct {
+	client, target         *net.TCPConn
+	clientPeer, targetPeer *net.TCPConn
+	result                 chan SessionResult
+}
+
+func startSession(t *testing.T, conf *Config) *sessionFixture {
+	f := &sessionFixture{result: make(chan SessionResult, 1)}
+	f.clientPeer, f.client = tcpPair(t)
+	f.target, f.targetPeer = tcpPair(t)
+	s := &Server{config: conf}
+	timers := newSessionTimers(conf.IdleTimeout, conf.MaxSessionLifetime, func() {
+		f.client.Close()
+		f.target.Close()
+	})
+	go func() {
+		defer timers.stop()
+		f.result <- s.relaySession(f.client, f.target, f.client, timers)
+	}()
+	return f
+}
+
+func (f *sessionFixture) wait(t *testing.T) SessionResult {
+	select {
+	case res := <-f.result:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session did not end")
+	}
+	return SessionResult{}
+}
+
+func (f *sessionFixture) close() {
+	f.clientPeer.Close()
+	f.targetPeer.Close()
+}
+
+func TestSession_HalfClose(t *testing.T) {
+	f := startSession(t, &Config{})
+	defer f.close()
+
+	// The client sends its request and half-closes
+	f.clientPeer.Write([]byte("ping"))
+	f.clientPeer.CloseWrite()
+
+	// The destination sees the FIN and still answers
+	in, err := ioutil.ReadAll(f.targetPeer)
+	if err != nil || string(in) != "ping" {
+		t.Fatalf("bad upload: %q %v", in, err)
+	}
+	f.targetPeer.Write([]byte("pong"))
+	f.targetPeer.CloseWrite()
+
+	out, err := ioutil.ReadAll(f.clientPeer)
+	if err != nil || string(out) != "pong" {
+		t.Fatalf("bad download: %q %v", out, err)
+	}
+
+	res := f.wait(t)
+	if res.Upload.Reason != CloseEOF || res.Download.Reason != CloseEOF {
+		t.Fatalf("bad reasons: %+v", res)
+	}
+	if res.Upload.Bytes != 4 || res.Download.Bytes != 4 {
+		t.Fatalf("bad byte counts: %+v", res)
+	}
+	if res.err() != nil {
+		t.Fatalf("err: %v", res.err())
+	}
+}
+
+func TestSession_ResetPropagates(t *testing.T) {
+	f := startSession(t, &Config{})
+	defer f.close()
+
+	// The destination resets the connection
+	f.targetPeer.SetLinger(0)
+	f.targetPeer.Close()
+
+	res := f.wait(t)
+	if res.Download.Reason != CloseReset {
+		t.Fatalf("bad download reason: %+v", res.Download)
+	}
+	if res.Upload.Reason != ClosePeer {
+		t.Fatalf("bad upload reason: %+v", res.Upload)
+	}
+	if !isReset(res.err()) {
+		t.Fatalf("expected a reset error, got %v", res.err())
+	}
+
+	// The client must see the reset too, not a clean EOF
+	f.clientPeer.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := f.clientPeer.Read(make([]byte, 1))
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("expected a reset on the client, got %v", err)
+	}
+}
+
+func TestSession_LingerTimeout(t *testing.T) {
+	f := startSession(t, &Config{LingerTimeout: 50 * time.Millisecond})
+	defer f.close()
+
+	// The client is done, but the destination never finishes
+	f.clientPeer.CloseWrite()
+
+	res := f.wait(t)
+	if res.Upload.Reason != CloseEOF {
+		t.Fatalf("bad upload reason: %+v", res.Upload)
+	}
+	if res.Download.Reason != CloseLinger {
+		t.Fatalf("bad download reason: %+v", res.Download)
+	}
+}
+
+func TestSession_IdleTimeout(t *testing.T) {
+	f := startSession(t, &Config{IdleTimeout: 50 * time.Millisecond})
+	defer f.close()
+
+	res := f.wait(t)
+	if res.Upload.Reason != CloseIdleTimeout || res.Download.Reason != CloseIdleTimeout {
+		t.Fatalf("bad reasons: %+v", res)
+	}
+}
@@ -3,16 +3,17 @@ package socks5
 import (
 	"bufio"
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"os"
-	"os/exec"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/kennnnny/RRDproxy/sampler"
 	"github.com/mikioh/tcp"
-	"github.com/mikioh/tcpinfo"
 )
 
 const (
@@ -33,10 +34,24 @@ type Config struct {
 
 	// Resolver can be provided to do custom name resolution.
 	// Defaults to DNSResolver if not provided.
+	// Resolvers implementing MultiResolver let CONNECT race every
+	// address of a destination.
 	Resolver NameResolver
 
+	// IPPreference selects which address families of a resolved
+	// destination are dialed, and which one is tried first.
+	// Defaults to PreferIPv4.
+	IPPreference IPPreference
+
+	// FallbackDelay is how long a connection attempt to one address may
+	// run before the next address is tried in parallel.
+	// Defaults to 250ms.
+	FallbackDelay time.Duration
+
 	// Rules is provided to enable custom logic around permitting
-	// various commands. If not provided, PermitAll is used.
+	// various commands. If not provided, PermitAll is used. Rules see
+	// destinations given by name before they are resolved, since the
+	// dialer they pick decides whether to resolve them locally.
 	Rules RuleSet
 
 	// Rewriter can be used to transparently rewrite addresses.
@@ -53,64 +68,110 @@ type Config struct {
 
 	// Optional function for dialing out
 	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
-}
 
-//MyData is OutPut Data Structure
-type MyData struct {
-	Ato     time.Duration `json:"ato"`
-	CongCtl struct {
-		SSthresh          uint `json:"snd_ssthresh"`
-		RcvThresh         uint `json:"rcv_ssthresh"`
-		SenderWindowBytes uint `json:"snd_cwnd_bytes"`
-		SenderWindowSegs  uint `json:"snd_cwnd_segs"`
-	} `json:"cong_ctl"`
-	FlowControl struct {
-		ReceiverWindow uint `json:"rcv_wnd"`
-	} `json:"flow_ctl"`
-	LastDataReceived time.Duration `json:"last_data_rcvd"` // since last data received [FreeBSD and Linux]
-	LastAckReceived  time.Duration `json:"last_ack_rcvd"`  // since last ack received [Linux only]
-	LastDataSent     time.Duration `json:"last_data_sent"` // since last data sent [Linux only]
-	Opts             struct {
-		SACKPermitted bool `json:"sack"`
-		Timestamps    bool `json:"tmstamps"`
-		WindowScale   int  `json:"wscale"`
-	} `json:"opts"`
-	PeerOpts struct {
-		SACKPermitted bool `json:"sack"`
-		Timestamps    bool `json:"tmstamps"`
-		WindowScale   int  `json:"wscale"`
-	} `json:"peer_opts"`
-	ReceiverMSS uint          `json:"rcv_mss"`
-	RTO         time.Duration `json:"rto"`
-	RTT         time.Duration `json:"rtt"`
-	RTTVar      time.Duration `json:"rttvar"`
-	SenderMSS   uint          `json:"snd_mss"`
-	State       string        `json:"state"`
-	System      struct {
-		PathMTU                 uint          `json:"path_mtu"`           // path maximum transmission unit
-		AdvertisedMSS           uint          `json:"adv_mss"`            // advertised maximum segment size
-		CAState                 int           `json:"ca_state"`           // state of congestion avoidance
-		Retransmissions         uint          `json:"rexmits"`            // # of retranmissions on timeout invoked
-		Backoffs                uint          `json:"backoffs"`           // # of times retransmission backoff timer invoked
-		WindowOrKeepAliveProbes uint          `json:"wnd_ka_probes"`      // # of window or keep alive probes sent
-		UnackedSegs             uint          `json:"unacked_segs"`       // # of unack'd segments
-		SackedSegs              uint          `json:"sacked_segs"`        // # of sack'd segments
-		LostSegs                uint          `json:"lost_segs"`          // # of lost segments
-		RetransSegs             uint          `json:"retrans_segs"`       // # of retransmitting segments in transmission queue
-		ForwardAckSegs          uint          `json:"fack_segs"`          // # of forward ack segments in transmission queue
-		ReorderedSegs           uint          `json:"reord_segs"`         // # of reordered segments allowed
-		ReceiverRTT             time.Duration `json:"rcv_rtt"`            // current RTT for receiver
-		TotalRetransSegs        uint          `json:"total_retrans_segs"` // # of retransmitted segments
-		PacingRate              uint64        `json:"pacing_rate"`        // pacing rate
-		ThruBytesAcked          uint64        `json:"thru_bytes_acked"`   // # of bytes for which cumulative acknowledgments have been received
-		ThruBytesReceived       uint64        `json:"thru_bytes_rcvd"`    // # of bytes for which cumulative acknowledgments have been sent
-		SegsOut                 uint          `json:"segs_out"`           // # of segments sent
-		SegsIn                  uint          `json:"segs_in"`            // # of segments received
-		NotSentBytes            uint          `json:"not_sent_bytes"`     // # of bytes not sent yet
-		MinRTT                  time.Duration `json:"min_rtt"`            // current measured minimum RTT; zero means not available
-		DataSegsOut             uint          `json:"data_segs_out"`      // # of segments sent containing a positive length data segment
-		DataSegsIn              uint          `json:"data_segs_in"`       // # of segments received containing a positive length data segment
-	} `json:"sys"`
+	// Dialer is used for dialing out instead of Dial when set. When it
+	// reaches a destination through an upstream proxy, as UpstreamProxy,
+	// UpstreamPool and RouteDialer routes to them do, names are handed
+	// to the proxy to resolve and dialed once, not resolved locally.
+	Dialer Dialer
+
+	// ClassifyError can map resolve and dial errors to a category,
+	// which decides the reply code sent to the client. Returning an
+	// empty category falls back to ClassifyError.
+	ClassifyError func(err error) ErrorCategory
+
+	// ErrorReplies sets the RFC 1928 reply code (1 to 8) sent for a
+	// category, overriding the default, so that categories returned by
+	// ClassifyError can have their own code. Categories with no code
+	// are answered with a general server failure.
+	ErrorReplies map[ErrorCategory]uint8
+
+	// HandshakeTimeout bounds the time a client may take to send the
+	// version, authentication and request messages. Zero means no limit.
+	HandshakeTimeout time.Duration
+
+	// DialTimeout bounds the time spent connecting to the destination.
+	// A dial that runs out of time is answered with ttlExpired.
+	// Zero means no limit.
+	DialTimeout time.Duration
+
+	// IdleTimeout closes a session when no data has been relayed in
+	// either direction for this long. Zero means no limit.
+	IdleTimeout time.Duration
+
+	// MaxSessionLifetime closes a session this long after the success
+	// reply was sent, regardless of activity. Zero means no limit.
+	MaxSessionLifetime time.Duration
+
+	// LingerTimeout bounds how long one direction of a session may keep
+	// running after the other has finished. Zero leaves it to the idle
+	// and lifetime limits.
+	LingerTimeout time.Duration
+
+	// SessionClosed is called with the outcome of each direction once
+	// a CONNECT session has ended.
+	SessionClosed func(req *Request, res SessionResult)
+
+	// MaxConnections caps the connections served at once across all
+	// listeners of the server. Connections over the cap are closed as
+	// soon as they are accepted. Zero means no limit.
+	MaxConnections int
+
+	// DisableMonitor turns off the TCP_INFO monitors started for the
+	// client and upstream connections once a session is established.
+	DisableMonitor bool
+
+	// Tuner optionally sets socket options on the legs of a session
+	// by destination. A RuleSet can override it with WithSocketTuning.
+	Tuner *SocketTuner
+
+	// BufferGrowth optionally grows the socket buffers of monitored
+	// legs along with their bandwidth-delay product.
+	BufferGrowth *BufferGrowth
+
+	// PathProfiles optionally learns from the upstream leg of each
+	// monitored session and starts later connections to the same
+	// destination prefix with the MSS and congestion control learned.
+	PathProfiles *PathProfiles
+
+	// MTUProber optionally searches for the largest MSS that gets
+	// through to each upstream destination after MTU blackholes.
+	MTUProber *MTUProber
+
+	// CongestionSwitch optionally changes the congestion control
+	// algorithm of monitored legs whose samples match it.
+	CongestionSwitch *CongestionSwitch
+
+	// Sampler takes the samples of every monitored session on one
+	// shared ticker. If nil, New creates one sampling every
+	// MonitorInterval, 500ms by default, plus a random delay of up to
+	// MonitorJitter, with MonitorWorkers workers, one per CPU by
+	// default.
+	Sampler         *sampler.Service
+	MonitorInterval time.Duration
+	MonitorJitter   time.Duration
+	MonitorWorkers  int
+
+	// MonitorSample receives the samples taken by the monitors, which
+	// are otherwise only seen by the alerts, tuning and learning they
+	// feed.
+	MonitorSample func(LegSample)
+
+	// Alerts optionally judges the samples of every monitored leg,
+	// including those MonitorHost reports, and raises alerts when one
+	// degrades.
+	Alerts *AlertDetector
+
+	// DisableMSSClamp leaves the iptables mangle table alone. Otherwise
+	// a TCPMSS rule clamping to MSS is installed when the first TCP
+	// connection is accepted. While legs stall like an MTU blackhole
+	// the monitor lowers it to RetransmitMSS, and restores it once the
+	// last of them recovers or ends. Upstream legs leave it alone when
+	// an MTUProber learns their destinations instead.
+	// They default to 1400 and 200.
+	DisableMSSClamp bool
+	MSS             int
+	RetransmitMSS   int
 }
 
 // Server is reponsible for accepting connections and handling
@@ -118,6 +179,17 @@ type MyData struct {
 type Server struct {
 	config      *Config
 	authMethods map[uint8]Authenticator
+
+	// reloaded holds the *reloadState of the latest Reload
+	reloaded atomic.Value
+	reloadMu sync.Mutex
+
+	// active counts connections being served
+	active int64
+
+	// listener is the name of the Listener this server was configured
+	// for by forListener
+	listener string
 }
 
 // New creates a new Server and potentially returns an error
@@ -145,6 +217,25 @@ func New(conf *Config) (*Server, error) {
 	if conf.Logger == nil {
 		conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
 	}
+	if conf.PathProfiles != nil {
+		conf.PathProfiles.setLogger(conf.Logger)
+	}
+
+	// Ensure we have a shared sampler
+	if conf.MonitorInterval == 0 {
+		conf.MonitorInterval = 500 * time.Millisecond
+	}
+	if conf.Sampler == nil {
+		conf.Sampler = sampler.NewService(conf.MonitorInterval, conf.MonitorJitter, conf.MonitorWorkers)
+	}
+
+	// Ensure we have MSS clamp values
+	if conf.MSS == 0 {
+		conf.MSS = 1400
+	}
+	if conf.RetransmitMSS == 0 {
+		conf.RetransmitMSS = 200
+	}
 
 	server := &Server{
 		config: conf,
@@ -159,6 +250,61 @@ func New(conf *Config) (*Server, error) {
 	return server, nil
 }
 
+// Reload replaces the configuration used for connections accepted from
+// now on. Connections already being served keep the one they started
+// with. The policies of listeners given by name replace those of the
+// served Listeners with the same name, while their other fields are
+// ignored; listeners not named keep their policy.
+func (s *Server) Reload(conf *Config, policies ...*Listener) error {
+	next, err := New(conf)
+	if err != nil {
+		return err
+	}
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	st := &reloadState{server: next, policies: make(map[string]*Listener)}
+	if prev, ok := s.reloaded.Load().(*reloadState); ok {
+		for name, l := range prev.policies {
+			st.policies[name] = l
+		}
+	}
+	for _, l := range policies {
+		st.policies[l.Name] = l
+	}
+	s.reloaded.Store(st)
+	return nil
+}
+
+// reloadState is what a Reload swaps in at once
+type reloadState struct {
+	server   *Server
+	policies map[string]*Listener
+}
+
+// current returns the server holding the configuration for a new
+// connection
+func (s *Server) current() *Server {
+	if st, ok := s.reloaded.Load().(*reloadState); ok {
+		return st.server
+	}
+	return s
+}
+
+// currentFor returns the server and the policy for a new connection
+// accepted from l
+func (s *Server) currentFor(l *Listener) (*Server, *Listener) {
+	st, ok := s.reloaded.Load().(*reloadState)
+	if !ok {
+		return s, l
+	}
+	if l != nil && l.Name != "" {
+		if policy, ok := st.policies[l.Name]; ok {
+			return st.server, policy
+		}
+	}
+	return st.server, l
+}
+
 // ListenAndServe is used to create a listener and serve on it
 func (s *Server) ListenAndServe(network, addr string) error {
 	l, err := net.Listen(network, addr)
@@ -170,43 +316,79 @@ func (s *Server) ListenAndServe(network, addr string) error {
 
 // Serve is used to serve connections from a listener
 func (s *Server) Serve(l net.Listener) error {
+	return s.serve(l, nil, func(srv *Server, conn net.Conn) error { return srv.ServeConn(conn) })
+}
+
+// serve accepts connections, sets up MSS clamping for each TCP one and
+// hands it to handle along with the server configured for policy
+func (s *Server) serve(l net.Listener, policy *Listener, handle func(srv *Server, conn net.Conn) error) error {
+	// The listener's server is built again only after a reload
+	var base, cur *Server
+	var basePolicy *Listener
 	for {
 		conn, err := l.Accept()
 		if err != nil {
 			return err
 		}
 
-		tc, err := tcp.NewConn(conn)
-		if err != nil {
-			log.Fatal(err)
+		if next, p := s.currentFor(policy); next != base || p != basePolicy {
+			base, basePolicy, cur = next, p, next.forListener(p)
+		}
+		if n := atomic.AddInt64(&s.active, 1); cur.config.MaxConnections > 0 && n > int64(cur.config.MaxConnections) {
+			atomic.AddInt64(&s.active, -1)
+			cur.config.Logger.Printf("[ERR] socks: Connection limit of %d reached, closing connection from %v", cur.config.MaxConnections, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		// Unix sockets have nothing to clamp or monitor, TLS
+		// connections are monitored on the TCP connection beneath
+		var tc *tcp.Conn
+		raw := conn
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			raw = tlsConn.NetConn()
 		}
-		//delete all rules first
-		deletecmd := exec.Command("iptables", "-t", "mangle", "-F")
-		deletecmd.Stderr = os.Stderr
-		deletecmd.Stdout = os.Stdout
-		if err := deletecmd.Start(); err != nil {
-			fmt.Println("delete", err)
+		if _, ok := raw.(*net.TCPConn); ok {
+			if tc, err = tcp.NewConn(raw); err != nil {
+				cur.config.Logger.Printf("[ERR] socks: %v", err)
+				conn.Close()
+				atomic.AddInt64(&s.active, -1)
+				continue
+			}
+			if raw == conn {
+				conn = tc
+			}
 		}
-		//add a normal TCPMSS rule
-		addcmd := exec.Command("iptables", "-t", "mangle", "-I", "POSTROUTING", "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS", "--set-mss", "1400")
-		addcmd.Stderr = os.Stderr
-		addcmd.Stdout = os.Stdout
-		if err := addcmd.Start(); err != nil {
-			fmt.Println("add:", err)
+		if tc != nil && !cur.config.DisableMSSClamp {
+			if err := clamp.ensure(cur.config.MSS); err != nil {
+				cur.config.Logger.Printf("[ERR] socks: Failed to install the MSS clamp: %v", err)
+			}
 		}
-		go s.Monitor(tc)
-		go s.ServeConn(tc)
+		go func() {
+			defer atomic.AddInt64(&s.active, -1)
+			handle(cur, conn)
+		}()
 	}
 }
 
 // ServeConn is used to serve a single connection.
 func (s *Server) ServeConn(conn net.Conn) error {
+	s = s.current()
 	defer conn.Close()
 	bufConn := bufio.NewReader(conn)
 
+	// Bound the whole negotiation, the deadline is lifted once the
+	// request has been read
+	var deadline time.Time
+	if s.config.HandshakeTimeout > 0 {
+		deadline = time.Now().Add(s.config.HandshakeTimeout)
+		conn.SetDeadline(deadline)
+	}
+
 	// Read the version byte
 	version := []byte{0}
 	if _, err := bufConn.Read(version); err != nil {
+		err = handshakeErr(err, deadline)
 		s.config.Logger.Printf("[ERR] socks: Failed to get version byte: %v", err)
 		return err
 	}
@@ -221,7 +403,7 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	// Authenticate the connection
 	authContext, err := s.authenticate(conn, bufConn)
 	if err != nil {
-		err = fmt.Errorf("Failed to authenticate: %v", err)
+		err = fmt.Errorf("Failed to authenticate: %v", handshakeErr(err, deadline))
 		s.config.Logger.Printf("[ERR] socks: %v", err)
 		return err
 	}
@@ -233,7 +415,10 @@ func (s *Server) ServeConn(conn net.Conn) error {
 				return fmt.Errorf("Failed to send reply: %v", err)
 			}
 		}
-		return fmt.Errorf("Failed to read destination address: %v", err)
+		return fmt.Errorf("Failed to read destination address: %v", handshakeErr(err, deadline))
+	}
+	if s.config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Time{})
 	}
 	request.AuthContext = authContext
 	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
@@ -250,46 +435,11 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	return nil
 }
 
-//Monitor monitors net.conn and shows tcp.infos
-func (s *Server) Monitor(tc *tcp.Conn) {
-	fmt.Println("starting monitor for", tc.RemoteAddr())
-
-	for {
-
-		//Print tcpinfo
-		var o tcpinfo.Info
-		var b [256]byte
-		i, err := tc.Option(o.Level(), o.Name(), b[:])
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		data, err := json.Marshal(i)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		txt := string(data)
-		// info := &tcpinfo.Info{}
-		info := &MyData{}
-		json.Unmarshal([]byte(txt), &info)
-		fmt.Printf("%+v\n", info)
-		//exec.Command("iptables", "-I").Run()
-
-		//lower MSS if retransmit happened
-		switch info.System.Retransmissions {
-		case 0:
-			exec.Command("iptables", "-t", "mangle", "-R", "POSTROUTING", "1", "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS", "--set-mss", "1400")
-		default:
-			exec.Command("iptables", "-t", "mangle", "-R", "POSTROUTING", "1", "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS", "--set-mss", "200")
-			fmt.Println("Detect a retransimission! change MSS to 200")
-		}
-		time.Sleep(500 * time.Millisecond)
-		//command already added in linux's iptables: exec.Command("iptables", "-t mangle -I POSTROUTING -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss 1492")
-		//command that delete rules in iptables: exec.Command("sudo iptables", "-t mangle -F")
-		//command that Replace a rule in iptables(first line):
-		//exec.Command("sudo iptables", "-t mangle -R POSTROUTING 1 -p tcp --tcp-flags SYN,RST SYN -j TCPMSS --set-mss 1492")
-		// iptables -t mangle -I OUTPUT -p tcp --sport 80 --tcp-flags SYN,ACK SYN,ACK -j TCPWIN --tcpwin-set 1000
+// handshakeErr replaces an error raised during negotiation with
+// HandshakeTimeoutExceeded once the handshake deadline has passed
+func handshakeErr(err error, deadline time.Time) error {
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return HandshakeTimeoutExceeded
 	}
+	return err
 }
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -108,3 +109,108 @@ func TestSOCKS5_Connect(t *testing.T) {
 		t.Fatalf("bad: %v", out)
 	}
 }
+
+func TestSOCKS5_HandshakeTimeout(t *testing.T) {
+	// Create a socks server
+	conf := &Config{
+		Logger:           log.New(os.Stdout, "", log.LstdFlags),
+		HandshakeTimeout: 50 * time.Millisecond,
+	}
+	serv, err := New(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- serv.ServeConn(server) }()
+
+	// Send only the version byte and stall
+	client.Write([]byte{5})
+
+	select {
+	case err := <-errCh:
+		if err == nil || !strings.Contains(err.Error(), HandshakeTimeoutExceeded.Error()) {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("handshake did not time out")
+	}
+}
+
+func TestSOCKS5_Reload(t *testing.T) {
+	serv, err := New(&Config{Logger: log.New(os.Stdout, "", log.LstdFlags)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// negotiate offers only NoAuth and returns the method picked
+	negotiate := func() byte {
+		client, server := net.Pipe()
+		defer client.Close()
+		go serv.ServeConn(server)
+		client.Write([]byte{5, 1, NoAuth})
+		resp := make([]byte, 2)
+		client.SetDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(client, resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return resp[1]
+	}
+
+	if m := negotiate(); m != NoAuth {
+		t.Fatalf("bad method: %v", m)
+	}
+
+	// Require a password from now on
+	err = serv.Reload(&Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		Logger:      log.New(os.Stdout, "", log.LstdFlags),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if m := negotiate(); m != noAcceptable {
+		t.Fatalf("bad method after reload: %v", m)
+	}
+}
+
+func TestSOCKS5_MaxConnections(t *testing.T) {
+	serv, err := New(&Config{
+		Logger:          log.New(os.Stdout, "", log.LstdFlags),
+		MaxConnections:  1,
+		DisableMonitor:  true,
+		DisableMSSClamp: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	go serv.Serve(l)
+
+	// The first connection stays in the handshake
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer first.Close()
+	first.Write([]byte{5})
+	time.Sleep(20 * time.Millisecond)
+
+	// The second one is over the limit and gets closed
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+)
+
+var (
+	notRedirected = fmt.Errorf("Connection was not redirected to the transparent listener")
+)
+
+// originalDster is implemented by tcp.Conn
+type originalDster interface {
+	OriginalDst() (net.Addr, error)
+}
+
+// ServeTransparent serves connections redirected to l by iptables
+// REDIRECT or TPROXY. No SOCKS handshake takes place: the original
+// destination becomes a CONNECT request that goes through the same
+// rules, rewriter, dialer and monitoring as SOCKS clients.
+func (s *Server) ServeTransparent(l net.Listener) error {
+	return s.serve(l, nil, func(srv *Server, conn net.Conn) error { return srv.serveTransparentConn(conn, l.Addr()) })
+}
+
+// ServeTransparentConn serves a single redirected connection
+func (s *Server) ServeTransparentConn(conn net.Conn) error {
+	return s.serveTransparentConn(conn, nil)
+}
+
+func (s *Server) serveTransparentConn(conn net.Conn, listenAddr net.Addr) error {
+	s = s.current()
+	defer conn.Close()
+
+	dest, err := originalDst(conn, listenAddr)
+	if err != nil {
+		s.config.Logger.Printf("[ERR] socks: Failed to get original destination: %v", err)
+		return err
+	}
+
+	request := &Request{
+		Version:     socks5Version,
+		Command:     ConnectCommand,
+		AuthContext: &AuthContext{Method: NoAuth},
+		DestAddr:    &AddrSpec{IP: dest.IP, Port: dest.Port},
+		transparent: true,
+		bufConn:     conn,
+	}
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
+	}
+
+	if err := s.handleRequest(request, conn); err != nil {
+		err = fmt.Errorf("Failed to handle transparent request: %v", err)
+		s.config.Logger.Printf("[ERR] socks: %v", err)
+		return err
+	}
+	return nil
+}
+
+// originalDst recovers where the client was connecting to. REDIRECT
+// rewrites the destination and keeps the original for SO_ORIGINAL_DST,
+// with TPROXY the socket's local address already is the original
+// destination. A connection made straight to the listener is refused
+// since proxying it would loop back to ourselves.
+func originalDst(conn net.Conn, listenAddr net.Addr) (*net.TCPAddr, error) {
+	var dest *net.TCPAddr
+	if od, ok := conn.(originalDster); ok {
+		if addr, err := od.OriginalDst(); err == nil {
+			dest, _ = addr.(*net.TCPAddr)
+		}
+	}
+	if dest == nil {
+		dest, _ = conn.LocalAddr().(*net.TCPAddr)
+	}
+	if dest == nil {
+		return nil, fmt.Errorf("Unsupported address %v", conn.LocalAddr())
+	}
+
+	if listen, ok := listenAddr.(*net.TCPAddr); ok && listen.Port == dest.Port {
+		if listen.IP.IsUnspecified() || listen.IP.Equal(dest.IP) {
+			return nil, notRedirected
+		}
+	}
+	return dest, nil
+}
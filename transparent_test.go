@@ -0,0 +1,103 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// redirectedConn fakes a connection that iptables redirected from dst
+type redirectedConn struct {
+	net.Conn
+	dst net.Addr
+}
+
+func (r *redirectedConn) OriginalDst() (net.Addr, error) {
+	return r.dst, nil
+}
+
+func (r *redirectedConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 40000}
+}
+
+func TestTransparent_Connect(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	serv, err := New(&Config{Logger: log.New(os.Stdout, "", log.LstdFlags)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go serv.ServeTransparentConn(&redirectedConn{Conn: server, dst: echo.Addr()})
+
+	// The client talks to the destination directly, without SOCKS
+	client.SetDeadline(time.Now().Add(time.Second))
+	client.Write([]byte("ping"))
+	out := make([]byte, 4)
+	if _, err := io.ReadFull(client, out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(out, []byte("pong")) {
+		t.Fatalf("bad: %v", out)
+	}
+}
+
+func TestTransparent_RuleFail(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+
+	serv, err := New(&Config{
+		Rules:  PermitNone(),
+		Logger: log.New(ioutil.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	errCh := make(chan error, 1)
+	go func() { errCh <- serv.ServeTransparentConn(&redirectedConn{Conn: server, dst: echo.Addr()}) }()
+
+	// No SOCKS reply is written, the connection is just closed
+	client.SetDeadline(time.Now().Add(time.Second))
+	if n, err := client.Read(make([]byte, 16)); err != io.EOF {
+		t.Fatalf("expected close, got %d bytes, err %v", n, err)
+	}
+	if err := <-errCh; err == nil {
+		t.Fatalf("expected rule error")
+	}
+}
+
+func TestTransparent_NotRedirected(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	serv, err := New(&Config{Logger: log.New(ioutil.Discard, "", 0)})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.ServeTransparent(l)
+
+	// Connecting straight to the listener must not loop back to it
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected close, got %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mikioh/tcp"
+	"github.com/mikioh/tcpopt"
+)
+
+// SocketTuning is a set of socket options for one leg of a session.
+// Zero fields leave the kernel's setting alone.
+type SocketTuning struct {
+	// SendBuffer and ReceiveBuffer set SO_SNDBUF and SO_RCVBUF in
+	// bytes. A fixed receive buffer turns off its autotuning.
+	SendBuffer    int
+	ReceiveBuffer int
+
+	// Nagle turns TCP_NODELAY off, which Go sets on every connection.
+	Nagle bool
+
+	// Setting any of the keepalive fields turns SO_KEEPALIVE on.
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+
+	// NotSentLowWater sets TCP_NOTSENT_LOWAT, the unsent bytes above
+	// which the socket stops being writable.
+	NotSentLowWater int
+
+	// UserTimeout sets TCP_USER_TIMEOUT, how long sent data may stay
+	// unacknowledged before the connection is dropped (Linux only).
+	UserTimeout time.Duration
+}
+
+// apply sets the options on c, returning the first error
+func (t *SocketTuning) apply(c *net.TCPConn) error {
+	tc, err := tcp.NewConn(c)
+	if err != nil {
+		return err
+	}
+	var opts []tcpopt.Option
+	if t.SendBuffer > 0 {
+		opts = append(opts, tcpopt.SendBuffer(t.SendBuffer))
+	}
+	if t.ReceiveBuffer > 0 {
+		opts = append(opts, tcpopt.ReceiveBuffer(t.ReceiveBuffer))
+	}
+	if t.Nagle {
+		opts = append(opts, tcpopt.NoDelay(false))
+	}
+	if t.KeepAliveIdle > 0 || t.KeepAliveInterval > 0 || t.KeepAliveCount > 0 {
+		opts = append(opts, tcpopt.KeepAlive(true))
+	}
+	if t.KeepAliveIdle > 0 {
+		opts = append(opts, tcpopt.KeepAliveIdleInterval(t.KeepAliveIdle))
+	}
+	if t.KeepAliveInterval > 0 {
+		opts = append(opts, tcpopt.KeepAliveProbeInterval(t.KeepAliveInterval))
+	}
+	if t.KeepAliveCount > 0 {
+		opts = append(opts, tcpopt.KeepAliveProbeCount(t.KeepAliveCount))
+	}
+	if t.NotSentLowWater > 0 {
+		opts = append(opts, tcpopt.NotSentLowWMK(t.NotSentLowWater))
+	}
+	for _, o := range opts {
+		if err := tc.SetOption(o); err != nil {
+			return fmt.Errorf("%T: %v", o, err)
+		}
+	}
+	if t.UserTimeout > 0 {
+		raw, err := c.SyscallConn()
+		if err != nil {
+			return err
+		}
+		if cerr := raw.Control(func(fd uintptr) { err = setUserTimeout(fd, t.UserTimeout) }); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("user timeout: %v", err)
+		}
+	}
+	return nil
+}
+
+// TuningRule tunes the sockets of sessions it matches
+type TuningRule struct {
+	// User matches the authenticated user name, empty matches anyone.
+	User string
+
+	// Match is a destination pattern as in RewriteRule.Match,
+	// empty matches any destination.
+	Match string
+
+	// Leg limits the rule to one leg, empty for both.
+	Leg Leg
+
+	Tuning SocketTuning
+}
+
+// SocketTuner picks the tuning of each leg of a session from the first
+// matching rule for that leg
+type SocketTuner struct {
+	rules []compiledTuning
+}
+
+type compiledTuning struct {
+	TuningRule
+	matcher *addrMatcher
+}
+
+// NewSocketTuner validates rules and builds a SocketTuner
+func NewSocketTuner(rules []TuningRule) (*SocketTuner, error) {
+	t := &SocketTuner{}
+	for i, rule := range rules {
+		if rule.Leg != "" && rule.Leg != LegClient && rule.Leg != LegUpstream {
+			return nil, fmt.Errorf("tuning rule %d: unknown leg %q", i+1, rule.Leg)
+		}
+		c := compiledTuning{TuningRule: rule}
+		if rule.Match != "" {
+			m, err := compileAddrMatcher(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("tuning rule %d: match %v", i+1, err)
+			}
+			c.matcher = &m
+		}
+		t.rules = append(t.rules, c)
+	}
+	return t, nil
+}
+
+// tuning returns the first rule's tuning for leg of req
+func (t *SocketTuner) tuning(req *Request, leg Leg) *SocketTuning {
+	var user string
+	if req.AuthContext != nil {
+		user = req.AuthContext.Payload["Username"]
+	}
+	dest := req.realDestAddr
+	if dest == nil {
+		dest = req.DestAddr
+	}
+	for i := range t.rules {
+		r := &t.rules[i]
+		if r.Leg != "" && r.Leg != leg {
+			continue
+		}
+		if r.User != "" && r.User != user {
+			continue
+		}
+		if r.matcher != nil && !r.matcher.matches(dest) {
+			continue
+		}
+		return &r.Tuning
+	}
+	return nil
+}
+
+type tuningKey struct{}
+
+// WithSocketTuning sets the tuning of one leg of the connection ahead
+// of Config.Tuner. A RuleSet can use it to tune per request.
+func WithSocketTuning(ctx context.Context, leg Leg, tuning SocketTuning) context.Context {
+	tunings := make(map[Leg]SocketTuning)
+	for l, t := range tuningFromContext(ctx) {
+		tunings[l] = t
+	}
+	tunings[leg] = tuning
+	return context.WithValue(ctx, tuningKey{}, tunings)
+}
+
+func tuningFromContext(ctx context.Context) map[Leg]SocketTuning {
+	t, _ := ctx.Value(tuningKey{}).(map[Leg]SocketTuning)
+	return t
+}
+
+// applyTuning tunes both legs of the session
+func (s *Server) applyTuning(ctx context.Context, req *Request, client conn, target net.Conn) {
+	chosen := tuningFromContext(ctx)
+	for _, leg := range []Leg{LegClient, LegUpstream} {
+		var t *SocketTuning
+		if ct, ok := chosen[leg]; ok {
+			t = &ct
+		} else if s.config.Tuner != nil {
+			t = s.config.Tuner.tuning(req, leg)
+		}
+		if t == nil {
+			continue
+		}
+		var c interface{} = target
+		if leg == LegClient {
+			c = client
+		}
+		nc, ok := c.(net.Conn)
+		if !ok {
+			continue
+		}
+		raw, ok := socketOf(nc)
+		if !ok {
+			continue
+		}
+		if err := t.apply(raw); err != nil {
+			s.config.Logger.Printf("[ERR] socks: Failed to tune the %s leg: %v", leg, err)
+		}
+	}
+}
+
+// BufferGrowth grows the socket buffers of monitored legs to Factor
+// times the bandwidth-delay product seen in their samples, up to Max
+// bytes. Buffers only grow, and only past what autotuning reached on
+// its own, as a grown buffer no longer autotunes. The kernel caps the
+// sizes at net.core.wmem_max and rmem_max.
+type BufferGrowth struct {
+	// Factor defaults to 2
+	Factor float64
+	Max    int
+}
+
+// target returns the buffer size for rate bytes per second over rtt,
+// zero when nothing was measured
+func (g *BufferGrowth) target(rate float64, rtt time.Duration) int {
+	factor := g.Factor
+	if factor == 0 {
+		factor = 2
+	}
+	size := int(rate * rtt.Seconds() * factor)
+	if g.Max > 0 && size > g.Max {
+		size = g.Max
+	}
+	return size
+}
+
+// bufferSizes returns the current buffer sizes, as set with SO_SNDBUF
+// and SO_RCVBUF or grown by autotuning, half of what the kernel reports
+func bufferSizes(tc *tcp.Conn) (snd, rcv int) {
+	var b [4]byte
+	var so tcpopt.SendBuffer
+	if o, err := tc.Option(so.Level(), so.Name(), b[:]); err == nil {
+		if v, ok := o.(tcpopt.SendBuffer); ok {
+			snd = int(v) / 2
+		}
+	}
+	var ro tcpopt.ReceiveBuffer
+	if o, err := tc.Option(ro.Level(), ro.Name(), b[:]); err == nil {
+		if v, ok := o.(tcpopt.ReceiveBuffer); ok {
+			rcv = int(v) / 2
+		}
+	}
+	return snd, rcv
+}
@@ -0,0 +1,12 @@
+package socks5
+
+import (
+	"syscall"
+	"time"
+)
+
+const tcpUserTimeout = 0x12
+
+func setUserTimeout(fd uintptr, d time.Duration) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, int(d/time.Millisecond))
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import (
+	"fmt"
+	"time"
+)
+
+func setUserTimeout(fd uintptr, d time.Duration) error {
+	return fmt.Errorf("TCP user timeout is only supported on Linux")
+}
@@ -0,0 +1,165 @@
+package socks5
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kennnnny/RRDproxy/sampler"
+	"github.com/mikioh/tcp"
+	"github.com/mikioh/tcpopt"
+)
+
+func TestSocketTuner(t *testing.T) {
+	tuner, err := NewSocketTuner([]TuningRule{
+		{User: "bulk", Tuning: SocketTuning{SendBuffer: 1}},
+		{Match: "*.example.com", Leg: LegUpstream, Tuning: SocketTuning{SendBuffer: 2}},
+		{Tuning: SocketTuning{SendBuffer: 3}},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req := &Request{DestAddr: &AddrSpec{FQDN: "www.example.com", Port: 443}}
+	if got := tuner.tuning(req, LegUpstream); got == nil || got.SendBuffer != 2 {
+		t.Fatalf("bad upstream tuning: %+v", got)
+	}
+	if got := tuner.tuning(req, LegClient); got == nil || got.SendBuffer != 3 {
+		t.Fatalf("bad client tuning: %+v", got)
+	}
+	req.AuthContext = &AuthContext{Payload: map[string]string{"Username": "bulk"}}
+	if got := tuner.tuning(req, LegUpstream); got == nil || got.SendBuffer != 1 {
+		t.Fatalf("bad user tuning: %+v", got)
+	}
+
+	if _, err := NewSocketTuner([]TuningRule{{Leg: "sideways"}}); err == nil {
+		t.Fatalf("expected an unknown leg error")
+	}
+	if _, err := NewSocketTuner([]TuningRule{{Match: "10.0.0.0/99"}}); err == nil {
+		t.Fatalf("expected a bad pattern error")
+	}
+}
+
+// optionOf reads one option of c
+func optionOf(t *testing.T, c *net.TCPConn, o tcpopt.Option) tcpopt.Option {
+	tc, err := tcp.NewConn(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var b [4]byte
+	got, err := tc.Option(o.Level(), o.Name(), b[:])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return got
+}
+
+func TestSocketTuning_Apply(t *testing.T) {
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer s.Close()
+
+	tuning := SocketTuning{
+		SendBuffer:        256 << 10,
+		ReceiveBuffer:     128 << 10,
+		Nagle:             true,
+		KeepAliveIdle:     30 * time.Second,
+		KeepAliveInterval: 5 * time.Second,
+		KeepAliveCount:    4,
+		NotSentLowWater:   16 << 10,
+		UserTimeout:       10 * time.Second,
+	}
+	if err := tuning.apply(c); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got := optionOf(t, c, tcpopt.SendBuffer(0)).(tcpopt.SendBuffer); int(got) < tuning.SendBuffer {
+		t.Fatalf("send buffer %d", got)
+	}
+	if got := optionOf(t, c, tcpopt.NoDelay(false)).(tcpopt.NoDelay); got {
+		t.Fatalf("nodelay still on")
+	}
+	if got := optionOf(t, c, tcpopt.KeepAlive(false)).(tcpopt.KeepAlive); !got {
+		t.Fatalf("keepalive off")
+	}
+	if got := optionOf(t, c, tcpopt.KeepAliveProbeCount(0)).(tcpopt.KeepAliveProbeCount); got != 4 {
+		t.Fatalf("keepalive count %d", got)
+	}
+	if got := optionOf(t, c, tcpopt.NotSentLowWMK(0)).(tcpopt.NotSentLowWMK); got != 16<<10 {
+		t.Fatalf("notsent lowat %d", got)
+	}
+	raw, _ := c.SyscallConn()
+	var timeout int
+	raw.Control(func(fd uintptr) {
+		timeout, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout)
+	})
+	if timeout != 10000 {
+		t.Fatalf("user timeout %d", timeout)
+	}
+}
+
+func TestApplyTuning_RuleOverride(t *testing.T) {
+	client, _ := tcpPair(t)
+	defer client.Close()
+	target, _ := tcpPair(t)
+	defer target.Close()
+
+	tuner, _ := NewSocketTuner([]TuningRule{{Tuning: SocketTuning{NotSentLowWater: 8 << 10}}})
+	s := &Server{config: &Config{Tuner: tuner, Logger: log.New(ioutil.Discard, "", 0)}}
+	ctx := WithSocketTuning(context.Background(), LegUpstream, SocketTuning{NotSentLowWater: 32 << 10})
+	s.applyTuning(ctx, &Request{DestAddr: &AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 80}}, client, target)
+
+	if got := optionOf(t, client, tcpopt.NotSentLowWMK(0)).(tcpopt.NotSentLowWMK); got != 8<<10 {
+		t.Fatalf("client leg not tuned by the tuner: %d", got)
+	}
+	if got := optionOf(t, target, tcpopt.NotSentLowWMK(0)).(tcpopt.NotSentLowWMK); got != 32<<10 {
+		t.Fatalf("upstream leg not tuned by the rule: %d", got)
+	}
+}
+
+func TestBufferGrowth(t *testing.T) {
+	g := &BufferGrowth{Max: 4 << 20}
+	if got := g.target(1e6, 100*time.Millisecond); got != 200000 {
+		t.Fatalf("bad target: %d", got)
+	}
+	if got := g.target(1e9, time.Second); got != 4<<20 {
+		t.Fatalf("target not capped: %d", got)
+	}
+
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer s.Close()
+	tc, err := tcp.NewConn(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serv := &Server{config: &Config{BufferGrowth: g, Logger: log.New(ioutil.Discard, "", 0)}}
+	lm := &legMonitor{s: serv, tc: tc, leg: LegUpstream}
+	lm.sndbuf, lm.rcvbuf = bufferSizes(tc)
+	if lm.sndbuf == 0 || lm.rcvbuf == 0 {
+		t.Fatalf("buffer sizes not read")
+	}
+
+	// 100 MB/s over 20ms calls for 4 MB buffers
+	sample := &sampler.Sample{RTT: 20 * time.Millisecond}
+	lm.grow(g, sample, &sampler.Delta{DeliveryRate: 100e6, ReceiveRate: 100e6})
+	if snd, rcv := bufferSizes(tc); snd < 1<<20 || rcv < 1<<20 || lm.sndbuf != 4e6 {
+		t.Fatalf("buffers not grown: %d %d", snd, rcv)
+	}
+
+	// A slower interval never shrinks them
+	lm.grow(g, sample, &sampler.Delta{DeliveryRate: 1e3, ReceiveRate: 1e3})
+	if lm.sndbuf != 4e6 || lm.rcvbuf != 4e6 {
+		t.Fatalf("buffers shrunk: %d %d", lm.sndbuf, lm.rcvbuf)
+	}
+
+	// nor does a target below what the buffers grew to meanwhile
+	before, _ := bufferSizes(tc)
+	lm.sndbuf = 1000
+	lm.grow(g, sample, &sampler.Delta{DeliveryRate: 1e6})
+	if snd, _ := bufferSizes(tc); snd != before || lm.sndbuf != before {
+		t.Fatalf("send buffer set below its current size: %d, recorded %d, was %d", snd, lm.sndbuf, before)
+	}
+}
@@ -0,0 +1,395 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultPoolMaxFails      = 3
+	defaultPoolEjectDuration = 30 * time.Second
+	defaultPoolHealthTimeout = 5 * time.Second
+	poolVirtualNodes         = 64
+)
+
+var (
+	noUpstreamAvailable = fmt.Errorf("No upstream available")
+)
+
+// PoolStrategy selects which member of an UpstreamPool serves a dial
+type PoolStrategy uint8
+
+const (
+	// RoundRobin rotates through the healthy members
+	RoundRobin PoolStrategy = iota
+	// LeastConnections picks the member with the fewest open connections
+	LeastConnections
+	// ConsistentHash keeps each destination on the same member while
+	// the set of healthy members does not change
+	ConsistentHash
+)
+
+// PoolMember is an upstream of a pool, such as a direct Dialer bound to
+// an interface or an UpstreamProxy
+type PoolMember struct {
+	Name   string
+	Dialer Dialer
+}
+
+// PoolConfig configures an UpstreamPool
+type PoolConfig struct {
+	Members  []PoolMember
+	Strategy PoolStrategy
+
+	// MaxFails consecutive failures eject a member.
+	// Defaults to 3.
+	MaxFails int
+
+	// EjectDuration is how long an ejected member is skipped before it
+	// is tried again. Defaults to 30 seconds.
+	EjectDuration time.Duration
+
+	// HealthCheckAddr is dialed through every member each
+	// HealthCheckInterval. Active checks are disabled when either is
+	// unset, leaving only passive detection from failed dials.
+	HealthCheckAddr     string
+	HealthCheckInterval time.Duration
+
+	// HealthCheckTimeout bounds one active check.
+	// Defaults to five seconds.
+	HealthCheckTimeout time.Duration
+}
+
+// PoolMemberStatus is a snapshot of a pool member
+type PoolMemberStatus struct {
+	Name    string
+	Healthy bool
+	Active  int // open connections
+	Fails   int // consecutive failures
+}
+
+// UpstreamPool is a Dialer balancing connections over several members.
+// Members are ejected after repeated dial or health check failures and
+// recover once their ejection expires or a health check succeeds. When
+// every member is ejected all of them are tried.
+type UpstreamPool struct {
+	conf    PoolConfig
+	members []*poolMember
+	ring    []ringNode
+	now     func() time.Time
+
+	mu   sync.Mutex
+	next int
+
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+type poolMember struct {
+	PoolMember
+	active       int
+	fails        int
+	ejectedUntil time.Time
+}
+
+type ringNode struct {
+	hash   uint32
+	member int
+}
+
+// NewUpstreamPool validates conf and starts active health checks when
+// configured. Close stops them.
+func NewUpstreamPool(conf PoolConfig) (*UpstreamPool, error) {
+	if len(conf.Members) == 0 {
+		return nil, fmt.Errorf("Upstream pool has no members")
+	}
+	if conf.MaxFails <= 0 {
+		conf.MaxFails = defaultPoolMaxFails
+	}
+	if conf.EjectDuration <= 0 {
+		conf.EjectDuration = defaultPoolEjectDuration
+	}
+	if conf.HealthCheckTimeout <= 0 {
+		conf.HealthCheckTimeout = defaultPoolHealthTimeout
+	}
+
+	p := &UpstreamPool{conf: conf, now: time.Now, stop: make(chan struct{})}
+	seen := make(map[string]bool)
+	for i, m := range conf.Members {
+		if m.Dialer == nil {
+			return nil, fmt.Errorf("Upstream pool member %d has no dialer", i+1)
+		}
+		if m.Name == "" {
+			m.Name = strconv.Itoa(i + 1)
+		}
+		if seen[m.Name] {
+			return nil, fmt.Errorf("Duplicate upstream pool member %q", m.Name)
+		}
+		seen[m.Name] = true
+		p.members = append(p.members, &poolMember{PoolMember: m})
+		for v := 0; v < poolVirtualNodes; v++ {
+			key := m.Name + "#" + strconv.Itoa(v)
+			p.ring = append(p.ring, ringNode{crc32.ChecksumIEEE([]byte(key)), i})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+
+	if conf.HealthCheckAddr != "" && conf.HealthCheckInterval > 0 {
+		p.wg.Add(1)
+		go p.healthLoop()
+	}
+	return p, nil
+}
+
+// Close stops active health checks. It may be called more than once.
+func (p *UpstreamPool) Close() error {
+	p.closeOnce.Do(func() { close(p.stop) })
+	p.wg.Wait()
+	return nil
+}
+
+// Status returns a snapshot of every member
+func (p *UpstreamPool) Status() []PoolMemberStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	out := make([]PoolMemberStatus, len(p.members))
+	for i, m := range p.members {
+		out[i] = PoolMemberStatus{
+			Name:    m.Name,
+			Healthy: !now.Before(m.ejectedUntil),
+			Active:  m.active,
+			Fails:   m.fails,
+		}
+	}
+	return out
+}
+
+// DialContext dials through the member chosen by the strategy, moving
+// on to the next candidate when a member itself fails. Failures of the
+// destination are returned as is, see destinationError.
+// resolvesRemotely holds when every member reaches dest through a proxy
+func (p *UpstreamPool) resolvesRemotely(ctx context.Context, dest *AddrSpec) bool {
+	for _, m := range p.members {
+		if !resolvesRemotely(ctx, m.Dialer, dest) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *UpstreamPool) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var lastErr error
+	for _, idx := range p.candidates(ctx, addr) {
+		m := p.members[idx]
+		p.mu.Lock()
+		m.active++
+		p.mu.Unlock()
+
+		conn, err := m.Dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			p.report(m, nil)
+			return &poolConn{Conn: conn, pool: p, member: m}, nil
+		}
+		p.release(m)
+
+		// Cancellation and destination failures say nothing about the
+		// member's health, and another member would meet them too
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if destinationError(err) {
+			p.report(m, nil)
+			return nil, err
+		}
+		p.report(m, err)
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = noUpstreamAvailable
+	}
+	return nil, lastErr
+}
+
+// destinationError reports whether err is the destination's doing: a
+// refusal relayed by an upstream proxy, or a destination that refused
+// or could not be reached when dialed directly. Failing to reach a
+// proxy, or to complete its handshake, is the member's.
+func destinationError(err error) bool {
+	var hopErr *upstreamHopError
+	if errors.As(err, &hopErr) {
+		return false
+	}
+	var replyErr *upstreamReplyError
+	if errors.As(err, &replyErr) {
+		return true
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.EHOSTDOWN:
+			return true
+		}
+	}
+	return false
+}
+
+// candidates orders members for a dial: healthy ones picked by the
+// strategy first, or all of them when none is healthy
+func (p *UpstreamPool) candidates(ctx context.Context, addr string) []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	var healthy []int
+	for i, m := range p.members {
+		if !now.Before(m.ejectedUntil) {
+			healthy = append(healthy, i)
+		}
+	}
+	if len(healthy) == 0 {
+		for i := range p.members {
+			healthy = append(healthy, i)
+		}
+	}
+
+	switch p.conf.Strategy {
+	case LeastConnections:
+		// Ties go round-robin, so an idle pool still spreads the load
+		order := p.rotate(healthy)
+		sort.SliceStable(order, func(i, j int) bool {
+			return p.members[order[i]].active < p.members[order[j]].active
+		})
+		return order
+
+	case ConsistentHash:
+		return p.ringOrder(poolHashKey(ctx, addr), healthy)
+
+	default:
+		return p.rotate(healthy)
+	}
+}
+
+// rotate returns members starting from the next turn, called with p.mu
+// held
+func (p *UpstreamPool) rotate(members []int) []int {
+	start := p.next % len(members)
+	p.next++
+	order := make([]int, 0, len(members))
+	order = append(order, members[start:]...)
+	return append(order, members[:start]...)
+}
+
+// ringOrder walks the hash ring from key and lists the allowed members
+// in the order they are met
+func (p *UpstreamPool) ringOrder(key string, allowed []int) []int {
+	ok := make(map[int]bool, len(allowed))
+	for _, i := range allowed {
+		ok[i] = true
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+
+	var out []int
+	seen := make(map[int]bool)
+	for i := 0; i < len(p.ring) && len(out) < len(allowed); i++ {
+		n := p.ring[(start+i)%len(p.ring)]
+		if ok[n.member] && !seen[n.member] {
+			seen[n.member] = true
+			out = append(out, n.member)
+		}
+	}
+	return out
+}
+
+// poolHashKey is the requested destination, so that all addresses of
+// one name land on the same member
+func poolHashKey(ctx context.Context, addr string) string {
+	if req, ok := RequestFromContext(ctx); ok && req.realDestAddr != nil && req.realDestAddr.FQDN != "" {
+		return net.JoinHostPort(req.realDestAddr.FQDN, strconv.Itoa(req.realDestAddr.Port))
+	}
+	return addr
+}
+
+// report records the outcome of using a member
+func (p *UpstreamPool) report(m *poolMember, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		m.fails = 0
+		m.ejectedUntil = time.Time{}
+		return
+	}
+	m.fails++
+	if m.fails >= p.conf.MaxFails {
+		m.ejectedUntil = p.now().Add(p.conf.EjectDuration)
+	}
+}
+
+func (p *UpstreamPool) release(m *poolMember) {
+	p.mu.Lock()
+	m.active--
+	p.mu.Unlock()
+}
+
+func (p *UpstreamPool) healthLoop() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.conf.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.checkHealth()
+		}
+	}
+}
+
+// checkHealth dials HealthCheckAddr through every member in parallel
+func (p *UpstreamPool) checkHealth() {
+	var wg sync.WaitGroup
+	for _, m := range p.members {
+		wg.Add(1)
+		go func(m *poolMember) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), p.conf.HealthCheckTimeout)
+			defer cancel()
+			conn, err := m.Dialer.DialContext(ctx, "tcp", p.conf.HealthCheckAddr)
+			if err == nil {
+				conn.Close()
+			}
+			p.report(m, err)
+		}(m)
+	}
+	wg.Wait()
+}
+
+// poolConn releases its member's connection slot when closed
+type poolConn struct {
+	net.Conn
+	pool   *UpstreamPool
+	member *poolMember
+	once   sync.Once
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(func() { c.pool.release(c.member) })
+	return c.Conn.Close()
+}
+
+func (c *poolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
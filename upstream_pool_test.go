@@ -0,0 +1,297 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// poolTestDialer hands out one side of a pipe, or fails while down
+type poolTestDialer struct {
+	mu    sync.Mutex
+	down  bool
+	dials int
+}
+
+func (d *poolTestDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	if d.down {
+		return nil, fmt.Errorf("connection refused")
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func (d *poolTestDialer) setDown(down bool) {
+	d.mu.Lock()
+	d.down = down
+	d.mu.Unlock()
+}
+
+func (d *poolTestDialer) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials
+}
+
+func newTestPool(t *testing.T, strategy PoolStrategy, dialers ...*poolTestDialer) *UpstreamPool {
+	var members []PoolMember
+	for i, d := range dialers {
+		members = append(members, PoolMember{Name: fmt.Sprintf("m%d", i), Dialer: d})
+	}
+	p, err := NewUpstreamPool(PoolConfig{Members: members, Strategy: strategy, MaxFails: 2})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return p
+}
+
+func TestUpstreamPool_RoundRobin(t *testing.T) {
+	a, b := &poolTestDialer{}, &poolTestDialer{}
+	p := newTestPool(t, RoundRobin, a, b)
+	defer p.Close()
+
+	for i := 0; i < 4; i++ {
+		conn, err := p.DialContext(context.Background(), "tcp", "192.0.2.1:80")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.Close()
+	}
+	if a.count() != 2 || b.count() != 2 {
+		t.Fatalf("bad spread: %d %d", a.count(), b.count())
+	}
+}
+
+func TestUpstreamPool_LeastConnections(t *testing.T) {
+	a, b := &poolTestDialer{}, &poolTestDialer{}
+	p := newTestPool(t, LeastConnections, a, b)
+	defer p.Close()
+
+	// Keep the first connection open, the next two must avoid it
+	held, _ := p.DialContext(context.Background(), "tcp", "192.0.2.1:80")
+	for i := 0; i < 2; i++ {
+		conn, _ := p.DialContext(context.Background(), "tcp", "192.0.2.1:80")
+		conn.Close()
+	}
+	if a.count() != 1 || b.count() != 2 {
+		t.Fatalf("bad spread: %d %d", a.count(), b.count())
+	}
+	held.Close()
+	held.Close()
+	if st := p.Status(); st[0].Active != 0 {
+		t.Fatalf("bad status: %+v", st)
+	}
+
+	// Ties are broken in turn
+	for i := 0; i < 4; i++ {
+		conn, _ := p.DialContext(context.Background(), "tcp", "192.0.2.1:80")
+		conn.Close()
+	}
+	if a.count() != 3 || b.count() != 4 {
+		t.Fatalf("bad spread over an idle pool: %d %d", a.count(), b.count())
+	}
+}
+
+func TestUpstreamPool_ConsistentHash(t *testing.T) {
+	dialers := []*poolTestDialer{{}, {}, {}}
+	p := newTestPool(t, ConsistentHash, dialers...)
+	defer p.Close()
+
+	owner := func() int {
+		for i, d := range dialers {
+			if d.count() > 0 {
+				return i
+			}
+		}
+		return -1
+	}
+	for i := 0; i < 5; i++ {
+		conn, err := p.DialContext(context.Background(), "tcp", "198.51.100.7:443")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.Close()
+	}
+	first := owner()
+	if dialers[first].count() != 5 {
+		t.Fatalf("destination moved between members")
+	}
+
+	// When the owner fails the destination moves to another member
+	dialers[first].setDown(true)
+	conn, err := p.DialContext(context.Background(), "tcp", "198.51.100.7:443")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+}
+
+func TestUpstreamPool_EjectAndRecover(t *testing.T) {
+	a, b := &poolTestDialer{down: true}, &poolTestDialer{}
+	p := newTestPool(t, RoundRobin, a, b)
+	defer p.Close()
+	now := time.Unix(1000, 0)
+	p.now = func() time.Time { return now }
+
+	// Failures of a fall over to b until a is ejected
+	for i := 0; i < 4; i++ {
+		conn, err := p.DialContext(context.Background(), "tcp", "192.0.2.1:80")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		conn.Close()
+	}
+	if st := p.Status(); st[0].Healthy || st[0].Fails != 2 {
+		t.Fatalf("expected a to be ejected: %+v", st)
+	}
+	dialsWhileEjected := a.count()
+	conn, _ := p.DialContext(context.Background(), "tcp", "192.0.2.1:80")
+	conn.Close()
+	if a.count() != dialsWhileEjected {
+		t.Fatalf("ejected member was dialed")
+	}
+
+	// After the ejection expires a successful dial restores it
+	a.setDown(false)
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		conn, _ := p.DialContext(context.Background(), "tcp", "192.0.2.1:80")
+		conn.Close()
+	}
+	if st := p.Status(); !st[0].Healthy || st[0].Fails != 0 {
+		t.Fatalf("expected a to recover: %+v", st)
+	}
+}
+
+func TestUpstreamPool_HealthCheck(t *testing.T) {
+	a := &poolTestDialer{down: true}
+	p, err := NewUpstreamPool(PoolConfig{
+		Members:             []PoolMember{{Name: "a", Dialer: a}},
+		MaxFails:            1,
+		HealthCheckAddr:     "192.0.2.1:80",
+		HealthCheckInterval: 5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer p.Close()
+
+	waitFor := func(healthy bool) {
+		deadline := time.Now().Add(time.Second)
+		for p.Status()[0].Healthy != healthy {
+			if time.Now().After(deadline) {
+				t.Fatalf("member never became healthy=%v", healthy)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor(false)
+	a.setDown(false)
+	waitFor(true)
+}
+
+func TestUpstreamPool_ReplyErrorKeepsMemberHealthy(t *testing.T) {
+	refusing := DialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, &upstreamReplyError{Proxy: "socks5://gw", Reply: connectionRefused}
+	})
+	p, _ := NewUpstreamPool(PoolConfig{Members: []PoolMember{{Dialer: refusing}}, MaxFails: 1})
+	defer p.Close()
+
+	if _, err := p.DialContext(context.Background(), "tcp", "192.0.2.1:80"); err == nil {
+		t.Fatalf("expected error")
+	}
+	if st := p.Status(); !st[0].Healthy {
+		t.Fatalf("bad status: %+v", st)
+	}
+}
+
+// closedAddr returns an address nothing listens on
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestUpstreamPool_DestinationErrors(t *testing.T) {
+	closed := closedAddr(t)
+	httpProxy := startHTTPUpstream(t)
+	defer httpProxy.Close()
+
+	var dials [2]int
+	counting := func(i int, d Dialer) Dialer {
+		return DialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials[i]++
+			return d.DialContext(ctx, network, addr)
+		})
+	}
+	cases := []struct {
+		name   string
+		member Dialer
+	}{
+		// A refusal from a destination dialed directly
+		{"direct", &net.Dialer{}},
+		// A refusal relayed by an HTTP proxy as 502 Bad Gateway
+		{"http", &UpstreamProxy{Type: UpstreamHTTP, Addr: httpProxy.Addr().String(), Username: "user", Password: "pass"}},
+	}
+	for _, c := range cases {
+		dials = [2]int{}
+		p, _ := NewUpstreamPool(PoolConfig{
+			Members:  []PoolMember{{Dialer: counting(0, c.member)}, {Dialer: counting(1, c.member)}},
+			MaxFails: 1,
+		})
+		for i := 0; i < 3; i++ {
+			_, err := p.DialContext(context.Background(), "tcp", closed)
+			if err == nil {
+				t.Fatalf("%s: expected error", c.name)
+			}
+			if cat := ClassifyError(err); cat != CategoryRefused && cat != CategoryHostUnreachable {
+				t.Fatalf("%s: bad category %v for %v", c.name, cat, err)
+			}
+		}
+		if dials[0]+dials[1] != 3 {
+			t.Fatalf("%s: failed over on a destination error: %v", c.name, dials)
+		}
+		for _, st := range p.Status() {
+			if !st.Healthy || st.Fails != 0 {
+				t.Fatalf("%s: member blamed for the destination: %+v", c.name, st)
+			}
+		}
+		p.Close()
+	}
+
+	// A proxy that cannot be reached is the member's failure
+	dials = [2]int{}
+	p, _ := NewUpstreamPool(PoolConfig{
+		Members: []PoolMember{
+			{Dialer: counting(0, &UpstreamProxy{Type: UpstreamSOCKS5, Addr: closed})},
+			{Dialer: counting(1, &UpstreamProxy{Type: UpstreamSOCKS5, Addr: closed})},
+		},
+		MaxFails: 1,
+	})
+	_, err := p.DialContext(context.Background(), "tcp", "192.0.2.1:80")
+	if err == nil || ClassifyError(err) != CategoryServerFailure {
+		t.Fatalf("bad error: %v", err)
+	}
+	if dials != [2]int{1, 1} {
+		t.Fatalf("expected a failover, got %v", dials)
+	}
+	for _, st := range p.Status() {
+		if st.Healthy {
+			t.Fatalf("unreachable member still healthy: %+v", st)
+		}
+	}
+
+	// Close may be called twice
+	p.Close()
+	p.Close()
+}
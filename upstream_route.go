@@ -0,0 +1,122 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+type requestKey struct{}
+type dialRouteKey struct{}
+
+// RequestFromContext returns the request being served; it is available
+// to the dialer of a CONNECT
+func RequestFromContext(ctx context.Context) (*Request, bool) {
+	req, ok := ctx.Value(requestKey{}).(*Request)
+	return req, ok
+}
+
+// WithDialRoute selects a named DialRoute for the connection. A RuleSet
+// can use it to steer a request through a specific upstream.
+func WithDialRoute(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, dialRouteKey{}, name)
+}
+
+// DialRoute sends destinations through Dialer
+type DialRoute struct {
+	// Name lets a RuleSet pick the route with WithDialRoute.
+	Name string
+
+	// Match is a destination pattern as in RewriteRule.Match. Routes
+	// without one are only used when selected by name.
+	Match string
+
+	// Dialer makes the connection, for example an UpstreamProxy or a
+	// Chain of them.
+	Dialer Dialer
+}
+
+// RouteDialer is a Dialer choosing among routes per destination. A
+// route selected with WithDialRoute takes precedence, otherwise the
+// first route whose Match fits the destination is used, and Default
+// when none does.
+type RouteDialer struct {
+	routes  []compiledRoute
+	byName  map[string]Dialer
+	Default Dialer
+}
+
+type compiledRoute struct {
+	addrMatcher
+	dialer Dialer
+}
+
+// NewRouteDialer validates routes and builds a RouteDialer. A nil
+// def dials directly.
+func NewRouteDialer(routes []DialRoute, def Dialer) (*RouteDialer, error) {
+	if def == nil {
+		def = &net.Dialer{}
+	}
+	r := &RouteDialer{byName: make(map[string]Dialer), Default: def}
+	for i, route := range routes {
+		if route.Dialer == nil {
+			return nil, fmt.Errorf("dial route %d: no dialer", i+1)
+		}
+		if route.Name != "" {
+			if _, dup := r.byName[route.Name]; dup {
+				return nil, fmt.Errorf("dial route %d: duplicate name %q", i+1, route.Name)
+			}
+			r.byName[route.Name] = route.Dialer
+		}
+		if route.Match == "" {
+			if route.Name == "" {
+				return nil, fmt.Errorf("dial route %d: needs a name or a match", i+1)
+			}
+			continue
+		}
+		m, err := compileAddrMatcher(route.Match)
+		if err != nil {
+			return nil, fmt.Errorf("dial route %d: match %v", i+1, err)
+		}
+		r.routes = append(r.routes, compiledRoute{m, route.Dialer})
+	}
+	return r, nil
+}
+
+func (r *RouteDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dest, err := addrSpecFromString(addr)
+	if err != nil {
+		return nil, err
+	}
+	if req, ok := RequestFromContext(ctx); ok && req.realDestAddr != nil && req.realDestAddr.Port == dest.Port && dest.FQDN == "" {
+		// Keep the requested name alongside the address being dialed
+		dest.FQDN = req.realDestAddr.FQDN
+	}
+	d, err := r.pick(ctx, dest)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+func (r *RouteDialer) resolvesRemotely(ctx context.Context, dest *AddrSpec) bool {
+	d, err := r.pick(ctx, dest)
+	return err == nil && resolvesRemotely(ctx, d, dest)
+}
+
+// pick chooses the dialer for dest, the route named in ctx if any
+func (r *RouteDialer) pick(ctx context.Context, dest *AddrSpec) (Dialer, error) {
+	if name, ok := ctx.Value(dialRouteKey{}).(string); ok {
+		d, found := r.byName[name]
+		if !found {
+			return nil, fmt.Errorf("Unknown dial route %q", name)
+		}
+		return d, nil
+	}
+	for i := range r.routes {
+		if r.routes[i].matches(dest) {
+			return r.routes[i].dialer, nil
+		}
+	}
+	return r.Default, nil
+}
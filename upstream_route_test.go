@@ -0,0 +1,67 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// namedDialer fails with its own name so tests can see which was used
+type namedDialer string
+
+func (n namedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return nil, fmt.Errorf("%s", string(n))
+}
+
+func TestRouteDialer(t *testing.T) {
+	r, err := NewRouteDialer([]DialRoute{
+		{Match: "*.eu.example", Dialer: namedDialer("eu")},
+		{Match: "10.0.0.0/8:443", Dialer: namedDialer("internal")},
+		{Name: "audit", Dialer: namedDialer("audit")},
+	}, namedDialer("direct"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	used := func(ctx context.Context, addr string) string {
+		_, err := r.DialContext(ctx, "tcp", addr)
+		return err.Error()
+	}
+	ctx := context.Background()
+
+	if got := used(ctx, "10.1.2.3:443"); got != "internal" {
+		t.Fatalf("bad: %v", got)
+	}
+	if got := used(ctx, "10.1.2.3:80"); got != "direct" {
+		t.Fatalf("bad: %v", got)
+	}
+
+	// Names come from the request even though an address is dialed
+	req := &Request{realDestAddr: &AddrSpec{FQDN: "api.eu.example", IP: net.IPv4(192, 0, 2, 1), Port: 443}}
+	reqCtx := context.WithValue(ctx, requestKey{}, req)
+	if got := used(reqCtx, "192.0.2.1:443"); got != "eu" {
+		t.Fatalf("bad: %v", got)
+	}
+
+	if got := used(WithDialRoute(reqCtx, "audit"), "192.0.2.1:443"); got != "audit" {
+		t.Fatalf("bad: %v", got)
+	}
+	if got := used(WithDialRoute(ctx, "missing"), "192.0.2.1:443"); got == "direct" {
+		t.Fatalf("expected unknown route error")
+	}
+}
+
+func TestRouteDialer_Invalid(t *testing.T) {
+	invalid := [][]DialRoute{
+		{{Match: "*.example"}},
+		{{Dialer: namedDialer("x")}},
+		{{Name: "a", Dialer: namedDialer("x")}, {Name: "a", Dialer: namedDialer("y")}},
+		{{Match: "10.0.0.0/99", Dialer: namedDialer("x")}},
+	}
+	for _, routes := range invalid {
+		if _, err := NewRouteDialer(routes, nil); err == nil {
+			t.Fatalf("%+v: expected error", routes)
+		}
+	}
+}
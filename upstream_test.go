@@ -0,0 +1,253 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// startEcho serves a listener that answers "ping" with "pong"
+func startEcho(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 4)
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				if bytes.Equal(buf, []byte("ping")) {
+					conn.Write([]byte("pong"))
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+// startSOCKS5Upstream runs a Server requiring foo/bar credentials
+func startSOCKS5Upstream(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	serv, err := New(&Config{
+		Credentials: StaticCredentials{"foo": "bar"},
+		Logger:      log.New(ioutil.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go serv.Serve(l)
+	return l
+}
+
+// startHTTPUpstream runs a CONNECT proxy requiring user/pass
+func startHTTPUpstream(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "only CONNECT", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != expected {
+			http.Error(w, "auth required", http.StatusProxyAuthRequired)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+	}))
+	return l
+}
+
+func pingPong(t *testing.T, d Dialer, addr string) {
+	conn, err := d.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(buf, []byte("pong")) {
+		t.Fatalf("bad: %v", buf)
+	}
+}
+
+func TestUpstreamProxy_SOCKS5(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	upstream := startSOCKS5Upstream(t)
+	defer upstream.Close()
+
+	p, err := ParseUpstreamURL("socks5://foo:bar@" + upstream.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pingPong(t, p, echo.Addr().String())
+
+	p.Password = "wrong"
+	if _, err := p.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Fatalf("expected auth failure")
+	}
+}
+
+func TestUpstreamProxy_HTTP(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	upstream := startHTTPUpstream(t)
+	defer upstream.Close()
+
+	p, err := ParseUpstreamURL("http://user:pass@" + upstream.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pingPong(t, p, echo.Addr().String())
+
+	p.Username = ""
+	if _, err := p.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Fatalf("expected auth failure")
+	}
+}
+
+func TestUpstreamProxy_Chain(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	first := startHTTPUpstream(t)
+	defer first.Close()
+	second := startSOCKS5Upstream(t)
+	defer second.Close()
+
+	hop1, _ := ParseUpstreamURL("http://user:pass@" + first.Addr().String())
+	hop2, _ := ParseUpstreamURL("socks5://foo:bar@" + second.Addr().String())
+	pingPong(t, Chain(nil, hop1, hop2), echo.Addr().String())
+
+	if hop2.Forward != nil {
+		t.Fatalf("chain must not modify its hops")
+	}
+}
+
+func TestParseUpstreamURL(t *testing.T) {
+	p, err := ParseUpstreamURL("socks5://gw.example")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if p.Type != UpstreamSOCKS5 || p.Addr != "gw.example:1080" {
+		t.Fatalf("bad: %+v", p)
+	}
+
+	for _, raw := range []string{"ftp://gw.example", "socks5://", "http://:8080"} {
+		if _, err := ParseUpstreamURL(raw); err == nil {
+			t.Fatalf("%s: expected error", raw)
+		}
+	}
+}
+
+// gatewayRules sends names under gw through the route of that name
+type gatewayRules struct{}
+
+func (gatewayRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	if strings.HasSuffix(req.DestAddr.FQDN, ".gw") {
+		ctx = WithDialRoute(ctx, "gw")
+	}
+	return ctx, true
+}
+
+func TestRequest_UpstreamResolves(t *testing.T) {
+	echo := startEcho(t)
+	defer echo.Close()
+	port := echo.Addr().(*net.TCPAddr).Port
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	remote := &mapResolver{addrs: map[string]net.IP{
+		"echo.remote": net.IPv4(127, 0, 0, 1),
+		"echo.gw":     net.IPv4(127, 0, 0, 1),
+	}}
+	upstream, _ := New(&Config{Resolver: remote, Logger: log.New(ioutil.Discard, "", 0)})
+	go upstream.Serve(l)
+
+	proxy, _ := ParseUpstreamURL("socks5://" + l.Addr().String())
+	rd, err := NewRouteDialer([]DialRoute{
+		{Match: "*.remote", Dialer: proxy},
+		{Name: "gw", Dialer: proxy},
+	}, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []struct {
+		fqdn           string
+		local, proxied []string
+	}{
+		// The proxy is handed the name
+		{"echo.remote", nil, []string{"echo.remote"}},
+		// Also when the rules pick the route, local DNS not knowing it
+		{"echo.gw", nil, []string{"echo.gw"}},
+		// Direct routes resolve locally
+		{"echo.local", []string{"echo.local"}, nil},
+	}
+	for _, c := range cases {
+		remote.lookup = nil
+		local := &mapResolver{addrs: map[string]net.IP{"echo.local": net.IPv4(127, 0, 0, 1)}}
+		s := &Server{config: &Config{
+			Rules:    gatewayRules{},
+			Resolver: local,
+			Dialer:   rd,
+			Logger:   log.New(ioutil.Discard, "", 0),
+		}}
+		req := &Request{
+			Version:  socks5Version,
+			Command:  ConnectCommand,
+			DestAddr: &AddrSpec{FQDN: c.fqdn, Port: port},
+			bufConn:  bytes.NewReader([]byte("ping")),
+		}
+		resp := &MockConn{}
+		if err := s.handleRequest(req, resp); err != nil {
+			t.Fatalf("%s: err: %v", c.fqdn, err)
+		}
+		if out := resp.buf.Bytes(); out[1] != successReply || !bytes.HasSuffix(out, []byte("pong")) {
+			t.Fatalf("%s: bad reply: %v", c.fqdn, out)
+		}
+		if fmt.Sprint(local.lookup) != fmt.Sprint(c.local) || fmt.Sprint(remote.lookup) != fmt.Sprint(c.proxied) {
+			t.Fatalf("%s: looked up %v locally and %v upstream", c.fqdn, local.lookup, remote.lookup)
+		}
+	}
+}